@@ -0,0 +1,257 @@
+// Package config holds the server settings, loaded from a JSON file on top
+// of built-in defaults.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	// ListenAddr is the host:port the server listens on. A PORT environment
+	// variable, as set by most PaaS hosts, takes precedence.
+	ListenAddr string `json:"listenAddr"`
+
+	// AssetsDir holds the map and token images served under /assets.
+	AssetsDir string `json:"assetsDir"`
+	// MaxUploadBytes caps the size of uploaded images.
+	MaxUploadBytes int64 `json:"maxUploadBytes"`
+
+	MaxSessions int `json:"maxSessions"`
+	// MaxSpectators caps read-only connections per session; 0 means no limit.
+	MaxSpectators int `json:"maxSpectators"`
+	// MaxTokensPerSession caps the tokens on a session's board; adds beyond
+	// it are refused. 0 means no limit.
+	MaxTokensPerSession int `json:"maxTokensPerSession"`
+
+	// Longest accepted names/labels (token names, conditions) and free text,
+	// in characters. Longer input is truncated.
+	MaxNameLength int `json:"maxNameLength"`
+	MaxTextLength int `json:"maxTextLength"`
+	// MaxSessionNameLength caps session names and system tags the same way.
+	MaxSessionNameLength int `json:"maxSessionNameLength"`
+
+	// HeartbeatSec is how often each connection is pinged; a client that
+	// misses a full interval without answering is disconnected. 0 disables it.
+	HeartbeatSec int `json:"heartbeatSec"`
+
+	// IdleTimeoutSec is how long a session may go without a command before
+	// it is closed and deleted. 0 keeps sessions forever.
+	IdleTimeoutSec int `json:"idleTimeoutSec"`
+
+	// SessionTTLSec is how long a session may live after creation, however
+	// active it is. 0 lets sessions live until they go idle.
+	SessionTTLSec int `json:"sessionTtlSec"`
+
+	// MaxCommandsPerSec caps the commands each connection may send; the
+	// excess is dropped. 0 disables the limit.
+	MaxCommandsPerSec int `json:"maxCommandsPerSec"`
+
+	// ReconnectWindowSec is how long after disconnecting a client may rejoin
+	// with its reconnection token and keep its ID, name and role. While a
+	// GM's window is open nobody else becomes GM. 0 disables reconnection.
+	ReconnectWindowSec int `json:"reconnectWindowSec"`
+
+	// BroadcastCoalesceMs collapses the state broadcasts of commands sent
+	// within this many milliseconds of each other into one. 0 broadcasts
+	// after every command.
+	BroadcastCoalesceMs int `json:"broadcastCoalesceMs"`
+
+	// UndoDepth is how many previous states each session keeps for undo.
+	UndoDepth int `json:"undoDepth"`
+
+	// DefaultBackground and DefaultGridUnit set up the board of every new
+	// session.
+	DefaultBackground string  `json:"defaultBackground"`
+	DefaultGridUnit   float64 `json:"defaultGridUnit"`
+
+	// AllowedOrigins lists the Origin headers accepted on WebSocket upgrades.
+	// "*" accepts any origin.
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// AdminToken guards the admin endpoints; when empty they are refused.
+	AdminToken string `json:"adminToken"`
+	// DebugEnabled exposes the /debug endpoints.
+	DebugEnabled bool `json:"debugEnabled"`
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:           ":3000",
+		AssetsDir:            "./assets",
+		MaxUploadBytes:       10 << 20,
+		MaxSessions:          5,
+		MaxSpectators:        10,
+		MaxTokensPerSession:  500,
+		MaxNameLength:        64,
+		MaxTextLength:        1000,
+		MaxSessionNameLength: 80,
+		HeartbeatSec:         30,
+		IdleTimeoutSec:       3600,
+		MaxCommandsPerSec:    30,
+		ReconnectWindowSec:   300,
+		UndoDepth:            20,
+		DefaultBackground:    "/assets/default/maps/tavern.jpg",
+		DefaultGridUnit:      96,
+		AllowedOrigins:       []string{"*"},
+	}
+}
+
+// Load reads the JSON file at path over the defaults, so the file only needs
+// the fields it wants to change, then applies environment overrides. A
+// missing file yields the defaults.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return Default(), err
+		}
+	}
+
+	cfg.applyEnv()
+	return cfg, nil
+}
+
+// applyEnv overrides settings from QTT_* environment variables, which take
+// precedence over the file. Integers that don't parse are ignored with a
+// warning.
+func (c *Config) applyEnv() {
+	ints := map[string]*int{
+		"QTT_MAX_SESSIONS":           &c.MaxSessions,
+		"QTT_MAX_SPECTATORS":         &c.MaxSpectators,
+		"QTT_MAX_TOKENS_PER_SESSION": &c.MaxTokensPerSession,
+		"QTT_HEARTBEAT_SEC":          &c.HeartbeatSec,
+		"QTT_IDLE_TIMEOUT_SEC":       &c.IdleTimeoutSec,
+		"QTT_SESSION_TTL_SEC":        &c.SessionTTLSec,
+		"QTT_MAX_COMMANDS_PER_SEC":   &c.MaxCommandsPerSec,
+	}
+	for name, field := range ints {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("warning: ignoring %s=%q: not an integer\n", name, value)
+			continue
+		}
+		*field = n
+	}
+
+	if value, ok := os.LookupEnv("QTT_LISTEN_ADDR"); ok {
+		c.ListenAddr = value
+	}
+	if value, ok := os.LookupEnv("QTT_ASSETS_DIR"); ok {
+		c.AssetsDir = value
+	}
+	if value, ok := os.LookupEnv("QTT_ADMIN_TOKEN"); ok {
+		c.AdminToken = value
+	}
+	if value, ok := os.LookupEnv("QTT_ALLOWED_ORIGINS"); ok {
+		c.AllowedOrigins = splitList(value)
+	}
+}
+
+// splitList parses a comma-separated environment value, dropping blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// OriginAllowed reports whether a WebSocket upgrade from origin is accepted.
+// Requests without an Origin header come from non-browser clients and are
+// always let through.
+func (c Config) OriginAllowed(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate clamps settings that would leave the server unusable: a
+// non-positive MaxSessions, MaxUploadBytes or DefaultGridUnit goes back to
+// its default, and negative values for settings where 0 means "off" become
+// 0. Each change is logged.
+func (c *Config) Validate() {
+	if c.MaxSessions <= 0 {
+		log.Printf("warning: maxSessions %d is not positive, using %d\n", c.MaxSessions, Default().MaxSessions)
+		c.MaxSessions = Default().MaxSessions
+	}
+	if c.MaxUploadBytes <= 0 {
+		log.Printf("warning: maxUploadBytes %d is not positive, using %d\n", c.MaxUploadBytes, Default().MaxUploadBytes)
+		c.MaxUploadBytes = Default().MaxUploadBytes
+	}
+	if c.DefaultGridUnit <= 0 {
+		log.Printf("warning: defaultGridUnit %v is not positive, using %v\n", c.DefaultGridUnit, Default().DefaultGridUnit)
+		c.DefaultGridUnit = Default().DefaultGridUnit
+	}
+
+	nonNegative := []struct {
+		name  string
+		field *int
+	}{
+		{"maxSpectators", &c.MaxSpectators},
+		{"maxTokensPerSession", &c.MaxTokensPerSession},
+		{"maxNameLength", &c.MaxNameLength},
+		{"maxTextLength", &c.MaxTextLength},
+		{"maxSessionNameLength", &c.MaxSessionNameLength},
+		{"heartbeatSec", &c.HeartbeatSec},
+		{"idleTimeoutSec", &c.IdleTimeoutSec},
+		{"sessionTtlSec", &c.SessionTTLSec},
+		{"maxCommandsPerSec", &c.MaxCommandsPerSec},
+		{"reconnectWindowSec", &c.ReconnectWindowSec},
+		{"broadcastCoalesceMs", &c.BroadcastCoalesceMs},
+		{"undoDepth", &c.UndoDepth},
+	}
+	for _, setting := range nonNegative {
+		if *setting.field < 0 {
+			log.Printf("warning: %s %d is negative, using 0\n", setting.name, *setting.field)
+			*setting.field = 0
+		}
+	}
+}
+
+// Addr returns the address to listen on: ":$PORT" when PORT is set,
+// otherwise ListenAddr. An address that isn't a valid host:port falls back
+// to the default with a warning.
+func (c Config) Addr() string {
+	addr := c.ListenAddr
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	if !validAddr(addr) {
+		log.Printf("warning: invalid listen address %q, using %s\n", addr, Default().ListenAddr)
+		return Default().ListenAddr
+	}
+	return addr
+}
+
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 0 && n <= 65535
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadMissingFileUsesDefaults(t *testing.T) {
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("expected defaults, got %+v", cfg)
+	}
+}
+
+func TestLoadOverridesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"maxSessions": 12}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MaxSessions != 12 {
+		t.Errorf("expected maxSessions 12, got %d", cfg.MaxSessions)
+	}
+	if cfg.MaxNameLength != Default().MaxNameLength {
+		t.Errorf("expected default maxNameLength, got %d", cfg.MaxNameLength)
+	}
+}
+
+func TestLoadInvalidJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{not json`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestAddr(t *testing.T) {
+	for _, tc := range []struct {
+		listenAddr, port, want string
+	}{
+		{":3000", "", ":3000"},
+		{"127.0.0.1:8080", "", "127.0.0.1:8080"},
+		{":3000", "9000", ":9000"},
+		{"localhost", "", ":3000"},
+		{":3000", "not-a-port", ":3000"},
+		{":70000", "", ":3000"},
+	} {
+		t.Setenv("PORT", tc.port)
+		cfg := Default()
+		cfg.ListenAddr = tc.listenAddr
+
+		if got := cfg.Addr(); got != tc.want {
+			t.Errorf("Addr() with listenAddr %q and PORT %q = %q, want %q", tc.listenAddr, tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"maxSessions": 12, "maxSpectators": 4}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("QTT_MAX_SESSIONS", "20")
+	t.Setenv("QTT_MAX_SPECTATORS", "lots")
+	t.Setenv("QTT_ADMIN_TOKEN", "secret")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MaxSessions != 20 {
+		t.Errorf("expected env to override maxSessions to 20, got %d", cfg.MaxSessions)
+	}
+	if cfg.MaxSpectators != 4 {
+		t.Errorf("expected an unparsable override to be ignored, got %d", cfg.MaxSpectators)
+	}
+	if cfg.AdminToken != "secret" {
+		t.Errorf("expected admin token from env, got %q", cfg.AdminToken)
+	}
+}
+
+func TestLoadEnvOverridesWithoutFile(t *testing.T) {
+	t.Setenv("QTT_IDLE_TIMEOUT_SEC", "60")
+
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.IdleTimeoutSec != 60 {
+		t.Errorf("expected idleTimeoutSec 60, got %d", cfg.IdleTimeoutSec)
+	}
+}
+
+func TestValidateKeepsDefaults(t *testing.T) {
+	cfg := Default()
+	cfg.Validate()
+
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("expected defaults to be left alone, got %+v", cfg)
+	}
+}
+
+func TestValidateClampsSettings(t *testing.T) {
+	for name, tc := range map[string]struct {
+		set  func(*Config)
+		get  func(Config) int
+		want int
+	}{
+		"zero maxSessions":     {func(c *Config) { c.MaxSessions = 0 }, func(c Config) int { return c.MaxSessions }, Default().MaxSessions},
+		"negative maxSessions": {func(c *Config) { c.MaxSessions = -3 }, func(c Config) int { return c.MaxSessions }, Default().MaxSessions},
+		"maxUploadBytes":       {func(c *Config) { c.MaxUploadBytes = 0 }, func(c Config) int { return int(c.MaxUploadBytes) }, int(Default().MaxUploadBytes)},
+		"maxSpectators":        {func(c *Config) { c.MaxSpectators = -1 }, func(c Config) int { return c.MaxSpectators }, 0},
+		"maxTokensPerSession":  {func(c *Config) { c.MaxTokensPerSession = -1 }, func(c Config) int { return c.MaxTokensPerSession }, 0},
+		"maxNameLength":        {func(c *Config) { c.MaxNameLength = -1 }, func(c Config) int { return c.MaxNameLength }, 0},
+		"maxTextLength":        {func(c *Config) { c.MaxTextLength = -1 }, func(c Config) int { return c.MaxTextLength }, 0},
+		"maxSessionNameLength": {func(c *Config) { c.MaxSessionNameLength = -1 }, func(c Config) int { return c.MaxSessionNameLength }, 0},
+		"heartbeatSec":         {func(c *Config) { c.HeartbeatSec = -1 }, func(c Config) int { return c.HeartbeatSec }, 0},
+		"idleTimeoutSec":       {func(c *Config) { c.IdleTimeoutSec = -1 }, func(c Config) int { return c.IdleTimeoutSec }, 0},
+		"maxCommandsPerSec":    {func(c *Config) { c.MaxCommandsPerSec = -1 }, func(c Config) int { return c.MaxCommandsPerSec }, 0},
+		"reconnectWindowSec":   {func(c *Config) { c.ReconnectWindowSec = -1 }, func(c Config) int { return c.ReconnectWindowSec }, 0},
+		"broadcastCoalesceMs":  {func(c *Config) { c.BroadcastCoalesceMs = -1 }, func(c Config) int { return c.BroadcastCoalesceMs }, 0},
+		"undoDepth":            {func(c *Config) { c.UndoDepth = -1 }, func(c Config) int { return c.UndoDepth }, 0},
+		"defaultGridUnit":      {func(c *Config) { c.DefaultGridUnit = 0 }, func(c Config) int { return int(c.DefaultGridUnit) }, int(Default().DefaultGridUnit)},
+	} {
+		cfg := Default()
+		tc.set(&cfg)
+
+		cfg.Validate()
+
+		if got := tc.get(cfg); got != tc.want {
+			t.Errorf("%s: got %d, want %d", name, got, tc.want)
+		}
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	cfg := Default()
+	cfg.AllowedOrigins = []string{"https://table.example", "http://localhost:5173"}
+
+	for origin, want := range map[string]bool{
+		"":                      true,
+		"https://table.example": true,
+		"HTTPS://TABLE.EXAMPLE": true,
+		"http://localhost:5173": true,
+		"https://evil.example":  false,
+		"http://localhost:3000": false,
+	} {
+		if got := cfg.OriginAllowed(origin); got != want {
+			t.Errorf("origin %q: got %v, want %v", origin, got, want)
+		}
+	}
+
+	if !Default().OriginAllowed("https://anywhere.example") {
+		t.Error("expected the default wildcard to accept any origin")
+	}
+}
+
+func TestLoadAllowedOriginsFromEnv(t *testing.T) {
+	t.Setenv("QTT_ALLOWED_ORIGINS", " https://a.example, ,https://b.example")
+
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"https://a.example", "https://b.example"}
+	if !reflect.DeepEqual(cfg.AllowedOrigins, want) {
+		t.Errorf("expected origins %v, got %v", want, cfg.AllowedOrigins)
+	}
+}
@@ -0,0 +1,105 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// MaxDice caps how many dice a single roll may throw.
+const MaxDice = 100
+
+// rollDie returns a uniform result in [1, sides]. Tests replace it to get
+// deterministic rolls.
+var rollDie = func(sides int) int {
+	return rand.IntN(sides) + 1
+}
+
+// Roll evaluates standard dice notation such as "2d6+3" or "1d20+1d4-1".
+// It returns the total, including modifiers, and each individual die result.
+// Results of subtracted dice are negative, so the rolls always sum to the
+// total minus the constant modifier.
+func Roll(notation string) (total int, rolls []int, err error) {
+	expr := strings.ReplaceAll(strings.ToLower(notation), " ", "")
+	if expr == "" {
+		return 0, nil, errors.New("empty dice notation")
+	}
+
+	// Split into signed terms: "1d20+1d4-1" -> "+1d20", "+1d4", "-1".
+	if expr[0] != '+' && expr[0] != '-' {
+		expr = "+" + expr
+	}
+	start := 0
+	for i := 1; i <= len(expr); i++ {
+		if i < len(expr) && expr[i] != '+' && expr[i] != '-' {
+			continue
+		}
+		termTotal, termRolls, err := rollTerm(expr[start+1:i], len(rolls))
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid dice notation %q: %w", notation, err)
+		}
+		if expr[start] == '-' {
+			termTotal = -termTotal
+			for j := range termRolls {
+				termRolls[j] = -termRolls[j]
+			}
+		}
+		total += termTotal
+		rolls = append(rolls, termRolls...)
+		start = i
+	}
+	return total, rolls, nil
+}
+
+// rollTerm evaluates a single unsigned term, either "NdM" or a constant.
+// rolled is the number of dice already thrown, used to enforce MaxDice.
+func rollTerm(term string, rolled int) (int, []int, error) {
+	countStr, sidesStr, isDice := strings.Cut(term, "d")
+	if !isDice {
+		n, err := strconv.Atoi(term)
+		if err != nil {
+			return 0, nil, fmt.Errorf("bad modifier %q", term)
+		}
+		return n, nil, nil
+	}
+
+	count := 1
+	if countStr != "" {
+		n, err := strconv.Atoi(countStr)
+		if err != nil || n < 1 {
+			return 0, nil, fmt.Errorf("bad dice count %q", countStr)
+		}
+		count = n
+	}
+	sides, err := strconv.Atoi(sidesStr)
+	if err != nil || sides < 1 {
+		return 0, nil, fmt.Errorf("bad die size %q", sidesStr)
+	}
+	if rolled+count > MaxDice {
+		return 0, nil, fmt.Errorf("more than %d dice", MaxDice)
+	}
+
+	total := 0
+	rolls := make([]int, count)
+	for i := range rolls {
+		rolls[i] = rollDie(sides)
+		total += rolls[i]
+	}
+	return total, rolls, nil
+}
+
+type RollDicePayload struct {
+	Notation string `json:"notation"`
+	Label    string `json:"label"`
+}
+
+type DiceResult struct {
+	Notation string `json:"notation"`
+	Label    string `json:"label"`
+	// Rolls holds each die result, negative for subtracted dice.
+	Rolls    []int `json:"rolls"`
+	Modifier int   `json:"modifier"`
+	Total    int   `json:"total"`
+}
@@ -0,0 +1,100 @@
+package game
+
+import "testing"
+
+// fixedDice makes every die roll its maximum for the duration of the test.
+func fixedDice(t *testing.T) {
+	t.Helper()
+	orig := rollDie
+	rollDie = func(sides int) int { return sides }
+	t.Cleanup(func() { rollDie = orig })
+}
+
+func TestRollWithModifier(t *testing.T) {
+	fixedDice(t)
+
+	total, rolls, err := Roll("2d6+3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 15 {
+		t.Errorf("expected total 15, got %d", total)
+	}
+	if len(rolls) != 2 || rolls[0] != 6 || rolls[1] != 6 {
+		t.Errorf("expected rolls [6 6], got %v", rolls)
+	}
+}
+
+func TestRollSubtractedDiceAreNegative(t *testing.T) {
+	fixedDice(t)
+
+	total, rolls, err := Roll("1d20-1d4")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 16 {
+		t.Errorf("expected total 16, got %d", total)
+	}
+	if len(rolls) != 2 || rolls[0] != 20 || rolls[1] != -4 {
+		t.Errorf("expected rolls [20 -4], got %v", rolls)
+	}
+}
+
+func TestRollMultipleGroups(t *testing.T) {
+	fixedDice(t)
+
+	total, rolls, err := Roll("1d20 + 1d4 - 2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 22 {
+		t.Errorf("expected total 22, got %d", total)
+	}
+	if len(rolls) != 2 {
+		t.Errorf("expected 2 rolls, got %v", rolls)
+	}
+}
+
+func TestRollImplicitCount(t *testing.T) {
+	fixedDice(t)
+
+	total, _, err := Roll("d8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 8 {
+		t.Errorf("expected total 8, got %d", total)
+	}
+}
+
+func TestRollRange(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		total, _, err := Roll("1d6")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total < 1 || total > 6 {
+			t.Fatalf("1d6 rolled out of range: %d", total)
+		}
+	}
+}
+
+func TestRollInvalidNotation(t *testing.T) {
+	for _, notation := range []string{"", "abc", "2d", "0d6", "2d0", "1d6+", "1d6++2", "d-4"} {
+		if _, _, err := Roll(notation); err == nil {
+			t.Errorf("expected an error for %q", notation)
+		}
+	}
+}
+
+func TestRollCapsDiceCount(t *testing.T) {
+	if _, _, err := Roll("101d6"); err == nil {
+		t.Error("expected an error for more than 100 dice")
+	}
+	if _, _, err := Roll("60d6+60d6"); err == nil {
+		t.Error("expected the cap to apply across dice groups")
+	}
+	if _, _, err := Roll("100d6"); err != nil {
+		t.Errorf("expected 100 dice to be allowed, got %v", err)
+	}
+}
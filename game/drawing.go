@@ -0,0 +1,62 @@
+package game
+
+import (
+	"fmt"
+	"slices"
+)
+
+// MaxDrawingPoints caps the points kept per drawing; longer strokes are cut off.
+const MaxDrawingPoints = 2000
+
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Drawing is a freehand stroke on the map.
+type Drawing struct {
+	ID     string  `json:"id"`
+	Points []Point `json:"points"`
+	Color  string  `json:"color"`
+	Width  float64 `json:"width"`
+}
+
+// Validate checks the drawing's color. Overlong strokes aren't an error here
+// since AddDrawing cuts them off.
+func (d Drawing) Validate() error {
+	if d.Color != "" && !ValidColor(d.Color) {
+		return fmt.Errorf("invalid drawing color %q", d.Color)
+	}
+	return nil
+}
+
+// AddDrawing adds a stroke. Adding a drawing with an existing ID replaces it.
+func (s *State) AddDrawing(drawing Drawing) {
+	if len(drawing.Points) > MaxDrawingPoints {
+		drawing.Points = drawing.Points[:MaxDrawingPoints]
+	}
+	drawing.Points = slices.Clone(drawing.Points)
+	if drawing.Points == nil {
+		drawing.Points = []Point{}
+	}
+	s.DeleteDrawing(drawing.ID)
+	s.Drawings = append(slices.Clone(s.Drawings), drawing)
+}
+
+func (s *State) DeleteDrawing(id string) {
+	s.Drawings = slices.DeleteFunc(slices.Clone(s.Drawings), func(d Drawing) bool {
+		return d.ID == id
+	})
+}
+
+func (s *State) ClearDrawings() {
+	s.Drawings = []Drawing{}
+}
+
+type AddDrawingPayload struct {
+	Drawing Drawing `json:"drawing"`
+}
+
+type DeleteDrawingPayload struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,58 @@
+package game
+
+import "testing"
+
+func TestNewStateHasNoDrawings(t *testing.T) {
+	s := NewState()
+
+	if s.Drawings == nil || len(s.Drawings) != 0 {
+		t.Errorf("expected empty drawings, got %v", s.Drawings)
+	}
+}
+
+func TestAddDrawingReplacesSameID(t *testing.T) {
+	s := NewState()
+
+	s.AddDrawing(Drawing{ID: "d1", Points: []Point{{0, 0}, {10, 10}}})
+	s.AddDrawing(Drawing{ID: "d2"})
+	s.AddDrawing(Drawing{ID: "d1", Points: []Point{{5, 5}}})
+
+	if len(s.Drawings) != 2 {
+		t.Fatalf("expected 2 drawings, got %+v", s.Drawings)
+	}
+	if s.Drawings[1].ID != "d1" || len(s.Drawings[1].Points) != 1 {
+		t.Errorf("expected d1 to be replaced, got %+v", s.Drawings[1])
+	}
+	if s.Drawings[0].Points == nil {
+		t.Error("expected a drawing without points to have an empty slice")
+	}
+}
+
+func TestAddDrawingCapsPoints(t *testing.T) {
+	s := NewState()
+
+	s.AddDrawing(Drawing{ID: "d1", Points: make([]Point, MaxDrawingPoints+10)})
+
+	if got := len(s.Drawings[0].Points); got != MaxDrawingPoints {
+		t.Errorf("expected %d points, got %d", MaxDrawingPoints, got)
+	}
+}
+
+func TestDeleteAndClearDrawings(t *testing.T) {
+	s := NewState()
+	s.AddDrawing(Drawing{ID: "d1"})
+	s.AddDrawing(Drawing{ID: "d2"})
+
+	s.DeleteDrawing("d1")
+	s.DeleteDrawing("missing")
+
+	if len(s.Drawings) != 1 || s.Drawings[0].ID != "d2" {
+		t.Fatalf("expected only d2, got %+v", s.Drawings)
+	}
+
+	s.ClearDrawings()
+
+	if s.Drawings == nil || len(s.Drawings) != 0 {
+		t.Errorf("expected drawings cleared, got %v", s.Drawings)
+	}
+}
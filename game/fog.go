@@ -0,0 +1,47 @@
+package game
+
+import (
+	"errors"
+	"slices"
+)
+
+// FogRect is a rectangular map area hidden from players until removed.
+type FogRect struct {
+	ID string  `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+	W  float64 `json:"w"`
+	H  float64 `json:"h"`
+}
+
+// Validate rejects regions with a negative width or height.
+func (r FogRect) Validate() error {
+	if r.W < 0 || r.H < 0 {
+		return errors.New("fog region has a negative size")
+	}
+	return nil
+}
+
+// AddFog covers a new area. Adding a region with an existing ID replaces it.
+func (s *State) AddFog(rect FogRect) {
+	s.RemoveFog(rect.ID)
+	s.FogRegions = append(slices.Clone(s.FogRegions), rect)
+}
+
+func (s *State) RemoveFog(id string) {
+	s.FogRegions = slices.DeleteFunc(slices.Clone(s.FogRegions), func(r FogRect) bool {
+		return r.ID == id
+	})
+}
+
+func (s *State) ClearFog() {
+	s.FogRegions = []FogRect{}
+}
+
+type AddFogPayload struct {
+	Region FogRect `json:"region"`
+}
+
+type RemoveFogPayload struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,57 @@
+package game
+
+import "testing"
+
+func TestNewStateHasNoFog(t *testing.T) {
+	s := NewState()
+
+	if s.FogRegions == nil || len(s.FogRegions) != 0 {
+		t.Errorf("expected empty fog regions, got %v", s.FogRegions)
+	}
+}
+
+func TestAddFog(t *testing.T) {
+	s := NewState()
+
+	s.AddFog(FogRect{ID: "f1", X: 0, Y: 0, W: 192, H: 96})
+	s.AddFog(FogRect{ID: "f2", X: 96, Y: 96, W: 96, H: 96})
+
+	if len(s.FogRegions) != 2 {
+		t.Fatalf("expected 2 regions, got %d", len(s.FogRegions))
+	}
+}
+
+func TestAddFogReplacesSameID(t *testing.T) {
+	s := NewState()
+
+	s.AddFog(FogRect{ID: "f1", W: 96, H: 96})
+	s.AddFog(FogRect{ID: "f1", W: 192, H: 192})
+
+	if len(s.FogRegions) != 1 || s.FogRegions[0].W != 192 {
+		t.Errorf("expected a single replaced region, got %+v", s.FogRegions)
+	}
+}
+
+func TestRemoveFog(t *testing.T) {
+	s := NewState()
+	s.AddFog(FogRect{ID: "f1"})
+	s.AddFog(FogRect{ID: "f2"})
+
+	s.RemoveFog("f1")
+	s.RemoveFog("does-not-exist")
+
+	if len(s.FogRegions) != 1 || s.FogRegions[0].ID != "f2" {
+		t.Errorf("expected only f2 to remain, got %+v", s.FogRegions)
+	}
+}
+
+func TestClearFog(t *testing.T) {
+	s := NewState()
+	s.AddFog(FogRect{ID: "f1"})
+
+	s.ClearFog()
+
+	if s.FogRegions == nil || len(s.FogRegions) != 0 {
+		t.Errorf("expected empty fog regions, got %v", s.FogRegions)
+	}
+}
@@ -1,53 +1,701 @@
 package game
 
+import (
+	"hash/fnv"
+	"log"
+	"maps"
+	"math"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Diagonal rules for converting distances into grid cells.
+const (
+	// DiagonalChebyshev counts a diagonal step as one cell, as in 5e.
+	DiagonalChebyshev = "chebyshev"
+	// DiagonalEuclidean uses the straight-line distance.
+	DiagonalEuclidean = "euclidean"
+)
+
+// ConditionConcentration is the condition a token holds while concentrating on a spell.
+const ConditionConcentration = "concentration"
+
+// TokenData is a token on the board. Elevation is its height above the
+// ground in feet, negative when underground. GroupID ties it to tokens that
+// are moved, hidden or deleted together; empty means ungrouped. AuraRadius,
+// in grid units, draws a light or aura around it in AuraColor; 0 disables it.
+// NameVisibleToPlayers is nil, meaning true, unless set; when false, players
+// see MaskedTokenName instead of the real name.
 type TokenData struct {
-	Name      string  `json:"name"`
-	ImgPath   string  `json:"imgPath"`
-	X         float64 `json:"x"`
-	Y         float64 `json:"y"`
-	TokenSize float64 `json:"tokenSize"`
+	Name                 string   `json:"name"`
+	ImgPath              string   `json:"imgPath"`
+	X                    float64  `json:"x"`
+	Y                    float64  `json:"y"`
+	TokenSize            float64  `json:"tokenSize"`
+	ConcentratingOn      string   `json:"concentratingOn"`
+	HP                   int      `json:"hp"`
+	MaxHP                int      `json:"maxHp"`
+	Conditions           []string `json:"conditions"`
+	Z                    int      `json:"z"`
+	Hidden               bool     `json:"hidden"`
+	Elevation            float64  `json:"elevation"`
+	GroupID              string   `json:"groupId"`
+	AuraRadius           float64  `json:"auraRadius"`
+	AuraColor            string   `json:"auraColor"`
+	NameVisibleToPlayers *bool    `json:"nameVisibleToPlayers,omitempty"`
+	Initials             string   `json:"initials,omitempty"`
+	PlaceholderColor     string   `json:"placeholderColor,omitempty"`
 }
 
+// State is a session's board. BackgroundScale and the background offsets
+// line the map image up with the grid. PreventOverlap refuses moves onto a
+// cell held by a similar-sized token.
 type State struct {
-	DisplayedTokens   map[string]TokenData `json:"displayedTokens"`
-	BackgroundImgPath string               `json:"backgroundImgPath"`
-	ShowGrid          bool                 `json:"showGrid"`
-	GridUnit          float64              `json:"gridUnit"`
+	// DisplayedTokens is unordered; clients must sort by Z, then by ID, to
+	// draw overlapping tokens in a stable order.
+	DisplayedTokens   map[string]TokenData  `json:"displayedTokens"`
+	BackgroundImgPath string                `json:"backgroundImgPath"`
+	BackgroundScale   float64               `json:"backgroundScale"`
+	BackgroundOffsetX float64               `json:"backgroundOffsetX"`
+	BackgroundOffsetY float64               `json:"backgroundOffsetY"`
+	ShowGrid          bool                  `json:"showGrid"`
+	GridUnit          float64               `json:"gridUnit"`
+	SnapToGrid        bool                  `json:"snapToGrid"`
+	PreventOverlap    bool                  `json:"preventOverlap"`
+	GridOffsetX       float64               `json:"gridOffsetX"`
+	GridOffsetY       float64               `json:"gridOffsetY"`
+	InitiativeOrder   []InitiativeEntry     `json:"initiativeOrder"`
+	FogRegions        []FogRect             `json:"fogRegions"`
+	CurrentTurn       int                   `json:"currentTurn"`
+	Drawings          []Drawing             `json:"drawings"`
+	Notes             map[string]Note       `json:"notes"`
+	TextObjects       map[string]TextObject `json:"textObjects"`
+	// Round counts trips through the initiative order, starting at 1 when
+	// initiative is set; 0 means no encounter is running.
+	Round int `json:"round"`
+	// SnapAnchor is the part of a token that snapping lines up with the
+	// grid: SnapAnchorCorner or SnapAnchorCenter.
+	SnapAnchor string `json:"snapAnchor"`
+	// GridType is the shape of the active scene's grid: GridSquare or
+	// GridIso.
+	GridType string `json:"gridType"`
+	// ActiveScene is the ID of the scene shown by the fields above; Scenes
+	// holds every scene, including the active one by name only.
+	ActiveScene string                `json:"activeScene"`
+	Scenes      map[string]SceneState `json:"scenes"`
+}
+
+// MaskedTokenName replaces the name of a token whose name players may not see.
+const MaskedTokenName = "Unknown"
+
+// NameVisible reports whether players may see the token's name.
+func (t TokenData) NameVisible() bool {
+	return t.NameVisibleToPlayers == nil || *t.NameVisibleToPlayers
 }
 
+// ForPlayers returns the token as players see it, with a masked name and
+// initials when its name is kept from them.
+func (t TokenData) ForPlayers() TokenData {
+	if !t.NameVisible() {
+		t.Name = MaskedTokenName
+		if t.Initials != "" {
+			t.Initials = "?"
+		}
+	}
+	return t
+}
+
+// Defaults for a new session's board.
+const (
+	DefaultBackground = "/assets/default/maps/tavern.jpg"
+	DefaultGridUnit   = 96
+)
+
 func NewState() State {
+	return NewStateWithDefaults(DefaultBackground, DefaultGridUnit)
+}
+
+// NewStateWithDefaults returns an empty board with the given background and
+// grid unit, e.g. from the server config.
+func NewStateWithDefaults(bg string, gridUnit float64) State {
 	return State{
 		DisplayedTokens:   make(map[string]TokenData),
-		BackgroundImgPath: "/assets/default/maps/tavern.jpg",
+		BackgroundImgPath: bg,
+		BackgroundScale:   1,
 		ShowGrid:          true,
-		GridUnit:          96,
+		GridUnit:          gridUnit,
+		SnapAnchor:        SnapAnchorCorner,
+		GridType:          GridSquare,
+		InitiativeOrder:   []InitiativeEntry{},
+		FogRegions:        []FogRect{},
+		Drawings:          []Drawing{},
+		Notes:             make(map[string]Note),
+		TextObjects:       make(map[string]TextObject),
+		ActiveScene:       DefaultScene,
+		Scenes:            map[string]SceneState{DefaultScene: {Name: "Default"}},
 	}
 }
 
+// Clone returns a deep copy of the state that shares no maps or slices with s.
+func (s State) Clone() State {
+	clone := s
+	clone.DisplayedTokens = make(map[string]TokenData, len(s.DisplayedTokens))
+	for id, token := range s.DisplayedTokens {
+		token.Conditions = slices.Clone(token.Conditions)
+		clone.DisplayedTokens[id] = token
+	}
+	clone.InitiativeOrder = slices.Clone(s.InitiativeOrder)
+	clone.FogRegions = slices.Clone(s.FogRegions)
+	// Points are never modified in place, so drawings can share them.
+	clone.Drawings = slices.Clone(s.Drawings)
+	clone.Notes = maps.Clone(s.Notes)
+	clone.TextObjects = maps.Clone(s.TextObjects)
+	clone.Scenes = cloneScenes(s.Scenes)
+	return clone
+}
+
+// AddToken places a token. A token without an image gets placeholder initials
+// and color; one with an invalid image path is ignored. A missing or negative
+// size becomes the grid unit, the latter with a warning.
 func (s *State) AddToken(id string, token TokenData) {
+	if token.ImgPath != "" && !ValidateImgPath(token.ImgPath) {
+		return
+	}
+	if token.TokenSize < 0 {
+		log.Printf("warning: token %s has negative size %v, using the grid unit\n", id, token.TokenSize)
+		token.TokenSize = 0
+	}
+	if token.TokenSize == 0 {
+		token.TokenSize = s.GridUnit
+	}
+	if token.Conditions == nil {
+		token.Conditions = []string{}
+	}
+	if token.ImgPath == "" {
+		token.Initials = tokenInitials(token.Name)
+		token.PlaceholderColor = placeholderColor(token.Name)
+	}
 	s.DisplayedTokens[id] = token
 }
 
-func (s *State) MoveToken(id string, x, y float64) {
-	if token, ok := s.DisplayedTokens[id]; ok {
-		token.X = x
-		token.Y = y
-		s.DisplayedTokens[id] = token
+// tokenInitials returns the uppercased first letters of up to two words of name.
+func tokenInitials(name string) string {
+	var initials []rune
+	for _, word := range strings.Fields(name) {
+		initials = append(initials, unicode.ToUpper([]rune(word)[0]))
+		if len(initials) == 2 {
+			break
+		}
+	}
+	return string(initials)
+}
+
+// placeholderPalette holds the colors placeholder avatars are drawn from.
+var placeholderPalette = []string{
+	"#e57373", "#f06292", "#ba68c8", "#7986cb",
+	"#4fc3f7", "#4db6ac", "#aed581", "#ffb74d",
+}
+
+// placeholderColor picks a palette color from a hash of name so the same
+// name always gets the same avatar color.
+func placeholderColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return placeholderPalette[h.Sum32()%uint32(len(placeholderPalette))]
+}
+
+// MoveToken moves the token to (x, y), snapped to the grid when SnapToGrid
+// is on so every client sees and persists the same position. With
+// PreventOverlap on, a move onto an occupied cell leaves the token where it
+// was. It reports whether the token moved.
+func (s *State) MoveToken(id string, x, y float64) bool {
+	token, ok := s.DisplayedTokens[id]
+	if !ok {
+		return false
+	}
+	x, y = s.snap(x, y, token.TokenSize)
+	if s.PreventOverlap && s.occupied(map[string]bool{id: true}, x, y, token.TokenSize) {
+		return false
+	}
+	token.X = x
+	token.Y = y
+	s.DisplayedTokens[id] = token
+	return true
+}
+
+// occupied reports whether a token outside exclude with a comparable size,
+// one that spans the same number of grid cells, sits in the cell at (x, y).
+func (s *State) occupied(exclude map[string]bool, x, y, size float64) bool {
+	if s.GridUnit <= 0 {
+		return false
+	}
+	cells := func(size float64) float64 { return max(1, math.Round(size/s.GridUnit)) }
+	i, j := s.cell(x, y, size)
+	i, j = math.Round(i), math.Round(j)
+	for id, other := range s.DisplayedTokens {
+		if exclude[id] || cells(other.TokenSize) != cells(size) {
+			continue
+		}
+		if oi, oj := s.cell(other.X, other.Y, other.TokenSize); math.Round(oi) == i && math.Round(oj) == j {
+			return true
+		}
+	}
+	return false
+}
+
+// DuplicateToken copies token id to a new ID, offset by (dx, dy). It
+// reports false when there is no such token, or when PreventOverlap is on
+// and the copy would land on an occupied cell.
+func (s *State) DuplicateToken(id string, dx, dy float64) (string, bool) {
+	token, ok := s.DisplayedTokens[id]
+	if !ok {
+		return "", false
+	}
+	token.Conditions = slices.Clone(token.Conditions)
+	token.X, token.Y = s.snap(token.X+dx, token.Y+dy, token.TokenSize)
+	if s.PreventOverlap && s.occupied(nil, token.X, token.Y, token.TokenSize) {
+		return "", false
+	}
+
+	newID := uuid.NewString()
+	s.DisplayedTokens[newID] = token
+	return newID, true
+}
+
+// MoveTokens applies several moves at once, skipping unknown IDs. The moved
+// tokens don't block each other's destinations, so a selection can shift as
+// a formation, but a token refused by PreventOverlap stays put and blocks
+// the rest. It returns the IDs of the refused tokens.
+func (s *State) MoveTokens(moves []MoveTokenPayload) []string {
+	moving := make(map[string]bool, len(moves))
+	targets := make(map[string]TokenData, len(moves))
+	for _, move := range moves {
+		token, ok := s.DisplayedTokens[move.ID]
+		if !ok {
+			continue
+		}
+		token.X, token.Y = s.snap(move.X, move.Y, token.TokenSize)
+		moving[move.ID] = true
+		targets[move.ID] = token
+	}
+	var rejected []string
+	for refused := s.PreventOverlap; refused; {
+		refused = false
+		for _, move := range moves {
+			token := targets[move.ID]
+			if moving[move.ID] && s.occupied(moving, token.X, token.Y, token.TokenSize) {
+				delete(moving, move.ID)
+				rejected = append(rejected, move.ID)
+				refused = true
+			}
+		}
+	}
+	for id := range moving {
+		s.DisplayedTokens[id] = targets[id]
+	}
+	return rejected
+}
+
+// SetPreventOverlap turns collision prevention on or off.
+func (s *State) SetPreventOverlap(enabled bool) {
+	s.PreventOverlap = enabled
+}
+
+// Snap anchors. With SnapAnchorCorner a token's position lands on a grid
+// line. With SnapAnchorCenter the position is taken as the token's center
+// and lands wherever the token then covers whole cells: mid-cell for a token
+// one cell wide, on a grid line for one two cells wide.
+const (
+	SnapAnchorCorner = "corner"
+	SnapAnchorCenter = "center"
+)
+
+// ValidSnapAnchor reports whether anchor is one of the snap anchors.
+func ValidSnapAnchor(anchor string) bool {
+	return anchor == SnapAnchorCorner || anchor == SnapAnchorCenter
+}
+
+// Grid types. A GridSquare cell is GridUnit wide and high. A GridIso cell
+// is a diamond GridUnit wide and half as high, the usual 2:1 isometric
+// projection of a square cell.
+const (
+	GridSquare = "square"
+	GridIso    = "iso"
+)
+
+// ValidGridType reports whether gridType is one of the grid types.
+func ValidGridType(gridType string) bool {
+	return gridType == GridSquare || gridType == GridIso
+}
+
+// snap rounds (x, y), the position of a token of the given size, to the
+// nearest grid point when snapping is enabled, honoring SnapAnchor.
+func (s *State) snap(x, y, size float64) (float64, float64) {
+	if !s.SnapToGrid || s.GridUnit <= 0 {
+		return x, y
+	}
+	i, j := s.cell(x, y, size)
+	return s.cellPosition(math.Round(i), math.Round(j), size)
+}
+
+// cell converts a token position to grid coordinates, where whole numbers
+// are grid points: (column, row) on a square grid, and steps along the two
+// diagonal axes on an iso grid.
+func (s *State) cell(x, y, size float64) (float64, float64) {
+	shift := s.anchorShift(size)
+	if s.GridType == GridIso {
+		// Iso grid points are (i-j)*GridUnit/2 across and (i+j)*GridUnit/4
+		// down, and a centered token sits half its height below its point.
+		u := (x - s.GridOffsetX) / (s.GridUnit / 2)
+		v := (y - s.GridOffsetY - shift/2) / (s.GridUnit / 4)
+		return (u + v) / 2, (v - u) / 2
+	}
+	return (x - s.GridOffsetX - shift) / s.GridUnit, (y - s.GridOffsetY - shift) / s.GridUnit
+}
+
+// cellPosition is the inverse of cell.
+func (s *State) cellPosition(i, j, size float64) (float64, float64) {
+	shift := s.anchorShift(size)
+	if s.GridType == GridIso {
+		return (i-j)*s.GridUnit/2 + s.GridOffsetX, (i+j)*s.GridUnit/4 + s.GridOffsetY + shift/2
 	}
+	return i*s.GridUnit + s.GridOffsetX + shift, j*s.GridUnit + s.GridOffsetY + shift
+}
+
+// SetGridType changes the grid's shape; unknown types are ignored. Token
+// positions are left alone until they next move.
+func (s *State) SetGridType(gridType string) {
+	if ValidGridType(gridType) {
+		s.GridType = gridType
+	}
+}
+
+// anchorShift is how far a token's snapped position sits from the grid line
+// at its edge: half its size with SnapAnchorCenter, otherwise none. Tokens
+// without a size count as one cell.
+func (s *State) anchorShift(size float64) float64 {
+	if s.SnapAnchor != SnapAnchorCenter {
+		return 0
+	}
+	if size <= 0 {
+		size = s.GridUnit
+	}
+	return size / 2
+}
+
+// SetSnapAnchor changes how tokens line up with the grid; unknown anchors
+// are ignored.
+func (s *State) SetSnapAnchor(anchor string) {
+	if ValidSnapAnchor(anchor) {
+		s.SnapAnchor = anchor
+	}
+}
+
+// SetGridOffset shifts the grid origin so it lines up with the map's own grid.
+func (s *State) SetGridOffset(x, y float64) {
+	s.GridOffsetX = x
+	s.GridOffsetY = y
+}
+
+func (s *State) SetSnapToGrid(enabled bool) {
+	s.SnapToGrid = enabled
 }
 
 func (s *State) DeleteToken(id string) {
 	delete(s.DisplayedTokens, id)
+	s.removeFromInitiative(id)
+}
+
+// DeleteTokens removes every listed token, skipping unknown IDs.
+func (s *State) DeleteTokens(ids []string) {
+	for _, id := range ids {
+		s.DeleteToken(id)
+	}
 }
 
 func (s *State) ClearTokens() {
 	s.DisplayedTokens = make(map[string]TokenData)
+	s.ClearInitiative()
+}
+
+// SetTokenHP sets the token's hit points, clamped to [0, MaxHP]. When MaxHP
+// is zero (unset) the value is stored as-is, so it may go negative for
+// homebrew rules that track damage below zero.
+func (s *State) SetTokenHP(id string, hp int) {
+	token, ok := s.DisplayedTokens[id]
+	if !ok {
+		return
+	}
+	if token.MaxHP > 0 {
+		hp = max(0, min(hp, token.MaxHP))
+	}
+	token.HP = hp
+	s.DisplayedTokens[id] = token
+}
+
+// SetTokenHidden hides the token from non-GM clients, or reveals it again.
+func (s *State) SetTokenHidden(id string, hidden bool) {
+	if token, ok := s.DisplayedTokens[id]; ok {
+		token.Hidden = hidden
+		s.DisplayedTokens[id] = token
+	}
 }
 
+// PlayerView returns a copy of the state with everything players shouldn't
+// see (hidden tokens and their turns, masked names, GM-only notes, the contents of other
+// scenes) removed. The receiver is left untouched.
+func (s State) PlayerView() State {
+	view := s
+	view.DisplayedTokens = make(map[string]TokenData, len(s.DisplayedTokens))
+	for id, token := range s.DisplayedTokens {
+		if !token.Hidden {
+			view.DisplayedTokens[id] = token.ForPlayers()
+		}
+	}
+	view.InitiativeOrder, view.CurrentTurn = s.PlayerInitiative()
+	view.Notes = make(map[string]Note, len(s.Notes))
+	for id, note := range s.Notes {
+		if !note.GMOnly {
+			view.Notes[id] = note
+		}
+	}
+	view.Scenes = sceneNames(s.Scenes)
+	return view
+}
+
+// PlayerInitiative returns the initiative order and current turn as players
+// see them. Hidden tokens' turns are dropped; while one is acting, players
+// see the next visible combatant as current.
+func (s State) PlayerInitiative() ([]InitiativeEntry, int) {
+	order := make([]InitiativeEntry, 0, len(s.InitiativeOrder))
+	turn := 0
+	for i, entry := range s.InitiativeOrder {
+		token, ok := s.DisplayedTokens[entry.TokenID]
+		if ok && token.Hidden {
+			continue
+		}
+		if ok && !token.NameVisible() {
+			entry.Name = MaskedTokenName
+		}
+		if i < s.CurrentTurn {
+			turn++
+		}
+		order = append(order, entry)
+	}
+	if turn >= len(order) {
+		turn = 0
+	}
+	return order, turn
+}
+
+// ImagePaths returns the distinct images the board uses, the background and
+// every token's image, sorted, so clients can preload them.
+func (s State) ImagePaths() []string {
+	paths := make([]string, 0, len(s.DisplayedTokens)+1)
+	if s.BackgroundImgPath != "" {
+		paths = append(paths, s.BackgroundImgPath)
+	}
+	for _, token := range s.DisplayedTokens {
+		if token.ImgPath != "" {
+			paths = append(paths, token.ImgPath)
+		}
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+func (s *State) SetTokenZ(id string, z int) {
+	if token, ok := s.DisplayedTokens[id]; ok {
+		token.Z = z
+		s.DisplayedTokens[id] = token
+	}
+}
+
+// SetTokenNameVisibility shows or masks the token's name for players.
+func (s *State) SetTokenNameVisibility(id string, visible bool) {
+	if token, ok := s.DisplayedTokens[id]; ok {
+		token.NameVisibleToPlayers = &visible
+		s.DisplayedTokens[id] = token
+	}
+}
+
+// SetTokenElevation sets how high the token flies, or how deep it burrows
+// when negative.
+func (s *State) SetTokenElevation(id string, elevation float64) {
+	if token, ok := s.DisplayedTokens[id]; ok {
+		token.Elevation = elevation
+		s.DisplayedTokens[id] = token
+	}
+}
+
+// SetTokenAura sets the token's aura. A negative radius or a color that
+// isn't "#rrggbb" is ignored; a radius of 0 turns the aura off.
+func (s *State) SetTokenAura(id string, radius float64, color string) {
+	if radius < 0 || (color != "" && !ValidColor(color)) {
+		return
+	}
+	if token, ok := s.DisplayedTokens[id]; ok {
+		token.AuraRadius = radius
+		token.AuraColor = color
+		s.DisplayedTokens[id] = token
+	}
+}
+
+// BringToFront places the token above every other token.
+func (s *State) BringToFront(id string) {
+	if _, ok := s.DisplayedTokens[id]; !ok {
+		return
+	}
+	top := math.MinInt
+	for otherID, token := range s.DisplayedTokens {
+		if otherID != id && token.Z > top {
+			top = token.Z
+		}
+	}
+	if top == math.MinInt {
+		return
+	}
+	s.SetTokenZ(id, top+1)
+}
+
+// SendToBack places the token below every other token.
+func (s *State) SendToBack(id string) {
+	if _, ok := s.DisplayedTokens[id]; !ok {
+		return
+	}
+	bottom := math.MaxInt
+	for otherID, token := range s.DisplayedTokens {
+		if otherID != id && token.Z < bottom {
+			bottom = token.Z
+		}
+	}
+	if bottom == math.MaxInt {
+		return
+	}
+	s.SetTokenZ(id, bottom-1)
+}
+
+// AddTokenCondition adds cond to the token's conditions unless it's already present.
+func (s *State) AddTokenCondition(id, cond string) {
+	token, ok := s.DisplayedTokens[id]
+	if !ok || slices.Contains(token.Conditions, cond) {
+		return
+	}
+	token.Conditions = append(slices.Clone(token.Conditions), cond)
+	s.DisplayedTokens[id] = token
+}
+
+// RemoveTokenCondition removes cond from the token. Removing a condition the
+// token doesn't have is a no-op. Dropping concentration also ends the spell.
+func (s *State) RemoveTokenCondition(id, cond string) {
+	token, ok := s.DisplayedTokens[id]
+	if !ok {
+		return
+	}
+	token.Conditions = slices.DeleteFunc(slices.Clone(token.Conditions), func(c string) bool {
+		return c == cond
+	})
+	if cond == ConditionConcentration {
+		token.ConcentratingOn = ""
+	}
+	s.DisplayedTokens[id] = token
+}
+
+func (s *State) ClearTokenConditions(id string) {
+	if token, ok := s.DisplayedTokens[id]; ok {
+		token.Conditions = []string{}
+		token.ConcentratingOn = ""
+		s.DisplayedTokens[id] = token
+	}
+}
+
+// StartConcentration gives the token the concentration condition tied to
+// spell. A token can only concentrate on one spell at a time, so any
+// previous one is dropped.
+func (s *State) StartConcentration(id, spell string) {
+	if token, ok := s.DisplayedTokens[id]; ok {
+		token.ConcentratingOn = spell
+		s.DisplayedTokens[id] = token
+		s.AddTokenCondition(id, ConditionConcentration)
+	}
+}
+
+func (s *State) EndConcentration(id string) {
+	s.RemoveTokenCondition(id, ConditionConcentration)
+}
+
+// GridDistance converts the offset between two points into grid cells using
+// the given diagonal rule. Unknown rules fall back to chebyshev.
+func GridDistance(x1, y1, x2, y2, gridUnit float64, rule string) float64 {
+	if gridUnit <= 0 {
+		return 0
+	}
+	dx := math.Abs(x2-x1) / gridUnit
+	dy := math.Abs(y2-y1) / gridUnit
+	if rule == DiagonalEuclidean {
+		return math.Hypot(dx, dy)
+	}
+	return math.Max(dx, dy)
+}
+
+// TokenDistance returns the grid distance between two tokens, or false if
+// either token doesn't exist.
+func (s *State) TokenDistance(idA, idB string) (float64, bool) {
+	a, ok := s.DisplayedTokens[idA]
+	if !ok {
+		return 0, false
+	}
+	b, ok := s.DisplayedTokens[idB]
+	if !ok {
+		return 0, false
+	}
+	return GridDistance(a.X, a.Y, b.X, b.Y, s.GridUnit, DiagonalChebyshev), true
+}
+
+// ChangeBackgroundImg sets the map image; invalid paths are ignored.
 func (s *State) ChangeBackgroundImg(path string) {
+	if !ValidateImgPath(path) {
+		return
+	}
 	s.BackgroundImgPath = path
 }
 
+// Bounds for BackgroundScale.
+const (
+	MinBackgroundScale = 0.1
+	MaxBackgroundScale = 10
+)
+
+// SetBackgroundTransform scales and shifts the map image, clamping the scale
+// to [MinBackgroundScale, MaxBackgroundScale].
+func (s *State) SetBackgroundTransform(scale, offsetX, offsetY float64) {
+	s.BackgroundScale = max(MinBackgroundScale, min(scale, MaxBackgroundScale))
+	s.BackgroundOffsetX = offsetX
+	s.BackgroundOffsetY = offsetY
+}
+
+var imgPathChars = regexp.MustCompile(`^/assets/[A-Za-z0-9._/ -]+$`)
+
+// ValidateImgPath reports whether path is a clean local path under /assets/,
+// ruling out external URLs and directory traversal.
+func ValidateImgPath(imgPath string) bool {
+	return imgPathChars.MatchString(imgPath) && path.Clean(imgPath) == imgPath
+}
+
+// FitGridToImage sets GridUnit so that columns cells span an image of the
+// given pixel width. Non-positive inputs leave the grid unchanged.
+func (s *State) FitGridToImage(width float64, columns int) {
+	if width <= 0 || columns <= 0 {
+		return
+	}
+	s.GridUnit = width / float64(columns)
+}
+
 func (s *State) ToggleGrid() {
 	s.ShowGrid = !s.ShowGrid
 }
@@ -64,10 +712,111 @@ type MoveTokenPayload struct {
 	Y  float64 `json:"y"`
 }
 
+type DuplicateTokenPayload struct {
+	ID      string  `json:"id"`
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+}
+
+type MoveTokensPayload struct {
+	Moves []MoveTokenPayload `json:"moves"`
+}
+
+type SetGridOffsetPayload struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type SetPreventOverlapPayload struct {
+	Enabled bool `json:"enabled"`
+}
+
+type SetSnapPayload struct {
+	Enabled bool `json:"enabled"`
+}
+
+type SetGridTypePayload struct {
+	GridType string `json:"gridType"`
+}
+
+type SetSnapAnchorPayload struct {
+	Anchor string `json:"anchor"`
+}
+
 type DeleteTokenPayload struct {
 	ID string `json:"id"`
 }
 
+type DeleteTokensPayload struct {
+	IDs []string `json:"ids"`
+}
+
+type SetTokenHPPayload struct {
+	ID string `json:"id"`
+	HP int    `json:"hp"`
+}
+
+type SetTokenHiddenPayload struct {
+	ID     string `json:"id"`
+	Hidden bool   `json:"hidden"`
+}
+
+type SetTokenZPayload struct {
+	ID string `json:"id"`
+	Z  int    `json:"z"`
+}
+
+type SetTokenNameVisibilityPayload struct {
+	ID      string `json:"id"`
+	Visible bool   `json:"visible"`
+}
+
+type SetTokenElevationPayload struct {
+	ID        string  `json:"id"`
+	Elevation float64 `json:"elevation"`
+}
+
+type SetTokenAuraPayload struct {
+	ID     string  `json:"id"`
+	Radius float64 `json:"radius"`
+	Color  string  `json:"color"`
+}
+
+type TokenOrderPayload struct {
+	ID string `json:"id"`
+}
+
+type TokenConditionPayload struct {
+	ID        string `json:"id"`
+	Condition string `json:"condition"`
+}
+
+type ConcentrationPayload struct {
+	ID    string `json:"id"`
+	Spell string `json:"spell"`
+}
+
+type TokenDistancePayload struct {
+	IDA string `json:"idA"`
+	IDB string `json:"idB"`
+}
+
+type TokenDistanceResult struct {
+	IDA      string  `json:"idA"`
+	IDB      string  `json:"idB"`
+	Distance float64 `json:"distance"`
+}
+
+type SetBackgroundTransformPayload struct {
+	Scale   float64 `json:"scale"`
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+}
+
 type ChangeBackgroundPayload struct {
 	ImgPath string `json:"imgPath"`
+	// Optional: when both are set, GridUnit is refit so FitColumns grid
+	// cells span the image's intrinsic width.
+	ImageWidth float64 `json:"imageWidth,omitempty"`
+	FitColumns int     `json:"fitColumns,omitempty"`
 }
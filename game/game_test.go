@@ -1,6 +1,11 @@
 package game
 
-import "testing"
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
 
 func TestNewState(t *testing.T) {
 	s := NewState()
@@ -17,11 +22,14 @@ func TestNewState(t *testing.T) {
 	if s.GridUnit != 96 {
 		t.Errorf("expected gridUnit 96, got %f", s.GridUnit)
 	}
+	if s.GridOffsetX != 0 || s.GridOffsetY != 0 {
+		t.Errorf("expected grid offset (0,0), got (%f,%f)", s.GridOffsetX, s.GridOffsetY)
+	}
 }
 
 func TestAddToken(t *testing.T) {
 	s := NewState()
-	token := TokenData{Name: "Goblin", ImgPath: "/goblin.jpg", X: 96, Y: 96, TokenSize: 96}
+	token := TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg", X: 96, Y: 96, TokenSize: 96}
 
 	s.AddToken("t1", token)
 
@@ -37,6 +45,95 @@ func TestAddToken(t *testing.T) {
 	}
 }
 
+func TestAddTokenDefaultsSizeToGridUnit(t *testing.T) {
+	s := NewState()
+
+	s.AddToken("omitted", TokenData{Name: "Goblin"})
+	s.AddToken("negative", TokenData{Name: "Goblin", TokenSize: -50})
+	s.AddToken("large", TokenData{Name: "Ogre", TokenSize: 192})
+
+	for id, want := range map[string]float64{"omitted": 96, "negative": 96, "large": 192} {
+		if got := s.DisplayedTokens[id].TokenSize; got != want {
+			t.Errorf("%s: expected size %v, got %v", id, want, got)
+		}
+	}
+}
+
+func TestNewStateWithDefaults(t *testing.T) {
+	s := NewStateWithDefaults("/assets/maps/cave.png", 70)
+
+	if s.BackgroundImgPath != "/assets/maps/cave.png" || s.GridUnit != 70 {
+		t.Errorf("expected the given defaults, got %q at %v", s.BackgroundImgPath, s.GridUnit)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected a valid state, got %v", err)
+	}
+}
+
+func TestSetBackgroundTransform(t *testing.T) {
+	s := NewState()
+	if s.BackgroundScale != 1 || s.BackgroundOffsetX != 0 || s.BackgroundOffsetY != 0 {
+		t.Fatalf("expected an untransformed background, got %v (%v,%v)", s.BackgroundScale, s.BackgroundOffsetX, s.BackgroundOffsetY)
+	}
+
+	s.SetBackgroundTransform(1.5, -20, 12)
+	if s.BackgroundScale != 1.5 || s.BackgroundOffsetX != -20 || s.BackgroundOffsetY != 12 {
+		t.Errorf("expected scale 1.5 at (-20,12), got %v (%v,%v)", s.BackgroundScale, s.BackgroundOffsetX, s.BackgroundOffsetY)
+	}
+
+	for scale, want := range map[float64]float64{0.01: MinBackgroundScale, 50: MaxBackgroundScale} {
+		s.SetBackgroundTransform(scale, 0, 0)
+		if s.BackgroundScale != want {
+			t.Errorf("scale %v: expected %v, got %v", scale, want, s.BackgroundScale)
+		}
+	}
+}
+
+func TestMoveTokenPreventOverlap(t *testing.T) {
+	s := NewState()
+	s.SnapToGrid = true
+	s.AddToken("a", TokenData{Name: "Fighter", X: 0, Y: 0})
+	s.AddToken("b", TokenData{Name: "Rogue", X: 96, Y: 0})
+	s.AddToken("dragon", TokenData{Name: "Dragon", X: 192, Y: 0, TokenSize: 384})
+
+	if !s.MoveToken("a", 90, 5) {
+		t.Error("expected overlapping moves to be allowed by default")
+	}
+	s.MoveToken("a", 0, 0)
+
+	s.SetPreventOverlap(true)
+	if s.MoveToken("a", 100, 10) {
+		t.Error("expected a move onto b's cell to be refused")
+	}
+	if got := s.DisplayedTokens["a"]; got.X != 0 || got.Y != 0 {
+		t.Errorf("expected a to stay at (0,0), got (%v,%v)", got.X, got.Y)
+	}
+	if !s.MoveToken("a", 192, 0) {
+		t.Error("expected a token to share a cell with a much larger one")
+	}
+	if !s.MoveToken("b", 96, 96) {
+		t.Error("expected a move onto a free cell to succeed")
+	}
+}
+
+func TestMoveTokensShiftsFormationsWithPreventOverlap(t *testing.T) {
+	s := NewState()
+	s.PreventOverlap = true
+	s.AddToken("a", TokenData{Name: "Fighter", X: 0, Y: 0})
+	s.AddToken("b", TokenData{Name: "Rogue", X: 96, Y: 0})
+	s.AddToken("c", TokenData{Name: "Wizard", X: 288, Y: 0})
+
+	rejected := s.MoveTokens([]MoveTokenPayload{{ID: "a", X: 96, Y: 0}, {ID: "b", X: 192, Y: 0}})
+	if len(rejected) != 0 || s.DisplayedTokens["a"].X != 96 || s.DisplayedTokens["b"].X != 192 {
+		t.Errorf("expected the pair to shift right together, rejected %v", rejected)
+	}
+
+	rejected = s.MoveTokens([]MoveTokenPayload{{ID: "b", X: 288, Y: 0}})
+	if len(rejected) != 1 || rejected[0] != "b" {
+		t.Errorf("expected b to be refused c's cell, got %v", rejected)
+	}
+}
+
 func TestMoveToken(t *testing.T) {
 	s := NewState()
 	s.AddToken("t1", TokenData{Name: "Goblin", X: 96, Y: 96, TokenSize: 96})
@@ -60,6 +157,84 @@ func TestMoveTokenNonExistent(t *testing.T) {
 	}
 }
 
+func TestDuplicateToken(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg", X: 96, Y: 96, TokenSize: 96, HP: 5, MaxHP: 7})
+	s.AddTokenCondition("t1", "prone")
+
+	newID, ok := s.DuplicateToken("t1", 96, 0)
+	if !ok || newID == "" || newID == "t1" {
+		t.Fatalf("expected a new ID, got %q (ok=%v)", newID, ok)
+	}
+
+	dup := s.DisplayedTokens[newID]
+	if dup.Name != "Goblin" || dup.ImgPath != "/assets/goblin.jpg" || dup.TokenSize != 96 || dup.HP != 5 || dup.MaxHP != 7 {
+		t.Errorf("unexpected copy %+v", dup)
+	}
+	if dup.X != 192 || dup.Y != 96 {
+		t.Errorf("expected copy at (192,96), got (%f,%f)", dup.X, dup.Y)
+	}
+
+	// The copy's conditions must not alias the original's.
+	s.RemoveTokenCondition(newID, "prone")
+	if len(s.DisplayedTokens["t1"].Conditions) != 1 {
+		t.Error("changing the copy's conditions should not affect the original")
+	}
+}
+
+func TestDuplicateTokenPreventOverlap(t *testing.T) {
+	s := NewState()
+	s.PreventOverlap = true
+	s.AddToken("a", TokenData{Name: "Fighter", X: 0, Y: 0})
+	s.AddToken("b", TokenData{Name: "Rogue", X: 96, Y: 0})
+
+	if _, ok := s.DuplicateToken("a", 96, 0); ok {
+		t.Error("expected a copy onto b's cell to be refused")
+	}
+	if _, ok := s.DuplicateToken("a", 0, 0); ok {
+		t.Error("expected a copy on top of the original to be refused")
+	}
+	if len(s.DisplayedTokens) != 2 {
+		t.Errorf("expected no copies, got %d tokens", len(s.DisplayedTokens))
+	}
+	if _, ok := s.DuplicateToken("a", 0, 96); !ok {
+		t.Error("expected a copy onto a free cell to succeed")
+	}
+}
+
+func TestDuplicateTokenNonExistent(t *testing.T) {
+	s := NewState()
+
+	if _, ok := s.DuplicateToken("missing", 0, 0); ok {
+		t.Error("expected ok=false for an unknown token")
+	}
+	if len(s.DisplayedTokens) != 0 {
+		t.Error("duplicating an unknown token should not create one")
+	}
+}
+
+func TestMoveTokens(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin", X: 96, Y: 96})
+	s.AddToken("t2", TokenData{Name: "Orc", X: 192, Y: 96})
+
+	s.MoveTokens([]MoveTokenPayload{
+		{ID: "t1", X: 288, Y: 288},
+		{ID: "missing", X: 0, Y: 0},
+		{ID: "t2", X: 384, Y: 288},
+	})
+
+	if got := s.DisplayedTokens["t1"]; got.X != 288 || got.Y != 288 {
+		t.Errorf("expected t1 at (288,288), got (%f,%f)", got.X, got.Y)
+	}
+	if got := s.DisplayedTokens["t2"]; got.X != 384 || got.Y != 288 {
+		t.Errorf("expected t2 at (384,288), got (%f,%f)", got.X, got.Y)
+	}
+	if len(s.DisplayedTokens) != 2 {
+		t.Error("moving an unknown token should not create one")
+	}
+}
+
 func TestDeleteToken(t *testing.T) {
 	s := NewState()
 	s.AddToken("t1", TokenData{Name: "Goblin"})
@@ -78,6 +253,26 @@ func TestDeleteToken(t *testing.T) {
 	}
 }
 
+func TestDeleteTokens(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+	s.AddToken("t2", TokenData{Name: "Orc"})
+	s.AddToken("t3", TokenData{Name: "Troll"})
+	s.SetInitiative([]InitiativeEntry{{TokenID: "t1", Score: 12}, {TokenID: "t3", Score: 8}})
+
+	s.DeleteTokens([]string{"t1", "missing", "t2"})
+
+	if len(s.DisplayedTokens) != 1 {
+		t.Fatalf("expected 1 token left, got %d", len(s.DisplayedTokens))
+	}
+	if _, ok := s.DisplayedTokens["t3"]; !ok {
+		t.Error("t3 should not have been deleted")
+	}
+	if len(s.InitiativeOrder) != 1 || s.InitiativeOrder[0].TokenID != "t3" {
+		t.Errorf("expected deleted tokens to leave initiative, got %+v", s.InitiativeOrder)
+	}
+}
+
 func TestClearTokens(t *testing.T) {
 	s := NewState()
 	s.AddToken("t1", TokenData{Name: "Goblin"})
@@ -118,3 +313,582 @@ func TestToggleGrid(t *testing.T) {
 		t.Error("expected showGrid to be true after second toggle")
 	}
 }
+
+func TestStartConcentrationReplacesPrevious(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Wizard"})
+
+	s.StartConcentration("t1", "Bless")
+	s.StartConcentration("t1", "Haste")
+
+	if got := s.DisplayedTokens["t1"].ConcentratingOn; got != "Haste" {
+		t.Errorf("expected concentration on Haste, got %q", got)
+	}
+}
+
+func TestEndConcentration(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Wizard"})
+	s.StartConcentration("t1", "Bless")
+
+	s.EndConcentration("t1")
+
+	if got := s.DisplayedTokens["t1"].ConcentratingOn; got != "" {
+		t.Errorf("expected no concentration, got %q", got)
+	}
+}
+
+func TestStartConcentrationNonExistent(t *testing.T) {
+	s := NewState()
+
+	s.StartConcentration("does-not-exist", "Bless")
+
+	if len(s.DisplayedTokens) != 0 {
+		t.Error("concentrating on a non-existent token should not create one")
+	}
+}
+
+func TestGridDistance(t *testing.T) {
+	if got := GridDistance(0, 0, 96*3, 96*4, 96, DiagonalChebyshev); got != 4 {
+		t.Errorf("chebyshev: expected 4, got %f", got)
+	}
+	if got := GridDistance(0, 0, 96*3, 96*4, 96, DiagonalEuclidean); got != 5 {
+		t.Errorf("euclidean: expected 5, got %f", got)
+	}
+}
+
+func TestTokenDistance(t *testing.T) {
+	s := NewState()
+	s.AddToken("a", TokenData{Name: "Fighter", X: 96, Y: 96})
+	s.AddToken("b", TokenData{Name: "Goblin", X: 96 * 4, Y: 96 * 2})
+
+	got, ok := s.TokenDistance("a", "b")
+	if !ok {
+		t.Fatal("expected both tokens to be found")
+	}
+	if got != 3 {
+		t.Errorf("expected distance 3, got %f", got)
+	}
+
+	if _, ok := s.TokenDistance("a", "missing"); ok {
+		t.Error("expected distance to a missing token to fail")
+	}
+}
+
+func TestSetTokenHPClamps(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin", HP: 7, MaxHP: 7})
+
+	s.SetTokenHP("t1", 12)
+	if got := s.DisplayedTokens["t1"].HP; got != 7 {
+		t.Errorf("expected HP clamped to 7, got %d", got)
+	}
+
+	s.SetTokenHP("t1", -3)
+	if got := s.DisplayedTokens["t1"].HP; got != 0 {
+		t.Errorf("expected HP clamped to 0, got %d", got)
+	}
+
+	s.SetTokenHP("t1", 4)
+	if got := s.DisplayedTokens["t1"].HP; got != 4 {
+		t.Errorf("expected HP 4, got %d", got)
+	}
+}
+
+func TestSetTokenHPWithoutMax(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Zombie"})
+
+	s.SetTokenHP("t1", -5)
+
+	if got := s.DisplayedTokens["t1"].HP; got != -5 {
+		t.Errorf("expected HP -5 when MaxHP is unset, got %d", got)
+	}
+}
+
+func TestTokenHPJSONRoundTrip(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin", HP: 3, MaxHP: 7})
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored State
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.DisplayedTokens["t1"]; got.HP != 3 || got.MaxHP != 7 {
+		t.Errorf("expected HP 3/7 after round trip, got %d/%d", got.HP, got.MaxHP)
+	}
+
+	var legacy State
+	old := `{"displayedTokens":{"t1":{"name":"Goblin","imgPath":"/assets/goblin.jpg","x":0,"y":0,"tokenSize":96}}}`
+	if err := json.Unmarshal([]byte(old), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if got := legacy.DisplayedTokens["t1"]; got.HP != 0 || got.MaxHP != 0 {
+		t.Errorf("expected legacy token to load as 0/0, got %d/%d", got.HP, got.MaxHP)
+	}
+}
+
+func TestAddTokenWithoutImageDerivesPlaceholder(t *testing.T) {
+	s := NewState()
+
+	s.AddToken("t1", TokenData{Name: "goblin boss"})
+	s.AddToken("t2", TokenData{Name: "goblin boss"})
+
+	got := s.DisplayedTokens["t1"]
+	if got.Initials != "GB" {
+		t.Errorf("expected initials GB, got %q", got.Initials)
+	}
+	if got.PlaceholderColor == "" {
+		t.Error("expected a placeholder color")
+	}
+	if other := s.DisplayedTokens["t2"].PlaceholderColor; other != got.PlaceholderColor {
+		t.Errorf("expected deterministic color, got %q and %q", got.PlaceholderColor, other)
+	}
+}
+
+func TestAddTokenWithImageHasNoPlaceholder(t *testing.T) {
+	s := NewState()
+
+	s.AddToken("t1", TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg"})
+
+	got := s.DisplayedTokens["t1"]
+	if got.Initials != "" || got.PlaceholderColor != "" {
+		t.Errorf("expected no placeholder for a token with an image, got %+v", got)
+	}
+}
+
+func TestAddTokenInitializesConditions(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+
+	data, err := json.Marshal(s.DisplayedTokens["t1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"conditions":[]`) {
+		t.Errorf("expected conditions to serialize as [], got %s", data)
+	}
+}
+
+func TestAddTokenConditionDeduplicates(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+
+	s.AddTokenCondition("t1", "prone")
+	s.AddTokenCondition("t1", "poisoned")
+	s.AddTokenCondition("t1", "prone")
+
+	got := s.DisplayedTokens["t1"].Conditions
+	if len(got) != 2 || got[0] != "prone" || got[1] != "poisoned" {
+		t.Errorf("expected [prone poisoned], got %v", got)
+	}
+}
+
+func TestRemoveTokenCondition(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+	s.AddTokenCondition("t1", "prone")
+	s.AddTokenCondition("t1", "stunned")
+
+	s.RemoveTokenCondition("t1", "prone")
+	s.RemoveTokenCondition("t1", "blinded") // not present, no-op
+
+	got := s.DisplayedTokens["t1"].Conditions
+	if len(got) != 1 || got[0] != "stunned" {
+		t.Errorf("expected [stunned], got %v", got)
+	}
+}
+
+func TestClearTokenConditions(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+	s.AddTokenCondition("t1", "prone")
+	s.StartConcentration("t1", "Bless")
+
+	s.ClearTokenConditions("t1")
+
+	got := s.DisplayedTokens["t1"]
+	if got.Conditions == nil || len(got.Conditions) != 0 {
+		t.Errorf("expected empty conditions, got %v", got.Conditions)
+	}
+	if got.ConcentratingOn != "" {
+		t.Errorf("expected concentration cleared, got %q", got.ConcentratingOn)
+	}
+}
+
+func TestConcentrationCondition(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Wizard"})
+
+	s.StartConcentration("t1", "Bless")
+	s.StartConcentration("t1", "Haste")
+
+	got := s.DisplayedTokens["t1"]
+	if len(got.Conditions) != 1 || got.Conditions[0] != ConditionConcentration {
+		t.Errorf("expected a single concentration condition, got %v", got.Conditions)
+	}
+
+	s.RemoveTokenCondition("t1", ConditionConcentration)
+
+	if got := s.DisplayedTokens["t1"].ConcentratingOn; got != "" {
+		t.Errorf("removing concentration should end the spell, got %q", got)
+	}
+}
+
+func TestSetTokenZ(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+
+	s.SetTokenZ("t1", 5)
+
+	if got := s.DisplayedTokens["t1"].Z; got != 5 {
+		t.Errorf("expected z 5, got %d", got)
+	}
+}
+
+func TestSetTokenElevation(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Bulette"})
+
+	s.SetTokenElevation("t1", -10)
+	s.MoveToken("t1", 192, 192)
+	id, _ := s.DuplicateToken("t1", 96, 0)
+
+	if got := s.DisplayedTokens["t1"].Elevation; got != -10 {
+		t.Errorf("expected elevation -10 after moving, got %v", got)
+	}
+	if got := s.DisplayedTokens[id].Elevation; got != -10 {
+		t.Errorf("expected the duplicate to keep elevation -10, got %v", got)
+	}
+
+	var old TokenData
+	if err := json.Unmarshal([]byte(`{"name": "Goblin"}`), &old); err != nil || old.Elevation != 0 {
+		t.Errorf("expected snapshots without elevation to default to 0, got %v (%v)", old.Elevation, err)
+	}
+}
+
+func TestSetTokenAura(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Cleric"})
+
+	s.SetTokenAura("t1", 4, "#ffcc00")
+	s.SetTokenAura("t1", -1, "#ffcc00")
+	s.SetTokenAura("t1", 6, "yellow")
+	s.MoveToken("t1", 192, 192)
+	id, _ := s.DuplicateToken("t1", 96, 0)
+
+	for _, tid := range []string{"t1", id} {
+		if got := s.DisplayedTokens[tid]; got.AuraRadius != 4 || got.AuraColor != "#ffcc00" {
+			t.Errorf("%s: expected a 4-unit #ffcc00 aura, got %v %q", tid, got.AuraRadius, got.AuraColor)
+		}
+	}
+
+	s.SetTokenAura("t1", 0, "")
+	if got := s.DisplayedTokens["t1"]; got.AuraRadius != 0 {
+		t.Errorf("expected radius 0 to turn the aura off, got %v", got.AuraRadius)
+	}
+}
+
+func TestBringToFrontAndSendToBack(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin", Z: 0})
+	s.AddToken("t2", TokenData{Name: "Orc", Z: 3})
+	s.AddToken("t3", TokenData{Name: "Elf", Z: -2})
+
+	s.BringToFront("t1")
+	if got := s.DisplayedTokens["t1"].Z; got != 4 {
+		t.Errorf("expected z 4 after bring to front, got %d", got)
+	}
+
+	s.SendToBack("t1")
+	if got := s.DisplayedTokens["t1"].Z; got != -3 {
+		t.Errorf("expected z -3 after send to back, got %d", got)
+	}
+}
+
+func TestBringToFrontSingleToken(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin", Z: 2})
+
+	s.BringToFront("t1")
+
+	if got := s.DisplayedTokens["t1"].Z; got != 2 {
+		t.Errorf("expected a lone token to keep z 2, got %d", got)
+	}
+}
+
+func TestPlayerViewMasksNames(t *testing.T) {
+	s := NewState()
+	s.AddToken("dragon", TokenData{Name: "Ancient Red Dragon"})
+	s.AddToken("goblin", TokenData{Name: "Goblin"})
+	s.SetTokenNameVisibility("dragon", false)
+	s.SetInitiative([]InitiativeEntry{{TokenID: "dragon", Name: "Ancient Red Dragon", Score: 20}})
+
+	view := s.PlayerView()
+
+	if got := view.DisplayedTokens["dragon"]; got.Name != MaskedTokenName || got.Initials != "?" {
+		t.Errorf("expected a masked dragon, got %q (%q)", got.Name, got.Initials)
+	}
+	if got := view.DisplayedTokens["goblin"].Name; got != "Goblin" {
+		t.Errorf("expected names to be visible by default, got %q", got)
+	}
+	if got := view.InitiativeOrder[0].Name; got != MaskedTokenName {
+		t.Errorf("expected the initiative entry to be masked, got %q", got)
+	}
+	if s.DisplayedTokens["dragon"].Name != "Ancient Red Dragon" || s.InitiativeOrder[0].Name != "Ancient Red Dragon" {
+		t.Error("PlayerView should not modify the receiver")
+	}
+}
+
+func TestPlayerViewFiltersHiddenTokens(t *testing.T) {
+	s := NewState()
+	s.AddToken("visible", TokenData{Name: "Goblin"})
+	s.AddToken("ambush", TokenData{Name: "Ogre"})
+	s.SetTokenHidden("ambush", true)
+
+	view := s.PlayerView()
+
+	if _, ok := view.DisplayedTokens["ambush"]; ok {
+		t.Error("hidden token should not be in the player view")
+	}
+	if _, ok := view.DisplayedTokens["visible"]; !ok {
+		t.Error("visible token should be in the player view")
+	}
+	if _, ok := s.DisplayedTokens["ambush"]; !ok {
+		t.Error("PlayerView should not modify the original state")
+	}
+}
+
+func TestPlayerViewFiltersHiddenInitiative(t *testing.T) {
+	s := NewState()
+	s.AddToken("fighter", TokenData{Name: "Fighter"})
+	s.AddToken("ambush", TokenData{Name: "Ogre"})
+	s.AddToken("wizard", TokenData{Name: "Wizard"})
+	s.SetTokenHidden("ambush", true)
+	s.SetInitiative([]InitiativeEntry{
+		{TokenID: "fighter", Score: 20},
+		{TokenID: "ambush", Score: 15},
+		{TokenID: "wizard", Score: 10},
+	})
+
+	for turn, want := range []string{"fighter", "wizard", "wizard"} {
+		s.CurrentTurn = turn
+		view := s.PlayerView()
+		if len(view.InitiativeOrder) != 2 {
+			t.Fatalf("expected the hidden token's entry to be dropped, got %+v", view.InitiativeOrder)
+		}
+		if got := view.InitiativeOrder[view.CurrentTurn].TokenID; got != want {
+			t.Errorf("turn %d: expected players to see %s as current, got %s", turn, want, got)
+		}
+	}
+	if len(s.InitiativeOrder) != 3 {
+		t.Error("PlayerView should not modify the original state")
+	}
+}
+
+func TestCloneIsDeep(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+	s.AddTokenCondition("t1", "prone")
+
+	clone := s.Clone()
+	s.MoveToken("t1", 500, 500)
+	s.AddToken("t2", TokenData{Name: "Orc"})
+	s.DisplayedTokens["t1"].Conditions[0] = "stunned"
+
+	if len(clone.DisplayedTokens) != 1 {
+		t.Errorf("clone should not see new tokens, got %d", len(clone.DisplayedTokens))
+	}
+	got := clone.DisplayedTokens["t1"]
+	if got.X != 0 || got.Conditions[0] != "prone" {
+		t.Errorf("clone should be unaffected by later changes, got %+v", got)
+	}
+}
+
+func TestFitGridToImage(t *testing.T) {
+	s := NewState()
+
+	s.FitGridToImage(2000, 25)
+
+	if s.GridUnit != 80 {
+		t.Errorf("expected gridUnit 80, got %f", s.GridUnit)
+	}
+}
+
+func TestFitGridToImageIgnoresMissingInputs(t *testing.T) {
+	s := NewState()
+
+	s.FitGridToImage(2000, 0)
+	s.FitGridToImage(0, 25)
+
+	if s.GridUnit != 96 {
+		t.Errorf("expected gridUnit to stay 96, got %f", s.GridUnit)
+	}
+}
+
+func TestMoveTokenSnapsToGrid(t *testing.T) {
+	s := NewState()
+	s.SetSnapToGrid(true)
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+
+	s.MoveToken("t1", 100, 100)
+	if got := s.DisplayedTokens["t1"]; got.X != 96 || got.Y != 96 {
+		t.Errorf("expected (96,96), got (%f,%f)", got.X, got.Y)
+	}
+
+	s.MoveToken("t1", 150, 40)
+	if got := s.DisplayedTokens["t1"]; got.X != 192 || got.Y != 0 {
+		t.Errorf("expected (192,0), got (%f,%f)", got.X, got.Y)
+	}
+}
+
+func TestMoveTokenSnapAnchors(t *testing.T) {
+	s := NewState()
+	s.SetSnapToGrid(true)
+	s.AddToken("small", TokenData{Name: "Goblin"})
+	s.AddToken("large", TokenData{Name: "Ogre", TokenSize: 192})
+
+	// Corner: positions land on grid lines whatever the size.
+	s.MoveToken("small", 130, 130)
+	s.MoveToken("large", 130, 130)
+	if got := s.DisplayedTokens["small"]; got.X != 96 || got.Y != 96 {
+		t.Errorf("corner: expected the small token at (96,96), got (%f,%f)", got.X, got.Y)
+	}
+	if got := s.DisplayedTokens["large"]; got.X != 96 || got.Y != 96 {
+		t.Errorf("corner: expected the large token at (96,96), got (%f,%f)", got.X, got.Y)
+	}
+
+	// Center: a one-cell token sits mid-cell, a two-cell token on a grid line.
+	s.SetSnapAnchor(SnapAnchorCenter)
+	s.MoveToken("small", 130, 130)
+	s.MoveToken("large", 130, 130)
+	if got := s.DisplayedTokens["small"]; got.X != 144 || got.Y != 144 {
+		t.Errorf("center: expected the small token at (144,144), got (%f,%f)", got.X, got.Y)
+	}
+	if got := s.DisplayedTokens["large"]; got.X != 96 || got.Y != 96 {
+		t.Errorf("center: expected the large token at (96,96), got (%f,%f)", got.X, got.Y)
+	}
+
+	s.SetSnapAnchor("middle")
+	if s.SnapAnchor != SnapAnchorCenter {
+		t.Errorf("expected an unknown anchor to be ignored, got %q", s.SnapAnchor)
+	}
+}
+
+func TestMoveTokenSnapsToIsoGrid(t *testing.T) {
+	s := NewState()
+	s.SetSnapToGrid(true)
+	s.SetGridType(GridIso)
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+	s.AddToken("t2", TokenData{Name: "Orc"})
+
+	// Grid points are 48 apart across and 24 down, staggered like a diamond lattice.
+	for _, tc := range []struct{ x, y, wantX, wantY float64 }{
+		{50, 20, 48, 24},
+		{5, 47, 0, 48},
+		{-40, 30, -48, 24},
+	} {
+		s.MoveToken("t1", tc.x, tc.y)
+		if got := s.DisplayedTokens["t1"]; got.X != tc.wantX || got.Y != tc.wantY {
+			t.Errorf("expected (%v,%v) to snap to (%v,%v), got (%v,%v)", tc.x, tc.y, tc.wantX, tc.wantY, got.X, got.Y)
+		}
+	}
+
+	// Centered, a one-cell token sits in the middle of the diamond below its point.
+	s.SetSnapAnchor(SnapAnchorCenter)
+	s.MoveToken("t1", 50, 44)
+	if got := s.DisplayedTokens["t1"]; got.X != 48 || got.Y != 48 {
+		t.Errorf("center: expected (48,48), got (%v,%v)", got.X, got.Y)
+	}
+
+	s.SetPreventOverlap(true)
+	if s.MoveToken("t2", 46, 50) {
+		t.Error("expected a move into t1's diamond to be refused")
+	}
+	if !s.MoveToken("t2", 0, 72) {
+		t.Error("expected a move into the next diamond to succeed")
+	}
+
+	s.SetGridType("hex")
+	if s.GridType != GridIso {
+		t.Errorf("expected an unknown grid type to be ignored, got %q", s.GridType)
+	}
+}
+
+func TestMoveTokenWithoutSnap(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+
+	s.MoveToken("t1", 100, 100)
+
+	if got := s.DisplayedTokens["t1"]; got.X != 100 || got.Y != 100 {
+		t.Errorf("expected (100,100) with snapping off, got (%f,%f)", got.X, got.Y)
+	}
+}
+
+func TestMoveTokenSnapsWithGridOffset(t *testing.T) {
+	s := NewState()
+	s.SetSnapToGrid(true)
+	s.SetGridOffset(20, 10)
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+
+	s.MoveToken("t1", 100, 100)
+
+	if got := s.DisplayedTokens["t1"]; got.X != 116 || got.Y != 106 {
+		t.Errorf("expected (116,106), got (%f,%f)", got.X, got.Y)
+	}
+}
+
+func TestValidateImgPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/assets/default/maps/tavern.jpg":  true,
+		"/assets/uploads/1b4e28ba.png":     true,
+		"/assets/tokens/Goblin Archer.png": true,
+		"/assets/../../etc/passwd":         false,
+		"/assets/maps/../../secret.jpg":    false,
+		"/assets/./maps/tavern.jpg":        false,
+		"/assets//maps/tavern.jpg":         false,
+		"http://evil/x.png":                false,
+		"//evil/assets/x.png":              false,
+		"/etc/passwd":                      false,
+		"/assets/":                         false,
+		"/assets/x.png?v=1":                false,
+		"":                                 false,
+	} {
+		if got := ValidateImgPath(path); got != want {
+			t.Errorf("ValidateImgPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestInvalidImgPathsAreIgnored(t *testing.T) {
+	s := NewState()
+
+	s.ChangeBackgroundImg("http://evil/x.png")
+	s.AddToken("t1", TokenData{Name: "Goblin", ImgPath: "/assets/../../etc/passwd"})
+
+	if s.BackgroundImgPath != NewState().BackgroundImgPath {
+		t.Errorf("expected background unchanged, got %q", s.BackgroundImgPath)
+	}
+	if len(s.DisplayedTokens) != 0 {
+		t.Error("expected token with an invalid image path to be ignored")
+	}
+}
+
+func TestImagePaths(t *testing.T) {
+	state := NewState()
+	state.BackgroundImgPath = "/assets/maps/cave.jpg"
+	state.AddToken("a", TokenData{ImgPath: "/assets/tokens/goblin.png"})
+	state.AddToken("b", TokenData{ImgPath: "/assets/tokens/goblin.png"})
+	state.AddToken("c", TokenData{ImgPath: "/assets/tokens/orc.png"})
+	state.AddToken("d", TokenData{})
+
+	want := []string{"/assets/maps/cave.jpg", "/assets/tokens/goblin.png", "/assets/tokens/orc.png"}
+	if got := state.ImagePaths(); !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,74 @@
+package game
+
+import "sort"
+
+// ForEachInGroup calls fn for every token in the group, in ID order, and
+// stores whatever fn changes. An empty groupID matches nothing, so
+// ungrouped tokens never act as one group.
+func (s *State) ForEachInGroup(groupID string, fn func(id string, t *TokenData)) {
+	s.forEachMember(groupID, true, fn)
+}
+
+// forEachMember is ForEachInGroup, optionally skipping hidden members so a
+// player's group action can't reach tokens they can't see.
+func (s *State) forEachMember(groupID string, includeHidden bool, fn func(id string, t *TokenData)) {
+	if groupID == "" {
+		return
+	}
+	var ids []string
+	for id, token := range s.DisplayedTokens {
+		if token.GroupID == groupID && (includeHidden || !token.Hidden) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		token := s.DisplayedTokens[id]
+		fn(id, &token)
+		s.DisplayedTokens[id] = token
+	}
+}
+
+// MoveGroup shifts every token in the group by (dx, dy) as one MoveTokens
+// call, so members snap and are checked against PreventOverlap without
+// blocking each other. Hidden members only move when includeHidden is set.
+// It returns the IDs of members refused by PreventOverlap.
+func (s *State) MoveGroup(groupID string, dx, dy float64, includeHidden bool) []string {
+	var moves []MoveTokenPayload
+	s.forEachMember(groupID, includeHidden, func(id string, t *TokenData) {
+		moves = append(moves, MoveTokenPayload{ID: id, X: t.X + dx, Y: t.Y + dy})
+	})
+	return s.MoveTokens(moves)
+}
+
+// DeleteGroup removes every token in the group, leaving hidden members
+// unless includeHidden is set.
+func (s *State) DeleteGroup(groupID string, includeHidden bool) {
+	var ids []string
+	s.forEachMember(groupID, includeHidden, func(id string, _ *TokenData) {
+		ids = append(ids, id)
+	})
+	s.DeleteTokens(ids)
+}
+
+// SetGroupHidden hides or reveals every token in the group.
+func (s *State) SetGroupHidden(groupID string, hidden bool) {
+	s.ForEachInGroup(groupID, func(_ string, t *TokenData) {
+		t.Hidden = hidden
+	})
+}
+
+type MoveGroupPayload struct {
+	GroupID string  `json:"groupId"`
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+}
+
+type DeleteGroupPayload struct {
+	GroupID string `json:"groupId"`
+}
+
+type SetGroupHiddenPayload struct {
+	GroupID string `json:"groupId"`
+	Hidden  bool   `json:"hidden"`
+}
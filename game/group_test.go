@@ -0,0 +1,97 @@
+package game
+
+import "testing"
+
+func groupState() State {
+	s := NewState()
+	s.AddToken("g1", TokenData{Name: "Goblin", X: 96, Y: 96, GroupID: "warband"})
+	s.AddToken("g2", TokenData{Name: "Goblin", X: 192, Y: 96, GroupID: "warband"})
+	s.AddToken("pc", TokenData{Name: "Fighter", X: 0, Y: 0})
+	return s
+}
+
+func TestMoveGroup(t *testing.T) {
+	s := groupState()
+
+	s.MoveGroup("warband", 96, 48, true)
+
+	if g1, g2 := s.DisplayedTokens["g1"], s.DisplayedTokens["g2"]; g1.X != 192 || g1.Y != 144 || g2.X != 288 || g2.Y != 144 {
+		t.Errorf("expected the group shifted by (96,48), got %+v and %+v", g1, g2)
+	}
+	if pc := s.DisplayedTokens["pc"]; pc.X != 0 || pc.Y != 0 {
+		t.Errorf("expected tokens outside the group to stay put, got %+v", pc)
+	}
+}
+
+func TestMoveGroupPreventOverlap(t *testing.T) {
+	s := groupState()
+	s.PreventOverlap = true
+	s.AddToken("wall", TokenData{Name: "Wall", X: 288, Y: 96})
+
+	rejected := s.MoveGroup("warband", 96, 0, true)
+
+	// g2 is refused the wall's cell, which leaves g1 nowhere to go either.
+	if len(rejected) != 2 {
+		t.Errorf("expected both members refused, got %v", rejected)
+	}
+	if g1, g2 := s.DisplayedTokens["g1"], s.DisplayedTokens["g2"]; g1.X != 96 || g2.X != 192 {
+		t.Errorf("expected the group to stay put, got %+v and %+v", g1, g2)
+	}
+
+	rejected = s.MoveGroup("warband", 0, 96, true)
+	if len(rejected) != 0 || s.DisplayedTokens["g1"].Y != 192 || s.DisplayedTokens["g2"].Y != 192 {
+		t.Errorf("expected the group to move onto free cells, rejected %v", rejected)
+	}
+}
+
+func TestDeleteGroup(t *testing.T) {
+	s := groupState()
+	s.SetInitiative([]InitiativeEntry{{TokenID: "g1"}, {TokenID: "pc"}})
+
+	s.DeleteGroup("warband", true)
+
+	if len(s.DisplayedTokens) != 1 {
+		t.Errorf("expected only the ungrouped token left, got %v", s.DisplayedTokens)
+	}
+	if len(s.InitiativeOrder) != 1 {
+		t.Errorf("expected deleted tokens to leave initiative, got %v", s.InitiativeOrder)
+	}
+}
+
+func TestGroupActionsCanSkipHiddenMembers(t *testing.T) {
+	s := groupState()
+	s.SetTokenHidden("g2", true)
+
+	s.MoveGroup("warband", 96, 0, false)
+	if g1, g2 := s.DisplayedTokens["g1"], s.DisplayedTokens["g2"]; g1.X != 192 || g2.X != 192 {
+		t.Errorf("expected only the visible member moved, got %+v and %+v", g1, g2)
+	}
+
+	s.DeleteGroup("warband", false)
+	if _, ok := s.DisplayedTokens["g1"]; ok {
+		t.Error("expected the visible member deleted")
+	}
+	if _, ok := s.DisplayedTokens["g2"]; !ok {
+		t.Error("expected the hidden member left alone")
+	}
+}
+
+func TestSetGroupHidden(t *testing.T) {
+	s := groupState()
+
+	s.SetGroupHidden("warband", true)
+
+	if !s.DisplayedTokens["g1"].Hidden || !s.DisplayedTokens["g2"].Hidden || s.DisplayedTokens["pc"].Hidden {
+		t.Errorf("expected only the group hidden, got %+v", s.DisplayedTokens)
+	}
+}
+
+func TestEmptyGroupMatchesNothing(t *testing.T) {
+	s := groupState()
+
+	s.DeleteGroup("", true)
+
+	if len(s.DisplayedTokens) != 3 {
+		t.Errorf("expected ungrouped tokens to be left alone, got %d tokens", len(s.DisplayedTokens))
+	}
+}
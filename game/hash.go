@@ -0,0 +1,33 @@
+package game
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+)
+
+// Hash fingerprints the state so clients can tell whether they have drifted
+// out of sync. It is the 64-bit FNV-1a of the state's canonical encoding,
+// written as 16 hex digits.
+//
+// The canonical encoding is compact JSON with no trailing newline: struct
+// fields in declaration order, map keys (token, note, fog IDs, ...) sorted,
+// and strings escaped only where JSON requires it, so <, > and & are written
+// as themselves. Numbers use the shortest form that round-trips, as in
+// ECMAScript's Number.prototype.toString. Slices such as the initiative order
+// keep their order, since it is part of the state. A state that cannot be
+// encoded hashes to "".
+func (s State) Hash() string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		log.Printf("warning: cannot hash state: %v\n", err)
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,56 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"testing"
+)
+
+func TestHashIgnoresInsertionOrder(t *testing.T) {
+	a := NewState()
+	a.AddToken("t1", TokenData{Name: "Goblin", X: 96})
+	a.AddToken("t2", TokenData{Name: "Orc", X: 192})
+	a.AddNote("n1", Note{Text: "Trap"})
+
+	b := NewState()
+	b.AddNote("n1", Note{Text: "Trap"})
+	b.AddToken("t2", TokenData{Name: "Orc", X: 192})
+	b.AddToken("t1", TokenData{Name: "Goblin", X: 96})
+
+	if a.Hash() != b.Hash() {
+		t.Errorf("expected equal states to hash alike, got %s and %s", a.Hash(), b.Hash())
+	}
+	if len(a.Hash()) != 16 {
+		t.Errorf("expected 16 hex digits, got %q", a.Hash())
+	}
+}
+
+func TestHashChangesWithState(t *testing.T) {
+	state := NewState()
+	state.AddToken("t1", TokenData{Name: "Goblin", X: 96})
+	before := state.Hash()
+
+	state.MoveToken("t1", 192, 0)
+	if state.Hash() == before {
+		t.Error("expected moving a token to change the hash")
+	}
+}
+
+func TestHashDoesNotEscapeHTML(t *testing.T) {
+	state := NewState()
+	state.AddNote("n1", Note{Text: "<b>Trap</b> & pit"})
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical := strings.NewReplacer(`\u003c`, "<", `\u003e`, ">", `\u0026`, "&").Replace(string(data))
+	h := fnv.New64a()
+	h.Write([]byte(canonical))
+
+	if want := fmt.Sprintf("%016x", h.Sum64()); state.Hash() != want {
+		t.Errorf("expected the hash of the unescaped encoding %s, got %s", want, state.Hash())
+	}
+}
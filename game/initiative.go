@@ -0,0 +1,129 @@
+package game
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+type InitiativeEntry struct {
+	TokenID string `json:"tokenId"`
+	Score   int    `json:"score"`
+	Name    string `json:"name"`
+}
+
+// ValidateInitiative checks that every entry naming a token names one on the
+// board. Entries without a tokenId, such as lair actions, are allowed.
+func (s *State) ValidateInitiative(entries []InitiativeEntry) error {
+	for _, entry := range entries {
+		if _, ok := s.DisplayedTokens[entry.TokenID]; entry.TokenID != "" && !ok {
+			return fmt.Errorf("initiative entry for unknown token %q", entry.TokenID)
+		}
+	}
+	return nil
+}
+
+// SetInitiative replaces the initiative order with entries sorted by
+// descending score, and starts again from the first turn of round 1. Ties
+// keep the order they were given in.
+func (s *State) SetInitiative(entries []InitiativeEntry) {
+	order := slices.Clone(entries)
+	if order == nil {
+		order = []InitiativeEntry{}
+	}
+	slices.SortStableFunc(order, func(a, b InitiativeEntry) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	s.InitiativeOrder = order
+	s.CurrentTurn = 0
+	s.Round = 1
+}
+
+// SetTokenInitiative sets the token's initiative score, adding it to the
+// order if it isn't there yet, and re-sorts. The current turn stays with the
+// same combatant. Starting an order from empty begins round 1, as
+// SetInitiative does. Unknown tokens are ignored.
+func (s *State) SetTokenInitiative(tokenID string, score int) {
+	token, ok := s.DisplayedTokens[tokenID]
+	if !ok {
+		return
+	}
+	var active string
+	if s.CurrentTurn < len(s.InitiativeOrder) {
+		active = s.InitiativeOrder[s.CurrentTurn].TokenID
+	}
+
+	order := slices.Clone(s.InitiativeOrder)
+	i := slices.IndexFunc(order, func(e InitiativeEntry) bool {
+		return e.TokenID == tokenID
+	})
+	if i < 0 {
+		order = append(order, InitiativeEntry{TokenID: tokenID, Name: token.Name})
+		i = len(order) - 1
+	}
+	order[i].Score = score
+	slices.SortStableFunc(order, func(a, b InitiativeEntry) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	if len(s.InitiativeOrder) == 0 {
+		s.Round = 1
+	}
+	s.InitiativeOrder = order
+	s.CurrentTurn = max(0, slices.IndexFunc(order, func(e InitiativeEntry) bool {
+		return e.TokenID == active
+	}))
+}
+
+// NextTurn advances to the next entry, wrapping back to the first and
+// starting a new round.
+func (s *State) NextTurn() {
+	if len(s.InitiativeOrder) == 0 {
+		return
+	}
+	s.CurrentTurn = (s.CurrentTurn + 1) % len(s.InitiativeOrder)
+	if s.CurrentTurn == 0 {
+		s.Round++
+	}
+}
+
+// SetRound overrides the round counter, e.g. to correct a missed turn.
+func (s *State) SetRound(round int) {
+	s.Round = round
+}
+
+func (s *State) ClearInitiative() {
+	s.InitiativeOrder = []InitiativeEntry{}
+	s.CurrentTurn = 0
+	s.Round = 0
+}
+
+// removeFromInitiative drops the token's entry, keeping the current turn on
+// the same combatant when an earlier entry is removed.
+func (s *State) removeFromInitiative(tokenID string) {
+	i := slices.IndexFunc(s.InitiativeOrder, func(e InitiativeEntry) bool {
+		return e.TokenID == tokenID
+	})
+	if i < 0 {
+		return
+	}
+	s.InitiativeOrder = slices.Delete(slices.Clone(s.InitiativeOrder), i, i+1)
+	if i < s.CurrentTurn {
+		s.CurrentTurn--
+	}
+	if s.CurrentTurn >= len(s.InitiativeOrder) {
+		s.CurrentTurn = 0
+	}
+}
+
+type SetInitiativePayload struct {
+	Entries []InitiativeEntry `json:"entries"`
+}
+
+type SetTokenInitiativePayload struct {
+	TokenID string `json:"tokenId"`
+	Value   int    `json:"value"`
+}
+
+type SetRoundPayload struct {
+	Round int `json:"round"`
+}
@@ -0,0 +1,167 @@
+package game
+
+import "testing"
+
+func TestSetInitiativeSortsDescending(t *testing.T) {
+	s := NewState()
+
+	s.SetInitiative([]InitiativeEntry{
+		{TokenID: "a", Score: 8, Name: "Goblin"},
+		{TokenID: "b", Score: 17, Name: "Rogue"},
+		{TokenID: "c", Score: 12, Name: "Fighter"},
+	})
+
+	want := []string{"b", "c", "a"}
+	for i, id := range want {
+		if s.InitiativeOrder[i].TokenID != id {
+			t.Fatalf("expected order %v, got %+v", want, s.InitiativeOrder)
+		}
+	}
+	if s.CurrentTurn != 0 {
+		t.Errorf("expected current turn 0, got %d", s.CurrentTurn)
+	}
+}
+
+func TestNextTurnWraps(t *testing.T) {
+	s := NewState()
+	s.SetInitiative([]InitiativeEntry{{TokenID: "a", Score: 2}, {TokenID: "b", Score: 1}})
+
+	s.NextTurn()
+	if s.CurrentTurn != 1 {
+		t.Errorf("expected turn 1, got %d", s.CurrentTurn)
+	}
+	s.NextTurn()
+	if s.CurrentTurn != 0 {
+		t.Errorf("expected turn to wrap to 0, got %d", s.CurrentTurn)
+	}
+}
+
+func TestNextTurnCountsRounds(t *testing.T) {
+	s := NewState()
+	s.SetInitiative([]InitiativeEntry{{TokenID: "a", Score: 3}, {TokenID: "b", Score: 2}, {TokenID: "c", Score: 1}})
+	if s.Round != 1 {
+		t.Fatalf("expected setting initiative to start round 1, got %d", s.Round)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.NextTurn()
+	}
+	if s.Round != 2 || s.CurrentTurn != 0 {
+		t.Errorf("expected a full cycle to start round 2, got round %d turn %d", s.Round, s.CurrentTurn)
+	}
+
+	s.SetRound(5)
+	s.NextTurn()
+	if s.Round != 5 {
+		t.Errorf("expected the set round to hold until the next wrap, got %d", s.Round)
+	}
+
+	s.ClearInitiative()
+	if s.Round != 0 {
+		t.Errorf("expected clearing initiative to reset the round, got %d", s.Round)
+	}
+}
+
+func TestNextTurnEmpty(t *testing.T) {
+	s := NewState()
+
+	s.NextTurn()
+
+	if s.CurrentTurn != 0 {
+		t.Errorf("expected turn 0 with no initiative, got %d", s.CurrentTurn)
+	}
+}
+
+func TestClearInitiative(t *testing.T) {
+	s := NewState()
+	s.SetInitiative([]InitiativeEntry{{TokenID: "a", Score: 2}, {TokenID: "b", Score: 1}})
+	s.NextTurn()
+
+	s.ClearInitiative()
+
+	if len(s.InitiativeOrder) != 0 || s.CurrentTurn != 0 {
+		t.Errorf("expected empty initiative, got %+v turn %d", s.InitiativeOrder, s.CurrentTurn)
+	}
+}
+
+func TestDeleteTokenRemovesInitiativeEntry(t *testing.T) {
+	s := NewState()
+	s.AddToken("a", TokenData{Name: "Rogue"})
+	s.AddToken("b", TokenData{Name: "Fighter"})
+	s.AddToken("c", TokenData{Name: "Goblin"})
+	s.SetInitiative([]InitiativeEntry{{TokenID: "a", Score: 3}, {TokenID: "b", Score: 2}, {TokenID: "c", Score: 1}})
+	s.NextTurn() // Fighter's turn
+
+	s.DeleteToken("a")
+
+	if len(s.InitiativeOrder) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", s.InitiativeOrder)
+	}
+	if got := s.InitiativeOrder[s.CurrentTurn].TokenID; got != "b" {
+		t.Errorf("expected it to still be b's turn, got %s", got)
+	}
+}
+
+func TestDeleteLastTokenInOrderWrapsTurn(t *testing.T) {
+	s := NewState()
+	s.AddToken("a", TokenData{Name: "Rogue"})
+	s.AddToken("b", TokenData{Name: "Goblin"})
+	s.SetInitiative([]InitiativeEntry{{TokenID: "a", Score: 2}, {TokenID: "b", Score: 1}})
+	s.NextTurn()
+
+	s.DeleteToken("b")
+
+	if s.CurrentTurn != 0 {
+		t.Errorf("expected turn to wrap to 0, got %d", s.CurrentTurn)
+	}
+}
+
+func TestSetTokenInitiativeResortsAndKeepsTurn(t *testing.T) {
+	s := NewState()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.AddToken(id, TokenData{Name: id})
+	}
+	s.SetInitiative([]InitiativeEntry{
+		{TokenID: "a", Score: 20},
+		{TokenID: "b", Score: 15},
+		{TokenID: "c", Score: 10},
+	})
+	s.NextTurn() // b is acting
+
+	s.SetTokenInitiative("c", 25)
+	s.SetTokenInitiative("d", 18)
+	s.SetTokenInitiative("missing", 30)
+
+	want := []string{"c", "a", "d", "b"}
+	if len(s.InitiativeOrder) != len(want) {
+		t.Fatalf("expected order %v, got %+v", want, s.InitiativeOrder)
+	}
+	for i, id := range want {
+		if s.InitiativeOrder[i].TokenID != id {
+			t.Fatalf("expected order %v, got %+v", want, s.InitiativeOrder)
+		}
+	}
+	if s.InitiativeOrder[2].Name != "d" || s.InitiativeOrder[2].Score != 18 {
+		t.Errorf("expected the inserted entry to carry the token's name and score, got %+v", s.InitiativeOrder[2])
+	}
+	if got := s.InitiativeOrder[s.CurrentTurn].TokenID; got != "b" {
+		t.Errorf("expected b to keep the turn, got %s", got)
+	}
+}
+
+func TestSetTokenInitiativeStartsRoundOne(t *testing.T) {
+	s := NewState()
+	s.AddToken("a", TokenData{Name: "a"})
+	s.AddToken("b", TokenData{Name: "b"})
+
+	s.SetTokenInitiative("a", 12)
+	if s.Round != 1 {
+		t.Errorf("expected a new order to start at round 1, got %d", s.Round)
+	}
+
+	s.NextTurn()
+	s.SetTokenInitiative("b", 8)
+	if s.Round != 2 {
+		t.Errorf("expected adding to a running order to keep the round, got %d", s.Round)
+	}
+}
@@ -0,0 +1,34 @@
+package game
+
+// Note is a labeled pin on the map. GM-only notes are left out of PlayerView.
+type Note struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Text   string  `json:"text"`
+	GMOnly bool    `json:"gmOnly"`
+}
+
+// AddNote places a note, replacing any note with the same ID.
+func (s *State) AddNote(id string, note Note) {
+	s.Notes[id] = note
+}
+
+// UpdateNote replaces an existing note; unknown IDs are ignored.
+func (s *State) UpdateNote(id string, note Note) {
+	if _, ok := s.Notes[id]; ok {
+		s.Notes[id] = note
+	}
+}
+
+func (s *State) DeleteNote(id string) {
+	delete(s.Notes, id)
+}
+
+type NotePayload struct {
+	ID   string `json:"id"`
+	Note Note   `json:"note"`
+}
+
+type DeleteNotePayload struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,39 @@
+package game
+
+import "testing"
+
+func TestNotes(t *testing.T) {
+	s := NewState()
+
+	s.AddNote("n1", Note{X: 10, Y: 20, Text: "Trapdoor"})
+	s.UpdateNote("n1", Note{X: 10, Y: 20, Text: "Trapdoor (disarmed)"})
+	s.UpdateNote("missing", Note{Text: "ghost"})
+
+	if len(s.Notes) != 1 || s.Notes["n1"].Text != "Trapdoor (disarmed)" {
+		t.Fatalf("unexpected notes %+v", s.Notes)
+	}
+
+	s.DeleteNote("n1")
+
+	if len(s.Notes) != 0 {
+		t.Errorf("expected note deleted, got %+v", s.Notes)
+	}
+}
+
+func TestPlayerViewHidesGMOnlyNotes(t *testing.T) {
+	s := NewState()
+	s.AddNote("public", Note{Text: "Tavern"})
+	s.AddNote("secret", Note{Text: "Hidden cache", GMOnly: true})
+
+	view := s.PlayerView()
+
+	if _, ok := view.Notes["secret"]; ok {
+		t.Error("GM-only note should be hidden from players")
+	}
+	if _, ok := view.Notes["public"]; !ok {
+		t.Error("public note should be visible to players")
+	}
+	if len(s.Notes) != 2 {
+		t.Error("PlayerView should not modify the original state")
+	}
+}
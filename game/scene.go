@@ -0,0 +1,172 @@
+package game
+
+import (
+	"maps"
+	"slices"
+)
+
+// DefaultScene is the ID of the scene every session starts in. States saved
+// before scenes existed are migrated into it by Validate.
+const DefaultScene = "default"
+
+// SceneState is one prepared map: its tokens, background, grid, encounter
+// and annotations. The active scene's contents live in State's own fields,
+// so its entry in State.Scenes carries only its name.
+type SceneState struct {
+	Name              string                `json:"name"`
+	DisplayedTokens   map[string]TokenData  `json:"displayedTokens,omitempty"`
+	BackgroundImgPath string                `json:"backgroundImgPath,omitempty"`
+	BackgroundScale   float64               `json:"backgroundScale,omitempty"`
+	BackgroundOffsetX float64               `json:"backgroundOffsetX,omitempty"`
+	BackgroundOffsetY float64               `json:"backgroundOffsetY,omitempty"`
+	GridUnit          float64               `json:"gridUnit,omitempty"`
+	GridOffsetX       float64               `json:"gridOffsetX,omitempty"`
+	GridOffsetY       float64               `json:"gridOffsetY,omitempty"`
+	GridType          string                `json:"gridType,omitempty"`
+	InitiativeOrder   []InitiativeEntry     `json:"initiativeOrder,omitempty"`
+	CurrentTurn       int                   `json:"currentTurn,omitempty"`
+	Round             int                   `json:"round,omitempty"`
+	FogRegions        []FogRect             `json:"fogRegions,omitempty"`
+	Drawings          []Drawing             `json:"drawings,omitempty"`
+	Notes             map[string]Note       `json:"notes,omitempty"`
+	TextObjects       map[string]TextObject `json:"textObjects,omitempty"`
+}
+
+// CreateScene adds an empty scene with the given background and the active
+// scene's grid unit. It reports false if id is empty or already taken.
+func (s *State) CreateScene(id, name, bg string) bool {
+	if _, ok := s.Scenes[id]; ok || id == "" {
+		return false
+	}
+	if bg != "" && !ValidateImgPath(bg) {
+		return false
+	}
+	s.Scenes[id] = SceneState{
+		Name:              name,
+		DisplayedTokens:   make(map[string]TokenData),
+		BackgroundImgPath: bg,
+		BackgroundScale:   1,
+		GridUnit:          s.GridUnit,
+		GridType:          GridSquare,
+		InitiativeOrder:   []InitiativeEntry{},
+		FogRegions:        []FogRect{},
+		Drawings:          []Drawing{},
+		Notes:             make(map[string]Note),
+		TextObjects:       make(map[string]TextObject),
+	}
+	return true
+}
+
+// SwitchScene stores the active scene away and makes id active. It reports
+// false if there is no such scene or it is already active.
+func (s *State) SwitchScene(id string) bool {
+	next, ok := s.Scenes[id]
+	if !ok || id == s.ActiveScene {
+		return false
+	}
+	current := s.sceneContents()
+	current.Name = s.Scenes[s.ActiveScene].Name
+	s.Scenes[s.ActiveScene] = current
+
+	s.loadScene(next)
+	s.Scenes[id] = SceneState{Name: next.Name}
+	s.ActiveScene = id
+	return true
+}
+
+// DeleteScene removes an inactive scene. It reports false for the active
+// scene or an unknown ID.
+func (s *State) DeleteScene(id string) bool {
+	if _, ok := s.Scenes[id]; !ok || id == s.ActiveScene {
+		return false
+	}
+	delete(s.Scenes, id)
+	return true
+}
+
+// sceneContents copies the active scene out of the state's own fields.
+func (s *State) sceneContents() SceneState {
+	return SceneState{
+		DisplayedTokens:   s.DisplayedTokens,
+		BackgroundImgPath: s.BackgroundImgPath,
+		BackgroundScale:   s.BackgroundScale,
+		BackgroundOffsetX: s.BackgroundOffsetX,
+		BackgroundOffsetY: s.BackgroundOffsetY,
+		GridUnit:          s.GridUnit,
+		GridOffsetX:       s.GridOffsetX,
+		GridOffsetY:       s.GridOffsetY,
+		GridType:          s.GridType,
+		InitiativeOrder:   s.InitiativeOrder,
+		CurrentTurn:       s.CurrentTurn,
+		Round:             s.Round,
+		FogRegions:        s.FogRegions,
+		Drawings:          s.Drawings,
+		Notes:             s.Notes,
+		TextObjects:       s.TextObjects,
+	}
+}
+
+// loadScene makes scene's contents the state's own fields.
+func (s *State) loadScene(scene SceneState) {
+	s.DisplayedTokens = scene.DisplayedTokens
+	s.BackgroundImgPath = scene.BackgroundImgPath
+	s.BackgroundScale = scene.BackgroundScale
+	s.BackgroundOffsetX = scene.BackgroundOffsetX
+	s.BackgroundOffsetY = scene.BackgroundOffsetY
+	s.GridUnit = scene.GridUnit
+	s.GridOffsetX = scene.GridOffsetX
+	s.GridOffsetY = scene.GridOffsetY
+	s.GridType = scene.GridType
+	s.InitiativeOrder = scene.InitiativeOrder
+	s.CurrentTurn = scene.CurrentTurn
+	s.Round = scene.Round
+	s.FogRegions = scene.FogRegions
+	s.Drawings = scene.Drawings
+	s.Notes = scene.Notes
+	s.TextObjects = scene.TextObjects
+}
+
+// cloneScenes deep-copies scenes the way Clone copies the active one.
+func cloneScenes(scenes map[string]SceneState) map[string]SceneState {
+	if scenes == nil {
+		return nil
+	}
+	clone := make(map[string]SceneState, len(scenes))
+	for id, scene := range scenes {
+		if scene.DisplayedTokens != nil {
+			tokens := make(map[string]TokenData, len(scene.DisplayedTokens))
+			for tid, token := range scene.DisplayedTokens {
+				token.Conditions = slices.Clone(token.Conditions)
+				tokens[tid] = token
+			}
+			scene.DisplayedTokens = tokens
+		}
+		scene.InitiativeOrder = slices.Clone(scene.InitiativeOrder)
+		scene.FogRegions = slices.Clone(scene.FogRegions)
+		scene.Drawings = slices.Clone(scene.Drawings)
+		scene.Notes = maps.Clone(scene.Notes)
+		scene.TextObjects = maps.Clone(scene.TextObjects)
+		clone[id] = scene
+	}
+	return clone
+}
+
+// sceneNames lists scenes by name only, for clients that may not see the
+// contents of scenes the GM hasn't switched to.
+func sceneNames(scenes map[string]SceneState) map[string]SceneState {
+	names := make(map[string]SceneState, len(scenes))
+	for id, scene := range scenes {
+		names[id] = SceneState{Name: scene.Name}
+	}
+	return names
+}
+
+type CreateScenePayload struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	BackgroundImgPath string `json:"backgroundImgPath"`
+}
+
+type SceneIDPayload struct {
+	ID string `json:"id"`
+}
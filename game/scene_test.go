@@ -0,0 +1,110 @@
+package game
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSwitchSceneKeepsEachScenesBoard(t *testing.T) {
+	s := NewState()
+	s.AddToken("bartender", TokenData{Name: "Bartender"})
+
+	if !s.CreateScene("cellar", "Cellar", "/assets/maps/cellar.jpg") {
+		t.Fatal("expected the scene to be created")
+	}
+	if s.CreateScene("cellar", "Again", "") {
+		t.Error("expected a duplicate scene ID to be refused")
+	}
+
+	if !s.SwitchScene("cellar") {
+		t.Fatal("expected to switch to the cellar")
+	}
+	if s.ActiveScene != "cellar" || s.BackgroundImgPath != "/assets/maps/cellar.jpg" || len(s.DisplayedTokens) != 0 {
+		t.Fatalf("expected the empty cellar, got %q with %d tokens", s.BackgroundImgPath, len(s.DisplayedTokens))
+	}
+	s.AddToken("rat", TokenData{Name: "Rat"})
+	s.SetBackgroundTransform(2, 10, 10)
+
+	s.SwitchScene(DefaultScene)
+	if _, ok := s.DisplayedTokens["bartender"]; !ok || len(s.DisplayedTokens) != 1 {
+		t.Errorf("expected the tavern's tokens back, got %v", s.DisplayedTokens)
+	}
+	if s.BackgroundImgPath != DefaultBackground || s.BackgroundScale != 1 {
+		t.Errorf("expected the tavern background back, got %q at scale %v", s.BackgroundImgPath, s.BackgroundScale)
+	}
+	if got := s.Scenes["cellar"].DisplayedTokens; len(got) != 1 {
+		t.Errorf("expected the cellar to keep its rat, got %v", got)
+	}
+	if s.Scenes[DefaultScene].DisplayedTokens != nil {
+		t.Error("expected the active scene's entry to carry only its name")
+	}
+}
+
+func TestDeleteScene(t *testing.T) {
+	s := NewState()
+	s.CreateScene("cellar", "Cellar", "")
+
+	if s.DeleteScene(DefaultScene) {
+		t.Error("expected the active scene to be kept")
+	}
+	if !s.DeleteScene("cellar") || len(s.Scenes) != 1 {
+		t.Errorf("expected the cellar deleted, got %v", s.Scenes)
+	}
+}
+
+func TestCloneCopiesScenes(t *testing.T) {
+	s := NewState()
+	s.CreateScene("cellar", "Cellar", "")
+
+	clone := s.Clone()
+	clone.Scenes["cellar"].DisplayedTokens["rat"] = TokenData{Name: "Rat"}
+
+	if len(s.Scenes["cellar"].DisplayedTokens) != 0 {
+		t.Error("expected the clone's scenes to be independent")
+	}
+}
+
+func TestPlayerViewHidesOtherScenes(t *testing.T) {
+	s := NewState()
+	s.CreateScene("lair", "Dragon's Lair", "")
+	s.Scenes["lair"].DisplayedTokens["dragon"] = TokenData{Name: "Dragon"}
+
+	view := s.PlayerView()
+
+	if lair := view.Scenes["lair"]; lair.Name != "Dragon's Lair" || lair.DisplayedTokens != nil {
+		t.Errorf("expected only the scene name, got %+v", lair)
+	}
+	if len(s.Scenes["lair"].DisplayedTokens) != 1 {
+		t.Error("PlayerView should not modify the receiver")
+	}
+}
+
+func TestValidateMigratesStatesWithoutScenes(t *testing.T) {
+	var s State
+	legacy := `{"displayedTokens": {"t1": {"name": "Goblin"}}, "backgroundImgPath": "/assets/maps/cave.png", "gridUnit": 96, "notes": {}}`
+	if err := json.Unmarshal([]byte(legacy), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.ActiveScene != DefaultScene || len(s.Scenes) != 1 || len(s.DisplayedTokens) != 1 {
+		t.Errorf("expected the board to become the default scene, got %q %v", s.ActiveScene, s.Scenes)
+	}
+	if s.BackgroundScale != 1 {
+		t.Errorf("expected a missing background scale to default to 1, got %v", s.BackgroundScale)
+	}
+}
+
+func TestValidateChecksInactiveScenes(t *testing.T) {
+	s := NewState()
+	s.CreateScene("cellar", "Cellar", "")
+	cellar := s.Scenes["cellar"]
+	cellar.BackgroundImgPath = "http://evil/x.png"
+	s.Scenes["cellar"] = cellar
+
+	if err := s.Validate(); err == nil {
+		t.Error("expected an invalid inactive scene to be rejected")
+	}
+}
@@ -0,0 +1,68 @@
+package game
+
+import "fmt"
+
+// MaxTextSize caps the font size of a text object, in pixels.
+const MaxTextSize = 500
+
+// TextObject is large free text drawn on the map, such as a room name or a
+// sign. Size is its font size in pixels; an empty Color leaves the choice to
+// the client.
+type TextObject struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Text  string  `json:"text"`
+	Size  float64 `json:"size"`
+	Color string  `json:"color"`
+}
+
+// Validate checks the text object's size and color.
+func (t TextObject) Validate() error {
+	if t.Size <= 0 || t.Size > MaxTextSize {
+		return fmt.Errorf("text size must be between 0 and %d, got %v", MaxTextSize, t.Size)
+	}
+	if t.Color != "" && !ValidColor(t.Color) {
+		return fmt.Errorf("invalid text color %q", t.Color)
+	}
+	return nil
+}
+
+// AddText places a text object, replacing any with the same ID.
+func (s *State) AddText(id string, text TextObject) {
+	s.TextObjects[id] = text
+}
+
+// UpdateText replaces an existing text object; unknown IDs are ignored.
+func (s *State) UpdateText(id string, text TextObject) {
+	if _, ok := s.TextObjects[id]; ok {
+		s.TextObjects[id] = text
+	}
+}
+
+// MoveText moves a text object; unknown IDs are ignored.
+func (s *State) MoveText(id string, x, y float64) {
+	if text, ok := s.TextObjects[id]; ok {
+		text.X = x
+		text.Y = y
+		s.TextObjects[id] = text
+	}
+}
+
+func (s *State) DeleteText(id string) {
+	delete(s.TextObjects, id)
+}
+
+type TextPayload struct {
+	ID   string     `json:"id"`
+	Text TextObject `json:"text"`
+}
+
+type MoveTextPayload struct {
+	ID string  `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+}
+
+type DeleteTextPayload struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,74 @@
+package game
+
+import "testing"
+
+func TestTextObjects(t *testing.T) {
+	s := NewState()
+
+	s.AddText("t1", TextObject{X: 10, Y: 20, Text: "Throne Room", Size: 48})
+	s.UpdateText("t1", TextObject{X: 10, Y: 20, Text: "Ruined Throne Room", Size: 48, Color: "#ffcc00"})
+	s.UpdateText("missing", TextObject{Text: "ghost", Size: 12})
+	s.MoveText("t1", 96, 192)
+	s.MoveText("missing", 1, 1)
+
+	if len(s.TextObjects) != 1 {
+		t.Fatalf("unexpected text objects %+v", s.TextObjects)
+	}
+	if got := s.TextObjects["t1"]; got.Text != "Ruined Throne Room" || got.X != 96 || got.Y != 192 {
+		t.Errorf("unexpected text object %+v", got)
+	}
+
+	s.DeleteText("t1")
+
+	if len(s.TextObjects) != 0 {
+		t.Errorf("expected text deleted, got %+v", s.TextObjects)
+	}
+}
+
+func TestTextObjectValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		text TextObject
+		ok   bool
+	}{
+		"valid":         {TextObject{Size: 24, Color: "#112233"}, true},
+		"default color": {TextObject{Size: 24}, true},
+		"zero size":     {TextObject{Size: 0}, false},
+		"too large":     {TextObject{Size: MaxTextSize + 1}, false},
+		"bad color":     {TextObject{Size: 24, Color: "red"}, false},
+	} {
+		if err := tc.text.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v", name, err)
+		}
+	}
+}
+
+func TestTextObjectsFollowScenes(t *testing.T) {
+	s := NewState()
+	s.AddText("sign", TextObject{Text: "Tavern", Size: 24})
+	s.CreateScene("cave", "Cave", "")
+
+	s.SwitchScene("cave")
+	if len(s.TextObjects) != 0 {
+		t.Errorf("expected the new scene to have no text, got %+v", s.TextObjects)
+	}
+	s.SwitchScene(DefaultScene)
+	if s.TextObjects["sign"].Text != "Tavern" {
+		t.Errorf("expected the text to come back with its scene, got %+v", s.TextObjects)
+	}
+}
+
+func TestValidateFillsMissingTextObjects(t *testing.T) {
+	s := NewState()
+	s.TextObjects = nil
+	if err := s.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.TextObjects == nil {
+		t.Error("expected missing text objects to become an empty map")
+	}
+
+	s.AddText("t1", TextObject{Text: "Huge", Size: MaxTextSize * 2})
+	if err := s.Validate(); err == nil {
+		t.Error("expected an oversized text object to be rejected")
+	}
+}
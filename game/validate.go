@@ -0,0 +1,161 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// ValidColor reports whether color is a "#rrggbb" hex color.
+func ValidColor(color string) bool {
+	return hexColor.MatchString(color)
+}
+
+// Validate checks the fields a client supplies when adding a token. Both
+// add_token and State.Validate use it, so anything the server accepts can
+// be exported and imported again. A negative size isn't an error here:
+// AddToken replaces it with the grid unit.
+func (t TokenData) Validate() error {
+	if t.ImgPath != "" && !ValidateImgPath(t.ImgPath) {
+		return fmt.Errorf("invalid image path %q", t.ImgPath)
+	}
+	if t.MaxHP < 0 {
+		return errors.New("maxHp must not be negative")
+	}
+	if t.PlaceholderColor != "" && !ValidColor(t.PlaceholderColor) {
+		return fmt.Errorf("invalid placeholder color %q", t.PlaceholderColor)
+	}
+	if t.AuraRadius < 0 || (t.AuraColor != "" && !ValidColor(t.AuraColor)) {
+		return errors.New("invalid aura")
+	}
+	return nil
+}
+
+// Validate checks a state from outside the server, such as an imported file,
+// before it replaces a live session's state. Missing lists are replaced with
+// empty ones so the state marshals the same as one from NewState, and a state
+// saved before scenes existed becomes the default scene.
+func (s *State) Validate() error {
+	if s.ActiveScene == "" && s.Scenes == nil {
+		s.ActiveScene = DefaultScene
+		s.Scenes = map[string]SceneState{DefaultScene: {Name: "Default"}}
+	}
+	active, ok := s.Scenes[s.ActiveScene]
+	if !ok {
+		return fmt.Errorf("active scene %q is missing", s.ActiveScene)
+	}
+	s.Scenes[s.ActiveScene] = SceneState{Name: active.Name}
+	if s.SnapAnchor == "" {
+		s.SnapAnchor = SnapAnchorCorner
+	}
+	if !ValidSnapAnchor(s.SnapAnchor) {
+		return fmt.Errorf("invalid snapAnchor %q", s.SnapAnchor)
+	}
+	for id, scene := range s.Scenes {
+		if id == s.ActiveScene {
+			continue
+		}
+		board := State{}
+		board.loadScene(scene)
+		// An empty scene's maps are dropped by omitempty on export.
+		if board.DisplayedTokens == nil {
+			board.DisplayedTokens = make(map[string]TokenData)
+		}
+		if board.Notes == nil {
+			board.Notes = make(map[string]Note)
+		}
+		if err := board.validateBoard(); err != nil {
+			return fmt.Errorf("scene %q: %w", id, err)
+		}
+		contents := board.sceneContents()
+		contents.Name = scene.Name
+		s.Scenes[id] = contents
+	}
+	return s.validateBoard()
+}
+
+// validateBoard checks the active scene's fields for Validate.
+func (s *State) validateBoard() error {
+	if s.DisplayedTokens == nil {
+		return errors.New("displayedTokens is required")
+	}
+	if s.Notes == nil {
+		return errors.New("notes is required")
+	}
+	if s.GridUnit <= 0 {
+		return fmt.Errorf("gridUnit must be positive, got %v", s.GridUnit)
+	}
+	if s.GridType == "" {
+		s.GridType = GridSquare
+	}
+	if !ValidGridType(s.GridType) {
+		return fmt.Errorf("invalid gridType %q", s.GridType)
+	}
+
+	if s.BackgroundScale == 0 {
+		s.BackgroundScale = 1
+	}
+	if s.BackgroundScale < MinBackgroundScale || s.BackgroundScale > MaxBackgroundScale {
+		return fmt.Errorf("backgroundScale must be between %v and %v, got %v", MinBackgroundScale, MaxBackgroundScale, s.BackgroundScale)
+	}
+	if s.BackgroundImgPath != "" && !ValidateImgPath(s.BackgroundImgPath) {
+		return fmt.Errorf("invalid background image path %q", s.BackgroundImgPath)
+	}
+
+	for id, token := range s.DisplayedTokens {
+		if err := token.Validate(); err != nil {
+			return fmt.Errorf("token %q: %w", id, err)
+		}
+		// Tokens are stored with a positive size; see AddToken.
+		if token.TokenSize < 0 {
+			return fmt.Errorf("token %q: size must not be negative", id)
+		}
+		if token.Conditions == nil {
+			token.Conditions = []string{}
+			s.DisplayedTokens[id] = token
+		}
+	}
+	if err := s.ValidateInitiative(s.InitiativeOrder); err != nil {
+		return err
+	}
+	if s.CurrentTurn < 0 || (s.CurrentTurn > 0 && s.CurrentTurn >= len(s.InitiativeOrder)) {
+		return fmt.Errorf("currentTurn %d is out of range", s.CurrentTurn)
+	}
+	if s.Round < 0 {
+		return fmt.Errorf("round must not be negative, got %d", s.Round)
+	}
+	for id, text := range s.TextObjects {
+		if err := text.Validate(); err != nil {
+			return fmt.Errorf("text %q: %w", id, err)
+		}
+	}
+	for _, fog := range s.FogRegions {
+		if err := fog.Validate(); err != nil {
+			return fmt.Errorf("fog region %q: %w", fog.ID, err)
+		}
+	}
+	for _, drawing := range s.Drawings {
+		if len(drawing.Points) > MaxDrawingPoints {
+			return fmt.Errorf("drawing %q has more than %d points", drawing.ID, MaxDrawingPoints)
+		}
+		if err := drawing.Validate(); err != nil {
+			return fmt.Errorf("drawing %q: %w", drawing.ID, err)
+		}
+	}
+
+	if s.InitiativeOrder == nil {
+		s.InitiativeOrder = []InitiativeEntry{}
+	}
+	if s.FogRegions == nil {
+		s.FogRegions = []FogRect{}
+	}
+	if s.Drawings == nil {
+		s.Drawings = []Drawing{}
+	}
+	if s.TextObjects == nil {
+		s.TextObjects = make(map[string]TextObject)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package game
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidColor(t *testing.T) {
+	for color, want := range map[string]bool{
+		"#ff0000": true,
+		"#A1b2C3": true,
+		"ff0000":  false,
+		"#fff":    false,
+		"red":     false,
+		"#ff00zz": false,
+	} {
+		if got := ValidColor(color); got != want {
+			t.Errorf("ValidColor(%q) = %v, want %v", color, got, want)
+		}
+	}
+}
+
+func TestValidateAcceptsNewState(t *testing.T) {
+	s := NewState()
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+	s.SetInitiative([]InitiativeEntry{{TokenID: "t1", Score: 12}})
+
+	if err := s.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateFillsMissingLists(t *testing.T) {
+	s := State{
+		DisplayedTokens: map[string]TokenData{"t1": {Name: "Goblin"}},
+		Notes:           map[string]Note{},
+		GridUnit:        96,
+	}
+
+	if err := s.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.InitiativeOrder == nil || s.FogRegions == nil || s.Drawings == nil || s.DisplayedTokens["t1"].Conditions == nil {
+		t.Errorf("expected nil lists to be replaced with empty ones, got %+v", s)
+	}
+}
+
+func TestValidateAcceptsExportedScenes(t *testing.T) {
+	s := NewState()
+	s.CreateScene("cellar", "Cellar", "")
+	s.AddToken("t1", TokenData{Name: "Goblin"})
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imported State
+	if err := json.Unmarshal(data, &imported); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.Validate(); err != nil {
+		t.Fatalf("expected an exported state to import, got %v", err)
+	}
+	if !imported.SwitchScene("cellar") || imported.DisplayedTokens == nil || imported.Notes == nil {
+		t.Errorf("expected the empty scene to come back usable, got %+v", imported)
+	}
+}
+
+func TestValidateRejectsInvalidStates(t *testing.T) {
+	for name, mutate := range map[string]func(*State){
+		"nil tokens":          func(s *State) { s.DisplayedTokens = nil },
+		"nil notes":           func(s *State) { s.Notes = nil },
+		"zero grid":           func(s *State) { s.GridUnit = 0 },
+		"negative size":       func(s *State) { s.DisplayedTokens["t1"] = TokenData{TokenSize: -1} },
+		"bad placeholder":     func(s *State) { s.DisplayedTokens["t1"] = TokenData{PlaceholderColor: "blue"} },
+		"unknown turn":        func(s *State) { s.InitiativeOrder = []InitiativeEntry{{TokenID: "ghost"}} },
+		"turn out of range":   func(s *State) { s.CurrentTurn = 3 },
+		"negative fog":        func(s *State) { s.FogRegions = []FogRect{{ID: "f1", W: -5}} },
+		"external background": func(s *State) { s.BackgroundImgPath = "http://evil/x.png" },
+		"external token":      func(s *State) { s.DisplayedTokens["t1"] = TokenData{ImgPath: "/assets/../secret.png"} },
+		"bad drawing color":   func(s *State) { s.Drawings = []Drawing{{ID: "d1", Color: "red"}} },
+		"long drawing":        func(s *State) { s.Drawings = []Drawing{{ID: "d1", Points: make([]Point, MaxDrawingPoints+1)}} },
+		"bad snap anchor":     func(s *State) { s.SnapAnchor = "middle" },
+		"bad grid type":       func(s *State) { s.GridType = "hex" },
+	} {
+		s := NewState()
+		s.AddToken("t1", TokenData{Name: "Goblin"})
+		mutate(&s)
+
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -2,40 +2,74 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 
+	"quick-tabletop-engine/config"
 	"quick-tabletop-engine/session"
+	"quick-tabletop-engine/upload"
 )
 
-// hardcoded 5 session limit
-var sessionManager = session.NewManager(5)
+// configPath is the optional JSON config file read at startup.
+const configPath = "config.json"
 
-func setupApp() *fiber.App {
-	app := fiber.New()
+// shutdownTimeout bounds how long a graceful shutdown waits for connections.
+const shutdownTimeout = 10 * time.Second
+
+var sessionManager = session.NewManager(config.Default())
+
+func setupApp(cfg config.Config) *fiber.App {
+	app := fiber.New(fiber.Config{
+		// Leave room for the multipart framing around the largest upload.
+		BodyLimit: int(cfg.MaxUploadBytes) + 1<<20,
+	})
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
 		AllowMethods: "GET,POST,OPTIONS",
-		AllowHeaders: "Content-Type",
+		AllowHeaders: "Content-Type,Authorization",
 	}))
 
+	manager := sessionManager
 	app.Use("/ws", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
+			if !manager.OriginAllowed(c.Get(fiber.HeaderOrigin)) {
+				return fiber.ErrForbidden
+			}
 			c.Locals("allowed", true)
 			return c.Next()
 		}
 		return fiber.ErrUpgradeRequired
 	})
 
+	app.Static("/assets", cfg.AssetsDir)
+	app.Post("/upload", upload.Handler(cfg.AssetsDir, cfg.MaxUploadBytes))
+
 	app.Get("/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": "ok"})
 	})
+	// /ready is for load balancers. Sessions live in memory and no external
+	// store is configured, so there is nothing to wait on once the server
+	// is listening.
+	app.Get("/ready", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+
+	app.Get("/metrics", sessionManager.GetMetrics)
+	app.Get("/debug/session/:id", sessionManager.DebugSession)
 
 	app.Post("/session", sessionManager.CreateSession)
 	app.Get("/session/:id", sessionManager.GetSession)
+	app.Get("/session/:id/assets", sessionManager.GetSessionAssets)
+	app.Get("/session/:id/export", sessionManager.ExportSession)
+	app.Post("/session/:id/import", sessionManager.ImportSession)
+	app.Post("/session/:id/sharelink", sessionManager.CreateShareLink)
 
 	app.Get("/ws/:sessionId", websocket.New(sessionManager.HandleWS))
 
@@ -43,7 +77,69 @@ func setupApp() *fiber.App {
 }
 
 func main() {
-	app := setupApp()
-	log.Fatal(app.Listen(":3000"))
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatalf("failed to load %s: %v", configPath, err)
+	}
+	cfg.Validate()
+	sessionManager = session.NewManager(cfg)
+	stopSweeper := make(chan struct{})
+	sessionManager.StartSweeper(stopSweeper)
+
+	app := setupApp(cfg)
+
+	go reloadOnHangup(cfg)
+
+	// On SIGINT/SIGTERM, disconnect every client and let in-flight requests
+	// finish before exiting.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Println("shutting down")
+		close(stopSweeper)
+		sessionManager.Shutdown()
+		if err := app.ShutdownWithTimeout(shutdownTimeout); err != nil {
+			log.Println("shutdown:", err)
+		}
+	}()
+
+	if err := app.Listen(cfg.Addr()); err != nil {
+		log.Fatal(err)
+	}
+	<-done
 }
 
+// reloadOnHangup re-reads the config file on every SIGHUP and applies it to
+// the session manager. The listen address, assets directory and upload limit
+// are wired into the app at startup and can only change on restart.
+func reloadOnHangup(current config.Config) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			log.Printf("reload: failed to load %s, keeping current config: %v", configPath, err)
+			continue
+		}
+		cfg.Validate()
+		if cfg.Addr() != current.Addr() {
+			log.Printf("reload: ignoring listen address change to %s until restart", cfg.Addr())
+			cfg.ListenAddr = current.ListenAddr
+		}
+		if cfg.AssetsDir != current.AssetsDir {
+			log.Printf("reload: ignoring assets directory change to %s until restart", cfg.AssetsDir)
+			cfg.AssetsDir = current.AssetsDir
+		}
+		if cfg.MaxUploadBytes != current.MaxUploadBytes {
+			log.Printf("reload: ignoring upload limit change to %d until restart", cfg.MaxUploadBytes)
+			cfg.MaxUploadBytes = current.MaxUploadBytes
+		}
+		sessionManager.UpdateConfig(cfg)
+		current = cfg
+		log.Println("reload: config applied")
+	}
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
 
+	"quick-tabletop-engine/config"
 	"quick-tabletop-engine/game"
 	"quick-tabletop-engine/session"
 )
@@ -19,11 +28,21 @@ import (
 // It also resets global state so tests are isolated.
 func startTestServer(t *testing.T) string {
 	t.Helper()
+	return startTestServerWithConfig(t, config.Default())
+}
+
+// startTestServerWithConfig is startTestServer backed by a session manager
+// built from cfg; the default manager is restored afterwards.
+func startTestServerWithConfig(t *testing.T, cfg config.Config) string {
+	t.Helper()
 
-	// Reset global state between tests.
-	sessionManager.Reset()
+	prev := sessionManager
+	sessionManager = session.NewManager(cfg)
+	t.Cleanup(func() {
+		sessionManager = prev
+	})
 
-	app := setupApp()
+	app := setupApp(cfg)
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -67,11 +86,23 @@ func createTestSession(t *testing.T, addr string) string {
 	return sessionId
 }
 
-// connectWS dials the WebSocket endpoint for a given session and returns the connection.
+// connectWS dials the WebSocket endpoint for a given session, consumes the
+// welcome message and returns the connection.
 func connectWS(t *testing.T, addr, sessionId string) *websocket.Conn {
 	t.Helper()
+	conn, _ := joinWS(t, addr, sessionId, "")
+	return conn
+}
+
+// joinWS dials the session with an optional query string and returns the
+// connection along with the welcome message the server greets it with.
+func joinWS(t *testing.T, addr, sessionId, query string) (*websocket.Conn, session.Welcome) {
+	t.Helper()
 
 	url := fmt.Sprintf("ws://%s/ws/%s", addr, sessionId)
+	if query != "" {
+		url += "?" + query
+	}
 	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
 		t.Fatalf("failed to connect to ws: %v", err)
@@ -81,41 +112,110 @@ func connectWS(t *testing.T, addr, sessionId string) *websocket.Conn {
 		conn.Close()
 	})
 
-	return conn
+	var welcome session.Welcome
+	if msgType := readServerMessage(t, conn, 2*time.Second, &welcome); msgType != "welcome" {
+		t.Fatalf("expected welcome, got %s", msgType)
+	}
+	return conn, welcome
 }
 
-// readStateUpdate reads a message, parses it as a ServerMessage with state_update type,
-// and returns the game.State payload.
+// readStateUpdate reads the next message, checks it is a state_update and
+// returns the game.State payload.
 func readStateUpdate(t *testing.T, conn *websocket.Conn, timeout time.Duration) game.State {
 	t.Helper()
-	conn.SetReadDeadline(time.Now().Add(timeout))
+	var state game.State
+	if msgType := readServerMessage(t, conn, timeout, &state); msgType != "state_update" {
+		t.Fatalf("expected type state_update, got %s", msgType)
+	}
+	return state
+}
+
+// ignoredTypes are roster broadcasts sent on every join and leave. Tests
+// skip over them unless they read them explicitly with readMessageOfType.
+var ignoredTypes = map[string]bool{"presence_update": true, "client_joined": true, "client_left": true}
+
+// readServerMessage reads the next message that isn't in ignoredTypes and
+// decodes its payload into v, returning the message type.
+func readServerMessage(t *testing.T, conn *websocket.Conn, timeout time.Duration, v interface{}) string {
+	t.Helper()
+	msgType, ok := tryReadServerMessage(t, conn, timeout, v)
+	if !ok {
+		t.Fatal("failed to read message before timeout")
+	}
+	return msgType
+}
+
+// tryReadServerMessage is readServerMessage but reports false instead of
+// failing when nothing arrives within timeout.
+func tryReadServerMessage(t *testing.T, conn *websocket.Conn, timeout time.Duration, v interface{}) (string, bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		msgType, payload, ok := readRaw(t, conn, deadline)
+		if !ok {
+			return "", false
+		}
+		if ignoredTypes[msgType] {
+			continue
+		}
+		decodePayload(t, msgType, payload, v)
+		return msgType, true
+	}
+}
+
+// readMessageOfType reads until a message of msgType arrives and decodes its
+// payload into v, discarding anything else.
+func readMessageOfType(t *testing.T, conn *websocket.Conn, timeout time.Duration, msgType string, v interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		gotType, payload, ok := readRaw(t, conn, deadline)
+		if !ok {
+			t.Fatalf("no %s message before timeout", msgType)
+		}
+		if gotType == msgType {
+			decodePayload(t, msgType, payload, v)
+			return
+		}
+	}
+}
+
+func readRaw(t *testing.T, conn *websocket.Conn, deadline time.Time) (string, json.RawMessage, bool) {
+	t.Helper()
+	conn.SetReadDeadline(deadline)
 	_, msg, err := conn.ReadMessage()
 	if err != nil {
-		t.Fatalf("failed to read message: %v", err)
+		return "", nil, false
 	}
 
-	var serverMsg session.ServerMessage
-	if err := json.Unmarshal(msg, &serverMsg); err != nil {
-		t.Fatalf("failed to unmarshal server message: %v", err)
+	var raw struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
 	}
-	if serverMsg.Type != "state_update" {
-		t.Fatalf("expected type state_update, got %s", serverMsg.Type)
+	if err := json.Unmarshal(msg, &raw); err != nil {
+		t.Fatalf("failed to unmarshal server message: %v", err)
 	}
+	return raw.Type, raw.Payload, true
+}
 
-	// Re-marshal payload and unmarshal into game.State
-	payloadBytes, err := json.Marshal(serverMsg.Payload)
-	if err != nil {
-		t.Fatalf("failed to marshal payload: %v", err)
+func decodePayload(t *testing.T, msgType string, payload json.RawMessage, v interface{}) {
+	t.Helper()
+	if v == nil {
+		return
 	}
-	var state game.State
-	if err := json.Unmarshal(payloadBytes, &state); err != nil {
-		t.Fatalf("failed to unmarshal game state: %v", err)
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Fatalf("failed to unmarshal %s payload: %v", msgType, err)
 	}
-	return state
 }
 
 // sendCommand sends a JSON command over the WebSocket.
 func sendCommand(t *testing.T, conn *websocket.Conn, msgType string, payload interface{}) {
+	t.Helper()
+	sendRequest(t, conn, msgType, "", payload)
+}
+
+// sendRequest is sendCommand with a reqId, asking the server for an ack.
+func sendRequest(t *testing.T, conn *websocket.Conn, msgType, reqID string, payload interface{}) {
 	t.Helper()
 	var raw json.RawMessage
 	if payload != nil {
@@ -125,7 +225,7 @@ func sendCommand(t *testing.T, conn *websocket.Conn, msgType string, payload int
 			t.Fatalf("failed to marshal payload: %v", err)
 		}
 	}
-	msg := session.ClientMessage{Type: msgType, Payload: raw}
+	msg := session.ClientMessage{Type: msgType, Payload: raw, ReqID: reqID}
 	data, err := json.Marshal(msg)
 	if err != nil {
 		t.Fatalf("failed to marshal command: %v", err)
@@ -157,7 +257,7 @@ func TestCreateSessionAndJoin(t *testing.T) {
 		ID: "token-1",
 		Token: game.TokenData{
 			Name:      "Goblin",
-			ImgPath:   "/goblin.jpg",
+			ImgPath:   "/assets/goblin.jpg",
 			X:         96,
 			Y:         96,
 			TokenSize: 96,
@@ -209,7 +309,7 @@ func TestBroadcastWithinSession(t *testing.T) {
 	// Client 0 sends an add_token command
 	sendCommand(t, conns[0], "add_token", game.AddTokenPayload{
 		ID:    "broadcast-token",
-		Token: game.TokenData{Name: "Orc", ImgPath: "/orc.jpg", X: 100, Y: 200, TokenSize: 96},
+		Token: game.TokenData{Name: "Orc", ImgPath: "/assets/orc.jpg", X: 100, Y: 200, TokenSize: 96},
 	})
 
 	// All clients should receive the state_update
@@ -243,7 +343,7 @@ func TestBroadcastIsolationBetweenSessions(t *testing.T) {
 	// Send a command in session 1
 	sendCommand(t, conn1, "add_token", game.AddTokenPayload{
 		ID:    "s1-token",
-		Token: game.TokenData{Name: "Elf", ImgPath: "/elf.jpg", X: 50, Y: 50, TokenSize: 96},
+		Token: game.TokenData{Name: "Elf", ImgPath: "/assets/elf.jpg", X: 50, Y: 50, TokenSize: 96},
 	})
 
 	// Client in session 1 should receive state_update
@@ -253,10 +353,8 @@ func TestBroadcastIsolationBetweenSessions(t *testing.T) {
 	}
 
 	// Client in session 2 should NOT receive anything
-	conn2.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-	_, _, err := conn2.ReadMessage()
-	if err == nil {
-		t.Error("session2 client should not have received a message from session1")
+	if msgType, ok := tryReadServerMessage(t, conn2, 500*time.Millisecond, nil); ok {
+		t.Errorf("session2 client should not have received a message from session1, got %s", msgType)
 	}
 }
 
@@ -270,7 +368,7 @@ func TestNewClientReceivesCurrentState(t *testing.T) {
 
 	sendCommand(t, conn1, "add_token", game.AddTokenPayload{
 		ID:    "existing-token",
-		Token: game.TokenData{Name: "Dragon", ImgPath: "/dragon.jpg", X: 200, Y: 300, TokenSize: 96},
+		Token: game.TokenData{Name: "Dragon", ImgPath: "/assets/dragon.jpg", X: 200, Y: 300, TokenSize: 96},
 	})
 	readStateUpdate(t, conn1, 2*time.Second) // drain broadcast
 
@@ -315,3 +413,1465 @@ func TestToggleGrid(t *testing.T) {
 		t.Error("expected showGrid to be true after second toggle")
 	}
 }
+
+func TestCapabilitiesCommand(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second) // drain initial state
+
+	sendCommand(t, conn, "capabilities", nil)
+
+	var caps session.Capabilities
+	if msgType := readServerMessage(t, conn, 2*time.Second, &caps); msgType != "capabilities" {
+		t.Fatalf("expected type capabilities, got %s", msgType)
+	}
+	found := false
+	for _, cmd := range caps.Commands {
+		if cmd == "add_token" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected add_token in commands, got %v", caps.Commands)
+	}
+	if caps.Version == "" {
+		t.Error("expected a protocol version")
+	}
+}
+
+func TestHiddenTokensFilteredForPlayers(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player := connectWS(t, addr, sessionId)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{
+		ID:    "ambush",
+		Token: game.TokenData{Name: "Ogre", ImgPath: "/assets/ogre.jpg", TokenSize: 96, Hidden: true},
+	})
+
+	gmState := readStateUpdate(t, gm, 2*time.Second)
+	if _, ok := gmState.DisplayedTokens["ambush"]; !ok {
+		t.Error("GM should see the hidden token")
+	}
+	playerState := readStateUpdate(t, player, 2*time.Second)
+	if _, ok := playerState.DisplayedTokens["ambush"]; ok {
+		t.Error("player should not see the hidden token")
+	}
+
+	sendCommand(t, gm, "set_token_hidden", game.SetTokenHiddenPayload{ID: "ambush", Hidden: false})
+
+	readStateUpdate(t, gm, 2*time.Second)
+	playerState = readStateUpdate(t, player, 2*time.Second)
+	if _, ok := playerState.DisplayedTokens["ambush"]; !ok {
+		t.Error("player should see the token once revealed")
+	}
+}
+
+func TestDeltaBroadcastsForOptedInClients(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	legacy := connectWS(t, addr, sessionId)
+	readStateUpdate(t, legacy, 2*time.Second)
+
+	deltaConn, _ := joinWS(t, addr, sessionId, "deltas=1")
+	readStateUpdate(t, deltaConn, 2*time.Second) // late-joiner sync is always a full state
+
+	sendCommand(t, legacy, "add_token", game.AddTokenPayload{
+		ID:    "t1",
+		Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg", TokenSize: 96},
+	})
+
+	state := readStateUpdate(t, legacy, 2*time.Second)
+	if len(state.DisplayedTokens) != 1 {
+		t.Errorf("legacy client: expected 1 token, got %d", len(state.DisplayedTokens))
+	}
+
+	var delta session.Delta
+	msgType := readServerMessage(t, deltaConn, 2*time.Second, &delta)
+	if msgType != "state_delta" || delta.Kind != session.DeltaToken || delta.ID != "t1" {
+		t.Errorf("unexpected %s %+v", msgType, delta)
+	}
+	if delta.Token == nil || delta.Token.Name != "Goblin" {
+		t.Errorf("expected Goblin in delta, got %+v", delta.Token)
+	}
+}
+
+func TestDiceResultBroadcastToSession(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn1 := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn1, 2*time.Second)
+	conn2 := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn2, 2*time.Second)
+
+	sendCommand(t, conn1, "roll_dice", game.RollDicePayload{Notation: "2d6+3", Label: "attack"})
+
+	for i, conn := range []*websocket.Conn{conn1, conn2} {
+		var result game.DiceResult
+		if msgType := readServerMessage(t, conn, 2*time.Second, &result); msgType != "dice_result" {
+			t.Fatalf("client %d: expected dice_result, got %s", i, msgType)
+		}
+		if result.Total < 5 || result.Total > 15 || len(result.Rolls) != 2 {
+			t.Errorf("client %d: unexpected result %+v", i, result)
+		}
+	}
+}
+
+func TestChatBroadcastIncludesSender(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	sender := connectWS(t, addr, sessionId)
+	readStateUpdate(t, sender, 2*time.Second)
+	other := connectWS(t, addr, sessionId)
+	readStateUpdate(t, other, 2*time.Second)
+
+	sendCommand(t, sender, "chat", session.ChatPayload{Text: "roll for initiative"})
+
+	for i, conn := range []*websocket.Conn{sender, other} {
+		var chat session.ChatMessage
+		if msgType := readServerMessage(t, conn, 2*time.Second, &chat); msgType != "chat_message" {
+			t.Fatalf("client %d: expected chat_message, got %s", i, msgType)
+		}
+		if chat.Text != "roll for initiative" || chat.ClientID == "" {
+			t.Errorf("client %d: unexpected chat %+v", i, chat)
+		}
+	}
+}
+
+func TestWhisperReachesOnlyTarget(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, gm, 2*time.Second)
+	target, targetWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, target, 2*time.Second)
+	bystander := connectWS(t, addr, sessionId)
+	readStateUpdate(t, bystander, 2*time.Second)
+
+	sendCommand(t, gm, "whisper", session.WhisperPayload{ToClientID: targetWelcome.ClientID, Text: "the innkeeper is lying"})
+
+	for name, conn := range map[string]*websocket.Conn{"target": target, "sender": gm} {
+		var chat session.ChatMessage
+		readMessageOfType(t, conn, 2*time.Second, "chat_message", &chat)
+		if !chat.Private || chat.Text != "the innkeeper is lying" || chat.ClientID != gmWelcome.ClientID || chat.ToClientID != targetWelcome.ClientID {
+			t.Errorf("%s: unexpected whisper %+v", name, chat)
+		}
+	}
+	if msgType, ok := tryReadServerMessage(t, bystander, 300*time.Millisecond, nil); ok {
+		t.Errorf("expected the bystander to see nothing, got %s", msgType)
+	}
+
+	sendCommand(t, gm, "whisper", session.WhisperPayload{ToClientID: "nobody", Text: "hello?"})
+	var errMsg session.ErrorMessage
+	readMessageOfType(t, gm, 2*time.Second, "error", &errMsg)
+	if errMsg.Command != "whisper" {
+		t.Errorf("expected an error for the whisper, got %+v", errMsg)
+	}
+}
+
+func TestPingBroadcastIsRateLimited(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	for i := 0; i < 8; i++ {
+		sendCommand(t, conn, "ping", session.PingPayload{X: float64(i), Y: 10, Color: "#ff0000"})
+	}
+
+	received := 0
+	for {
+		var ping session.PingMessage
+		msgType, ok := tryReadServerMessage(t, conn, 300*time.Millisecond, &ping)
+		if !ok {
+			break
+		}
+		if msgType != "ping" {
+			t.Fatalf("unexpected message %s", msgType)
+		}
+		if ping.ClientID == "" {
+			t.Error("ping should carry the sender's client ID")
+		}
+		received++
+	}
+
+	if received != 5 {
+		t.Errorf("expected 5 pings to get through the rate limit, got %d", received)
+	}
+}
+
+func TestClientsGetDistinctIDs(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	_, first := joinWS(t, addr, sessionId, "")
+	_, second := joinWS(t, addr, sessionId, "")
+
+	if first.ClientID == "" || second.ClientID == "" {
+		t.Fatalf("expected client IDs, got %q and %q", first.ClientID, second.ClientID)
+	}
+	if first.ClientID == second.ClientID {
+		t.Errorf("expected distinct client IDs, both got %q", first.ClientID)
+	}
+	if first.Role != session.RoleGM || second.Role != session.RolePlayer {
+		t.Errorf("expected gm then player, got %q and %q", first.Role, second.Role)
+	}
+}
+
+func TestPresenceOnJoinRenameAndLeave(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	var presence session.PresenceUpdate
+	readMessageOfType(t, gm, 2*time.Second, "presence_update", &presence)
+	if len(presence.Clients) != 1 {
+		t.Fatalf("expected 1 client after first join, got %+v", presence.Clients)
+	}
+
+	player, _ := joinWS(t, addr, sessionId, "")
+	readMessageOfType(t, gm, 2*time.Second, "presence_update", &presence)
+	if len(presence.Clients) != 2 {
+		t.Fatalf("expected 2 clients after second join, got %+v", presence.Clients)
+	}
+
+	sendCommand(t, gm, "set_name", session.SetNamePayload{Name: "  Dungeon Master  "})
+	readMessageOfType(t, player, 2*time.Second, "presence_update", &presence) // own join
+	readMessageOfType(t, player, 2*time.Second, "presence_update", &presence) // rename
+	renamed := false
+	for _, entry := range presence.Clients {
+		if entry.ClientID == gmWelcome.ClientID && entry.Name == "Dungeon Master" {
+			renamed = true
+		}
+	}
+	if !renamed {
+		t.Errorf("expected GM renamed in presence, got %+v", presence.Clients)
+	}
+
+	gm.Close()
+	readMessageOfType(t, player, 2*time.Second, "presence_update", &presence)
+	if len(presence.Clients) != 1 {
+		t.Errorf("expected 1 client after leave, got %+v", presence.Clients)
+	}
+}
+
+func TestProtectedCommandRejectedForPlayer(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player := connectWS(t, addr, sessionId)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, player, "change_background", game.ChangeBackgroundPayload{ImgPath: "/assets/forest.jpg"})
+
+	var errMsg session.ErrorMessage
+	if msgType := readServerMessage(t, player, 2*time.Second, &errMsg); msgType != "error" {
+		t.Fatalf("expected error reply, got %s", msgType)
+	}
+	if errMsg.Command != "change_background" {
+		t.Errorf("expected error for change_background, got %+v", errMsg)
+	}
+	// The rejected command must not have been broadcast, so the GM's next
+	// state_update is the one for its own command.
+	sendCommand(t, gm, "change_background", game.ChangeBackgroundPayload{ImgPath: "/assets/forest.jpg"})
+	state := readStateUpdate(t, gm, 2*time.Second)
+	if state.BackgroundImgPath != "/assets/forest.jpg" {
+		t.Errorf("GM change_background should apply, got %q", state.BackgroundImgPath)
+	}
+}
+
+func TestGMCanKickPlayer(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, gm, 2*time.Second)
+	player, playerWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, player, 2*time.Second)
+
+	// A player can't kick, and the GM can't kick themselves.
+	sendCommand(t, player, "kick", session.KickPayload{ClientID: gmWelcome.ClientID})
+	var errMsg session.ErrorMessage
+	readMessageOfType(t, player, 2*time.Second, "error", &errMsg)
+	sendCommand(t, gm, "kick", session.KickPayload{ClientID: gmWelcome.ClientID})
+
+	sendCommand(t, gm, "kick", session.KickPayload{ClientID: playerWelcome.ClientID})
+	readMessageOfType(t, player, 2*time.Second, "kicked", nil)
+
+	player.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := player.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	var presence session.PresenceUpdate
+	for len(presence.Clients) != 2 {
+		readMessageOfType(t, gm, 2*time.Second, "presence_update", &presence)
+	}
+	for len(presence.Clients) != 1 {
+		readMessageOfType(t, gm, 2*time.Second, "presence_update", &presence)
+	}
+	if presence.Clients[0].ClientID != gmWelcome.ClientID {
+		t.Errorf("expected only the GM to remain, got %+v", presence.Clients)
+	}
+
+	// A kicked player can't come straight back as themselves.
+	_, rejoined := joinWS(t, addr, sessionId, "reconnect="+playerWelcome.ReconnectToken)
+	if rejoined.ClientID == playerWelcome.ClientID {
+		t.Error("a kicked player should not reclaim their identity")
+	}
+}
+
+func TestSpectatorIsReadOnly(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	spectator, welcome := joinWS(t, addr, sessionId, "mode=spectator")
+	readStateUpdate(t, spectator, 2*time.Second)
+	if welcome.Role != session.RoleSpectator {
+		t.Fatalf("expected spectator role, got %q", welcome.Role)
+	}
+
+	// A spectator doesn't take the GM seat.
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, gm, 2*time.Second)
+	if gmWelcome.Role != session.RoleGM {
+		t.Fatalf("expected first non-spectator to be GM, got %q", gmWelcome.Role)
+	}
+
+	sendCommand(t, spectator, "add_token", game.AddTokenPayload{
+		ID:    "spy",
+		Token: game.TokenData{Name: "Spy", ImgPath: "/assets/spy.jpg"},
+	})
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{
+		ID:    "goblin",
+		Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg"},
+	})
+
+	// Spectators still receive broadcasts; the only change is the GM's.
+	state := readStateUpdate(t, spectator, 2*time.Second)
+	if _, ok := state.DisplayedTokens["spy"]; ok {
+		t.Error("spectator add_token should be ignored")
+	}
+	if _, ok := state.DisplayedTokens["goblin"]; !ok {
+		t.Error("expected spectator to receive the GM's change")
+	}
+
+	// They can still ask for a fresh copy of the state.
+	sendRequest(t, spectator, "resync", "r1", nil)
+	var ack session.Ack
+	readMessageOfType(t, spectator, 2*time.Second, "ack", &ack)
+	if !ack.OK {
+		t.Errorf("expected a spectator resync to succeed, got %+v", ack)
+	}
+
+	// Events reach the whole table, so only renaming themselves is allowed.
+	for i, event := range []struct {
+		msgType string
+		payload interface{}
+		ok      bool
+	}{
+		{"chat", session.ChatPayload{Text: "psst"}, false},
+		{"roll_dice", game.RollDicePayload{Notation: "1d20"}, false},
+		{"measure", session.MeasurePayload{X2: 96}, false},
+		{"ping", session.PingPayload{X: 10, Y: 10}, false},
+		{"set_name", session.SetNamePayload{Name: "Watcher"}, true},
+	} {
+		reqID := fmt.Sprintf("e%d", i)
+		sendRequest(t, spectator, event.msgType, reqID, event.payload)
+		readMessageOfType(t, spectator, 2*time.Second, "ack", &ack)
+		if ack.ReqID != reqID || ack.OK != event.ok {
+			t.Errorf("%s: expected ok=%v, got %+v", event.msgType, event.ok, ack)
+		}
+	}
+}
+
+func TestHeartbeatDropsUnresponsiveClients(t *testing.T) {
+	cfg := config.Default()
+	cfg.HeartbeatSec = 1
+	addr := startTestServerWithConfig(t, cfg)
+	sessionId := createTestSession(t, addr)
+
+	// The watcher keeps reading, so it answers pings; the silent client never
+	// reads and so never sends a pong.
+	watcher := connectWS(t, addr, sessionId)
+	readStateUpdate(t, watcher, 2*time.Second)
+	connectWS(t, addr, sessionId)
+
+	var presence session.PresenceUpdate
+	for len(presence.Clients) != 2 {
+		readMessageOfType(t, watcher, 2*time.Second, "presence_update", &presence)
+	}
+	for len(presence.Clients) != 1 {
+		readMessageOfType(t, watcher, 5*time.Second, "presence_update", &presence)
+	}
+}
+
+func TestIdleSessionsAreClosed(t *testing.T) {
+	cfg := config.Default()
+	cfg.IdleTimeoutSec = 1
+	addr := startTestServerWithConfig(t, cfg)
+	stop := make(chan struct{})
+	defer close(stop)
+	sessionManager.StartSweeper(stop)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+				t.Fatalf("expected the server to close the idle session, got %v", err)
+			}
+			break
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/session/%s", addr, sessionId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected idle session to be deleted, got status %d", resp.StatusCode)
+	}
+}
+
+func TestExpiredSessionsAreClosed(t *testing.T) {
+	cfg := config.Default()
+	cfg.IdleTimeoutSec = 0
+	cfg.SessionTTLSec = 1
+	addr := startTestServerWithConfig(t, cfg)
+	stop := make(chan struct{})
+	defer close(stop)
+	sessionManager.StartSweeper(stop)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readMessageOfType(t, conn, 5*time.Second, "session_expired", nil)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/session/%s", addr, sessionId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected expired session to be deleted, got status %d", resp.StatusCode)
+	}
+}
+
+func TestCommandsAreRateLimited(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxCommandsPerSec = 3
+	addr := startTestServerWithConfig(t, cfg)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	for i := 0; i < 6; i++ {
+		sendCommand(t, conn, "add_token", game.AddTokenPayload{
+			ID:    fmt.Sprintf("t%d", i),
+			Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg"},
+		})
+	}
+
+	var last game.State
+	received := 0
+	for {
+		var state game.State
+		if _, ok := tryReadServerMessage(t, conn, 300*time.Millisecond, &state); !ok {
+			break
+		}
+		last = state
+		received++
+	}
+
+	if received != 3 || len(last.DisplayedTokens) != 3 {
+		t.Errorf("expected 3 commands to get through, got %d updates and %d tokens", received, len(last.DisplayedTokens))
+	}
+}
+
+func TestQueriesAreRateLimited(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxCommandsPerSec = 3
+	addr := startTestServerWithConfig(t, cfg)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	for i := 0; i < 6; i++ {
+		sendRequest(t, conn, "capabilities", fmt.Sprintf("q%d", i), nil)
+	}
+
+	answered := 0
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for {
+		msgType, _, ok := readRaw(t, conn, deadline)
+		if !ok {
+			break
+		}
+		if msgType == "ack" {
+			answered++
+		}
+	}
+
+	if answered != 3 {
+		t.Errorf("expected 3 queries to get through, got %d", answered)
+	}
+}
+
+func TestMoveTokensBroadcastsOnce(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	for _, id := range []string{"t1", "t2"} {
+		sendCommand(t, conn, "add_token", game.AddTokenPayload{
+			ID:    id,
+			Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg"},
+		})
+		readStateUpdate(t, conn, 2*time.Second)
+	}
+
+	sendCommand(t, conn, "move_tokens", game.MoveTokensPayload{Moves: []game.MoveTokenPayload{
+		{ID: "t1", X: 100, Y: 100},
+		{ID: "t2", X: 200, Y: 100},
+	}})
+
+	state := readStateUpdate(t, conn, 2*time.Second)
+	if state.DisplayedTokens["t1"].X != 100 || state.DisplayedTokens["t2"].X != 200 {
+		t.Errorf("expected both tokens moved, got %+v", state.DisplayedTokens)
+	}
+	if msgType, ok := tryReadServerMessage(t, conn, 300*time.Millisecond, nil); ok {
+		t.Errorf("expected a single broadcast, also got %s", msgType)
+	}
+}
+
+func TestExportImportAcceptGMToken(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, gm, 2*time.Second)
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "ambush", Token: game.TokenData{Name: "Ogre", Hidden: true}})
+	readStateUpdate(t, gm, 2*time.Second)
+	player, playerWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, player, 2*time.Second)
+
+	export := func(bearer string) (int, game.State) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/session/%s/export", addr, sessionId), nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var state game.State
+		json.NewDecoder(resp.Body).Decode(&state)
+		return resp.StatusCode, state
+	}
+
+	if status, _ := export(playerWelcome.ReconnectToken); status != http.StatusForbidden {
+		t.Errorf("expected players to be refused an export, got %d", status)
+	}
+	status, state := export(gmWelcome.ReconnectToken)
+	if status != http.StatusOK {
+		t.Fatalf("expected the GM to export without an admin token, got %d", status)
+	}
+	if _, ok := state.DisplayedTokens["ambush"]; !ok {
+		t.Error("expected the export to include hidden tokens")
+	}
+
+	// The GM can load the export straight back in.
+	body, _ := json.Marshal(state)
+	importState := func(bearer string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/session/%s/import", addr, sessionId), bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := importState(playerWelcome.ReconnectToken); status != http.StatusForbidden {
+		t.Errorf("expected players to be refused an import, got %d", status)
+	}
+	if status := importState(gmWelcome.ReconnectToken); status != http.StatusOK {
+		t.Errorf("expected the GM to import their export, got %d", status)
+	}
+}
+
+func TestImportReplacesStateAndBroadcasts(t *testing.T) {
+	cfg := config.Default()
+	cfg.AdminToken = "secret"
+	addr := startTestServerWithConfig(t, cfg)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	importState := func(body string) *http.Response {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/session/%s/import", addr, sessionId), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	encounter := game.NewState()
+	encounter.AddToken("dragon", game.TokenData{Name: "Dragon", ImgPath: "/assets/dragon.jpg", TokenSize: 192})
+	encounter.BackgroundImgPath = "/assets/lair.jpg"
+	body, _ := json.Marshal(encounter)
+
+	if resp := importState(string(body)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	state := readStateUpdate(t, conn, 2*time.Second)
+	if _, ok := state.DisplayedTokens["dragon"]; !ok || state.BackgroundImgPath != "/assets/lair.jpg" {
+		t.Errorf("expected the imported state to be broadcast, got %+v", state)
+	}
+
+	if resp := importState(`{"gridUnit": 96}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid state, got %d", resp.StatusCode)
+	}
+}
+
+func TestShutdownDisconnectsClients(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	sessionManager.Shutdown()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expected a going-away close, got %v", err)
+		}
+		break
+	}
+}
+
+func TestServesAssets(t *testing.T) {
+	cfg := config.Default()
+	cfg.AssetsDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cfg.AssetsDir, "maps"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.AssetsDir, "maps", "tavern.jpg"), []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServerWithConfig(t, cfg)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/assets/maps/tavern.jpg", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "jpeg" {
+		t.Errorf("expected the asset, got %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/assets/maps/missing.jpg", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing asset, got %d", resp.StatusCode)
+	}
+}
+
+func TestReconnectPreservesGMRole(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, gm, 2*time.Second)
+	sendCommand(t, gm, "set_name", session.SetNamePayload{Name: "Dungeon Master"})
+	if gmWelcome.Role != session.RoleGM || gmWelcome.ReconnectToken == "" {
+		t.Fatalf("expected a GM welcome with a reconnection token, got %+v", gmWelcome)
+	}
+
+	player, playerWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, player, 2*time.Second)
+	gm.Close()
+
+	// Wait until the server has seen the GM leave.
+	var presence session.PresenceUpdate
+	for len(presence.Clients) != 1 {
+		readMessageOfType(t, player, 2*time.Second, "presence_update", &presence)
+	}
+
+	// The GM's seat is held for them, so a newcomer joins as a player.
+	_, other := joinWS(t, addr, sessionId, "")
+	if other.Role != session.RolePlayer {
+		t.Errorf("expected the GM seat to be reserved, got role %q", other.Role)
+	}
+
+	// Someone else's token can't be guessed from their client ID.
+	_, forged := joinWS(t, addr, sessionId, "reconnect="+playerWelcome.ClientID)
+	if forged.ClientID == playerWelcome.ClientID {
+		t.Error("a forged token should not take over another client's identity")
+	}
+
+	rejoined, welcome := joinWS(t, addr, sessionId, "reconnect="+gmWelcome.ReconnectToken)
+	readStateUpdate(t, rejoined, 2*time.Second)
+	if welcome.ClientID != gmWelcome.ClientID || welcome.Role != session.RoleGM {
+		t.Errorf("expected to rejoin as GM %s, got %+v", gmWelcome.ClientID, welcome)
+	}
+	readMessageOfType(t, rejoined, 2*time.Second, "presence_update", &presence)
+	for _, entry := range presence.Clients {
+		if entry.ClientID == gmWelcome.ClientID && entry.Name != "Dungeon Master" {
+			t.Errorf("expected the GM's name to be restored, got %q", entry.Name)
+		}
+	}
+}
+
+func TestPresenceListsRoles(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, gm, 2*time.Second)
+	_, playerWelcome := joinWS(t, addr, sessionId, "")
+	_, spectatorWelcome := joinWS(t, addr, sessionId, "mode=spectator")
+
+	var presence session.PresenceUpdate
+	for len(presence.Clients) != 3 {
+		readMessageOfType(t, gm, 2*time.Second, "presence_update", &presence)
+	}
+	want := map[string]session.PresenceEntry{
+		gmWelcome.ClientID:        {Role: session.RoleGM},
+		playerWelcome.ClientID:    {Role: session.RolePlayer},
+		spectatorWelcome.ClientID: {Role: session.RoleSpectator, Spectator: true},
+	}
+	for _, entry := range presence.Clients {
+		w, ok := want[entry.ClientID]
+		if !ok || entry.Role != w.Role || entry.Spectator != w.Spectator {
+			t.Errorf("unexpected roster entry %+v", entry)
+		}
+	}
+}
+
+func TestJoinAndLeaveFeed(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	watcher := connectWS(t, addr, sessionId)
+	readStateUpdate(t, watcher, 2*time.Second)
+
+	visitor, welcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, visitor, 2*time.Second)
+
+	var joined session.PresenceEntry
+	readMessageOfType(t, watcher, 2*time.Second, "client_joined", &joined)
+	if joined.ClientID != welcome.ClientID || joined.Name == "" {
+		t.Errorf("unexpected client_joined %+v", joined)
+	}
+
+	// The joiner isn't told about its own arrival.
+	if msgType, ok := tryReadServerMessage(t, visitor, 300*time.Millisecond, nil); ok {
+		t.Errorf("expected nothing for the joiner, got %s", msgType)
+	}
+
+	visitor.Close()
+
+	var left session.PresenceEntry
+	readMessageOfType(t, watcher, 2*time.Second, "client_left", &left)
+	if left.ClientID != welcome.ClientID {
+		t.Errorf("unexpected client_left %+v", left)
+	}
+	// Exactly one leave event per client.
+	for {
+		msgType, _, ok := readRaw(t, watcher, time.Now().Add(300*time.Millisecond))
+		if !ok {
+			break
+		}
+		if msgType == "client_left" {
+			t.Error("got a second client_left")
+		}
+	}
+}
+
+func TestCommandsWithReqIDAreAcked(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	sendRequest(t, conn, "add_token", "req-1", game.AddTokenPayload{
+		ID:    "t1",
+		Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg"},
+	})
+	var ack session.Ack
+	readMessageOfType(t, conn, 2*time.Second, "ack", &ack)
+	if ack.ReqID != "req-1" || !ack.OK {
+		t.Errorf("expected a successful ack for req-1, got %+v", ack)
+	}
+
+	sendRequest(t, conn, "move_token", "req-2", game.MoveTokenPayload{ID: "missing", X: 10, Y: 10})
+	readMessageOfType(t, conn, 2*time.Second, "ack", &ack)
+	if ack.ReqID != "req-2" || ack.OK || ack.Error == "" {
+		t.Errorf("expected a failed ack for moving an unknown token, got %+v", ack)
+	}
+
+	// Queries and events are acked too.
+	sendRequest(t, conn, "token_distance", "req-3", game.TokenDistancePayload{IDA: "t1", IDB: "missing"})
+	readMessageOfType(t, conn, 2*time.Second, "ack", &ack)
+	if ack.ReqID != "req-3" || ack.OK {
+		t.Errorf("expected a failed ack for measuring to an unknown token, got %+v", ack)
+	}
+	sendRequest(t, conn, "roll_dice", "req-4", game.RollDicePayload{Notation: "1d20"})
+	readMessageOfType(t, conn, 2*time.Second, "ack", &ack)
+	if ack.ReqID != "req-4" || !ack.OK {
+		t.Errorf("expected a successful ack for a roll, got %+v", ack)
+	}
+
+	// Without a reqId there is no ack, just the broadcast.
+	sendCommand(t, conn, "toggle_grid", nil)
+	readStateUpdate(t, conn, 2*time.Second)
+	if msgType, ok := tryReadServerMessage(t, conn, 300*time.Millisecond, nil); ok {
+		t.Errorf("expected no ack, got %s", msgType)
+	}
+}
+
+func TestInvalidCommandsGetErrorReplies(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	for _, tc := range []struct {
+		msgType string
+		payload interface{}
+	}{
+		{"add_token", json.RawMessage(`{"id": 42}`)},
+		{"add_token", game.AddTokenPayload{Token: game.TokenData{Name: "Goblin"}}},
+		{"add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin", MaxHP: -1}}},
+		{"summon_dragon", nil},
+		{"token_distance", game.TokenDistancePayload{IDA: "a", IDB: "b"}},
+		{"roll_dice", game.RollDicePayload{Notation: "banana"}},
+	} {
+		sendCommand(t, conn, tc.msgType, tc.payload)
+		var errMsg session.ErrorMessage
+		readMessageOfType(t, conn, 2*time.Second, "error", &errMsg)
+		if errMsg.Command != tc.msgType || errMsg.Message == "" {
+			t.Errorf("expected a descriptive error for %s, got %+v", tc.msgType, errMsg)
+		}
+	}
+}
+
+func TestSessionMetadata(t *testing.T) {
+	addr := startTestServer(t)
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/session", addr), "application/json",
+		strings.NewReader(`{"name": "  Friday Night Dungeon  ", "system": "5e"}`))
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	sessionId := created["sessionId"]
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/session/%s", addr, sessionId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if got["name"] != "Friday Night Dungeon" || got["system"] != "5e" {
+		t.Errorf("expected trimmed metadata, got %v", got)
+	}
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player := connectWS(t, addr, sessionId)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, player, "rename_session", session.SessionMeta{Name: "Hijacked"})
+	readMessageOfType(t, player, 2*time.Second, "error", nil)
+
+	sendCommand(t, gm, "rename_session", session.SessionMeta{Name: "Saturday Dungeon", System: "5e"})
+	var meta session.SessionMeta
+	readMessageOfType(t, player, 2*time.Second, "session_meta", &meta)
+	if meta.Name != "Saturday Dungeon" || meta.System != "5e" {
+		t.Errorf("unexpected session_meta %+v", meta)
+	}
+}
+
+func TestCompressedStateUpdates(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn, _ := joinWS(t, addr, sessionId, "compress=gzip")
+
+	readGzipState := func() game.State {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		// Presence updates and the like stay uncompressed text.
+		msgType, data, err := conn.ReadMessage()
+		for err == nil && msgType == websocket.TextMessage {
+			msgType, data, err = conn.ReadMessage()
+		}
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if msgType != websocket.BinaryMessage || len(data) == 0 || data[0] != 1 {
+			t.Fatalf("expected a gzip-prefixed binary frame, got type %d", msgType)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg struct {
+			Type    string     `json:"type"`
+			Payload game.State `json:"payload"`
+		}
+		if err := json.NewDecoder(zr).Decode(&msg); err != nil || msg.Type != "state_update" {
+			t.Fatalf("expected a state_update, got %q (%v)", msg.Type, err)
+		}
+		return msg.Payload
+	}
+
+	readGzipState()
+	sendCommand(t, conn, "toggle_grid", nil)
+	if state := readGzipState(); state.ShowGrid {
+		t.Error("expected the broadcast state to have the grid toggled off")
+	}
+}
+
+func TestMsgpackFormat(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws/%s?format=msgpack", addr, sessionId), nil)
+	if err != nil {
+		t.Fatalf("failed to connect to ws: %v", err)
+	}
+	defer conn.Close()
+
+	readMsgpack := func(want string) map[string]interface{} {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read failed waiting for %s: %v", want, err)
+			}
+			if msgType != websocket.BinaryMessage {
+				t.Fatalf("expected only binary frames, got type %d", msgType)
+			}
+			var msg map[string]interface{}
+			if err := msgpack.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg["type"] == want {
+				payload, _ := msg["payload"].(map[string]interface{})
+				return payload
+			}
+		}
+	}
+
+	readMsgpack("welcome")
+	readMsgpack("state_update")
+
+	data, _ := msgpack.Marshal(map[string]interface{}{
+		"type":    "add_token",
+		"payload": map[string]interface{}{"id": "t1", "token": map[string]interface{}{"name": "Goblin"}},
+	})
+	conn.WriteMessage(websocket.BinaryMessage, data)
+
+	state := readMsgpack("state_update")
+	tokens, _ := state["displayedTokens"].(map[string]interface{})
+	if _, ok := tokens["t1"]; !ok {
+		t.Errorf("expected the msgpack command to add t1, got %v", state["displayedTokens"])
+	}
+}
+
+func TestPauseFreezesPlayers(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player := connectWS(t, addr, sessionId)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, gm, "pause", nil)
+	var paused session.PausedMessage
+	readMessageOfType(t, player, 2*time.Second, "session_paused", &paused)
+	if !paused.Paused {
+		t.Fatal("expected the session to be paused")
+	}
+
+	drawing := game.AddDrawingPayload{Drawing: game.Drawing{ID: "d1", Points: []game.Point{{X: 1, Y: 2}}}}
+	sendCommand(t, player, "add_drawing", drawing)
+	var errMsg session.ErrorMessage
+	readMessageOfType(t, player, 2*time.Second, "error", &errMsg)
+	if !strings.Contains(errMsg.Message, "session paused") {
+		t.Errorf("expected a session paused error, got %+v", errMsg)
+	}
+
+	sendCommand(t, gm, "toggle_grid", nil)
+	if state := readStateUpdate(t, player, 2*time.Second); state.ShowGrid {
+		t.Error("expected the GM's command to apply while paused")
+	}
+
+	sendCommand(t, gm, "resume", nil)
+	readMessageOfType(t, player, 2*time.Second, "session_paused", &paused)
+	if paused.Paused {
+		t.Fatal("expected the session to be resumed")
+	}
+	sendCommand(t, player, "add_drawing", drawing)
+	if state := readStateUpdate(t, player, 2*time.Second); len(state.Drawings) != 1 {
+		t.Error("expected the player's command to apply after resuming")
+	}
+}
+
+func TestGMCanStopPlayersAddingTokens(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player := connectWS(t, addr, sessionId)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, player, "allow_player_tokens", session.PlayersCanAddTokensPayload{Allowed: false})
+	var errMsg session.ErrorMessage
+	readMessageOfType(t, player, 2*time.Second, "error", &errMsg)
+
+	sendCommand(t, gm, "allow_player_tokens", session.PlayersCanAddTokensPayload{Allowed: false})
+	var allowed session.PlayersCanAddTokensPayload
+	readMessageOfType(t, player, 2*time.Second, "players_can_add_tokens", &allowed)
+	if allowed.Allowed {
+		t.Fatal("expected adding tokens to be turned off")
+	}
+
+	sendCommand(t, player, "add_token", game.AddTokenPayload{ID: "wolf", Token: game.TokenData{Name: "Wolf"}})
+	readMessageOfType(t, player, 2*time.Second, "error", &errMsg)
+	if errMsg.Command != "add_token" {
+		t.Errorf("expected the player's add_token to be refused, got %+v", errMsg)
+	}
+
+	// Someone joining now is told straight away.
+	late := connectWS(t, addr, sessionId)
+	readMessageOfType(t, late, 2*time.Second, "players_can_add_tokens", &allowed)
+
+	sendCommand(t, gm, "allow_player_tokens", session.PlayersCanAddTokensPayload{Allowed: true})
+	readMessageOfType(t, player, 2*time.Second, "players_can_add_tokens", &allowed)
+	sendCommand(t, player, "add_token", game.AddTokenPayload{ID: "wolf", Token: game.TokenData{Name: "Wolf"}})
+	if state := readStateUpdate(t, player, 2*time.Second); state.DisplayedTokens["wolf"].Name != "Wolf" {
+		t.Error("expected the player's add_token to apply once allowed again")
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm, gmWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, gm, 2*time.Second)
+	player, playerWelcome := joinWS(t, addr, sessionId, "")
+	readStateUpdate(t, player, 2*time.Second)
+
+	createLink := func(bearer string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/session/%s/sharelink", addr, sessionId), nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body["token"]
+	}
+
+	if status, _ := createLink(playerWelcome.ReconnectToken); status != http.StatusForbidden {
+		t.Errorf("expected players to be refused a share link, got %d", status)
+	}
+	status, token := createLink(gmWelcome.ReconnectToken)
+	if status != http.StatusCreated || token == "" {
+		t.Fatalf("expected a share token for the GM, got %d %q", status, token)
+	}
+
+	// The share link wins over a request for another role.
+	viewer, welcome := joinWS(t, addr, sessionId, "share="+token+"&reconnect="+gmWelcome.ReconnectToken)
+	if welcome.Role != session.RoleSpectator {
+		t.Errorf("expected a spectator, got %s", welcome.Role)
+	}
+	readStateUpdate(t, viewer, 2*time.Second)
+
+	sendCommand(t, gm, "revoke_sharelink", session.RevokeShareLinkPayload{Token: token})
+	viewer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := viewer.ReadMessage(); err != nil {
+			if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				break
+			}
+			t.Fatalf("expected the viewer to be disconnected, got %v", err)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws/%s?share=%s", addr, sessionId, token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expected a revoked share link to be refused")
+	}
+
+	// Nor can the viewer slip back in with their reconnection token.
+	_, rejoined := joinWS(t, addr, sessionId, "reconnect="+welcome.ReconnectToken)
+	if rejoined.ClientID == welcome.ClientID {
+		t.Error("a revoked spectator should not reclaim their identity")
+	}
+}
+
+func TestOverlappingMoveIsRejected(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	conn := connectWS(t, addr, sessionId)
+	readStateUpdate(t, conn, 2*time.Second)
+
+	sendCommand(t, conn, "add_token", game.AddTokenPayload{ID: "a", Token: game.TokenData{Name: "Fighter", X: 0, Y: 0}})
+	sendCommand(t, conn, "add_token", game.AddTokenPayload{ID: "b", Token: game.TokenData{Name: "Rogue", X: 96, Y: 0}})
+	sendCommand(t, conn, "set_prevent_overlap", game.SetPreventOverlapPayload{Enabled: true})
+	sendCommand(t, conn, "move_token", game.MoveTokenPayload{ID: "a", X: 96, Y: 0})
+
+	var rejected session.MoveRejected
+	readMessageOfType(t, conn, 2*time.Second, "move_rejected", &rejected)
+	if rejected.ID != "a" || rejected.X != 0 || rejected.Y != 0 {
+		t.Errorf("expected a to be sent back to (0,0), got %+v", rejected)
+	}
+}
+
+func TestMaskedTokenNames(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player := connectWS(t, addr, sessionId)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "dragon", Token: game.TokenData{Name: "Ancient Red Dragon"}})
+	readStateUpdate(t, player, 2*time.Second)
+	readStateUpdate(t, gm, 2*time.Second)
+
+	sendCommand(t, player, "set_token_name_visibility", game.SetTokenNameVisibilityPayload{ID: "dragon"})
+	readMessageOfType(t, player, 2*time.Second, "error", nil)
+
+	sendCommand(t, gm, "set_token_name_visibility", game.SetTokenNameVisibilityPayload{ID: "dragon", Visible: false})
+	if got := readStateUpdate(t, gm, 2*time.Second).DisplayedTokens["dragon"].Name; got != "Ancient Red Dragon" {
+		t.Errorf("expected the GM to see the real name, got %q", got)
+	}
+	if got := readStateUpdate(t, player, 2*time.Second).DisplayedTokens["dragon"].Name; got != game.MaskedTokenName {
+		t.Errorf("expected the player to see a masked name, got %q", got)
+	}
+}
+
+func TestWebSocketOriginCheck(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowedOrigins = []string{"https://table.example"}
+	addr := startTestServerWithConfig(t, cfg)
+	sessionId := createTestSession(t, addr)
+	url := fmt.Sprintf("ws://%s/ws/%s", addr, sessionId)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil {
+		t.Fatal("expected the handshake from a disallowed origin to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %v", resp)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://table.example"}})
+	if err != nil {
+		t.Fatalf("expected an allowed origin to connect: %v", err)
+	}
+	defer conn.Close()
+	readMessageOfType(t, conn, 2*time.Second, "welcome", nil)
+
+	// A reloaded origin list applies to the next handshake.
+	cfg.AllowedOrigins = []string{"https://evil.example"}
+	sessionManager.UpdateConfig(cfg)
+	if _, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://table.example"}}); err == nil {
+		t.Error("expected the reloaded origin list to refuse the old origin")
+	}
+}
+
+// readHashed reads up to the next message of msgType, decodes its payload
+// into v and returns the state hash it carried.
+func readHashed(t *testing.T, conn *websocket.Conn, timeout time.Duration, msgType string, v interface{}) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no %s message before timeout: %v", msgType, err)
+		}
+		var msg struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+			Hash    string          `json:"hash"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("failed to unmarshal server message: %v", err)
+		}
+		if msg.Type == msgType {
+			decodePayload(t, msgType, msg.Payload, v)
+			return msg.Hash
+		}
+	}
+}
+
+func TestStateMessagesCarryHash(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player, _ := joinWS(t, addr, sessionId, "deltas=1")
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin"}})
+
+	var state game.State
+	hash := readHashed(t, gm, 2*time.Second, "state_update", &state)
+	if hash == "" || hash != state.Hash() {
+		t.Errorf("expected the state_update hash to match its payload, got %q want %q", hash, state.Hash())
+	}
+
+	if got := readHashed(t, player, 2*time.Second, "state_delta", nil); got != state.PlayerView().Hash() {
+		t.Errorf("expected the delta to carry the player view's hash, got %q want %q", got, state.PlayerView().Hash())
+	}
+}
+
+func TestResyncSendsStateToSenderOnly(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	player := connectWS(t, addr, sessionId)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin"}})
+	readStateUpdate(t, gm, 2*time.Second)
+	readStateUpdate(t, player, 2*time.Second)
+
+	sendRequest(t, player, "resync", "r1", nil)
+	state := readStateUpdate(t, player, 2*time.Second)
+	if _, ok := state.DisplayedTokens["t1"]; !ok {
+		t.Errorf("expected the resync to carry the current state, got %+v", state.DisplayedTokens)
+	}
+	var ack session.Ack
+	readMessageOfType(t, player, 2*time.Second, "ack", &ack)
+	if !ack.OK || ack.ReqID != "r1" {
+		t.Errorf("expected a successful ack, got %+v", ack)
+	}
+
+	if msgType, ok := tryReadServerMessage(t, gm, 300*time.Millisecond, nil); ok {
+		t.Errorf("expected nothing to be sent to the GM, got %s", msgType)
+	}
+}
+
+func TestCoalescedBroadcasts(t *testing.T) {
+	cfg := config.Default()
+	cfg.BroadcastCoalesceMs = 200
+	addr := startTestServerWithConfig(t, cfg)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin"}})
+	for x := 1; x <= 5; x++ {
+		sendCommand(t, gm, "move_token", game.MoveTokenPayload{ID: "t1", X: float64(x * 96)})
+	}
+
+	state := readStateUpdate(t, gm, 2*time.Second)
+	if got := state.DisplayedTokens["t1"].X; got != 480 {
+		t.Errorf("expected a single update with the last position, got x=%v", got)
+	}
+	if msgType, ok := tryReadServerMessage(t, gm, 400*time.Millisecond, nil); ok {
+		t.Errorf("expected the burst to be coalesced, got another %s", msgType)
+	}
+
+	// A late joiner is still synced straight away.
+	late, _ := joinWS(t, addr, sessionId, "")
+	if got := readStateUpdate(t, late, 100*time.Millisecond).DisplayedTokens["t1"].X; got != 480 {
+		t.Errorf("expected the late joiner to see x=480, got %v", got)
+	}
+}
+
+// TestParallelSessions drives many sessions at once while their metadata is
+// read over HTTP. Run it with -race to check the locking.
+func TestParallelSessions(t *testing.T) {
+	const sessions, moves = 8, 20
+
+	cfg := config.Default()
+	cfg.MaxSessions = sessions
+	cfg.MaxCommandsPerSec = 0
+	addr := startTestServerWithConfig(t, cfg)
+
+	conns := make([]*websocket.Conn, sessions)
+	ids := make([]string, sessions)
+	for i := range conns {
+		ids[i] = createTestSession(t, addr)
+		conns[i] = connectWS(t, addr, ids[i])
+		readStateUpdate(t, conns[i], 2*time.Second)
+	}
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			type command struct {
+				Type    string      `json:"type"`
+				Payload interface{} `json:"payload"`
+			}
+			commands := []command{{"add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin"}}}}
+			for x := 1; x <= moves; x++ {
+				commands = append(commands, command{"move_token", game.MoveTokenPayload{ID: "t1", X: float64(x)}})
+			}
+			for _, cmd := range commands {
+				if err := conn.WriteJSON(cmd); err != nil {
+					t.Errorf("session %d: %v", i, err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range moves {
+				resp, err := http.Get(fmt.Sprintf("http://%s/session/%s", addr, ids[i]))
+				if err != nil {
+					t.Errorf("session %d: %v", i, err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if state := readStateUpdate(t, conn, time.Until(deadline)); state.DisplayedTokens["t1"].X == moves {
+				break
+			}
+		}
+	}
+}
+
+func TestSessionAssetsManifest(t *testing.T) {
+	addr := startTestServer(t)
+	sessionId := createTestSession(t, addr)
+
+	gm := connectWS(t, addr, sessionId)
+	readStateUpdate(t, gm, 2*time.Second)
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "a", Token: game.TokenData{ImgPath: "/assets/default/tokens/goblin.png"}})
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "b", Token: game.TokenData{ImgPath: "/assets/default/tokens/goblin.png", X: 96}})
+	sendCommand(t, gm, "add_token", game.AddTokenPayload{ID: "c", Token: game.TokenData{ImgPath: "/assets/default/tokens/dragon.png", X: 192}})
+	sendCommand(t, gm, "set_token_hidden", game.SetTokenHiddenPayload{ID: "c", Hidden: true})
+	for range 4 {
+		readStateUpdate(t, gm, 2*time.Second)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/session/%s/assets", addr, sessionId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Images []string `json:"images"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{game.DefaultBackground, "/assets/default/tokens/goblin.png"}
+	if !slices.Equal(body.Images, want) {
+		t.Errorf("expected %v, got %v", want, body.Images)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/session/missing/assets", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown session, got %d", resp.StatusCode)
+	}
+}
+
+func TestReadyWithoutStore(t *testing.T) {
+	addr := startTestServer(t)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/ready", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Status != "ok" {
+		t.Errorf("expected ready with no store configured, got %d %+v", resp.StatusCode, body)
+	}
+}
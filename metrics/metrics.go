@@ -0,0 +1,116 @@
+// Package metrics provides a small in-process registry of latency
+// histograms, exposed as JSON by the HTTP server.
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the histogram upper bounds used for command latencies.
+var DefaultBuckets = []time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+}
+
+// Histogram counts observed durations into fixed buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []time.Duration
+	counts  []uint64 // counts[i] is observations <= buckets[i]; the last slot is +Inf
+	count   uint64
+	sum     time.Duration
+}
+
+func newHistogram(buckets []time.Duration) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.buckets), func(i int) bool { return d <= h.buckets[i] })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// Bucket is a cumulative count of observations at or below LeSeconds.
+// The final bucket has LeSeconds of -1 and stands for +Inf.
+type Bucket struct {
+	LeSeconds float64 `json:"le"`
+	Count     uint64  `json:"count"`
+}
+
+type HistogramSnapshot struct {
+	Count      uint64   `json:"count"`
+	SumSeconds float64  `json:"sum"`
+	Buckets    []Bucket `json:"buckets"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snap := HistogramSnapshot{
+		Count:      h.count,
+		SumSeconds: h.sum.Seconds(),
+		Buckets:    make([]Bucket, len(h.counts)),
+	}
+	var cumulative uint64
+	for i, n := range h.counts {
+		cumulative += n
+		le := -1.0
+		if i < len(h.buckets) {
+			le = h.buckets[i].Seconds()
+		}
+		snap.Buckets[i] = Bucket{LeSeconds: le, Count: cumulative}
+	}
+	return snap
+}
+
+// Registry holds named histograms, created on first use.
+type Registry struct {
+	mu         sync.Mutex
+	histograms map[string]*Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{histograms: make(map[string]*Histogram)}
+}
+
+// Histogram returns the histogram registered under name, creating it with
+// DefaultBuckets if needed.
+func (r *Registry) Histogram(name string) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.histograms[name]
+	if !ok {
+		h = newHistogram(DefaultBuckets)
+		r.histograms[name] = h
+	}
+	return h
+}
+
+func (r *Registry) Snapshot() map[string]HistogramSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snap := make(map[string]HistogramSnapshot, len(r.histograms))
+	for name, h := range r.histograms {
+		snap[name] = h.Snapshot()
+	}
+	return snap
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("cmd")
+
+	h.Observe(80 * time.Microsecond)
+	h.Observe(2 * time.Millisecond)
+	h.Observe(time.Second)
+
+	snap := r.Snapshot()["cmd"]
+	if snap.Count != 3 {
+		t.Fatalf("expected 3 observations, got %d", snap.Count)
+	}
+	if got := snap.Buckets[0].Count; got != 0 {
+		t.Errorf("expected 0 observations <= 50us, got %d", got)
+	}
+	if got := snap.Buckets[1].Count; got != 1 {
+		t.Errorf("expected 1 observation <= 100us, got %d", got)
+	}
+	last := snap.Buckets[len(snap.Buckets)-1]
+	if last.LeSeconds != -1 || last.Count != 3 {
+		t.Errorf("expected +Inf bucket with 3 observations, got %+v", last)
+	}
+}
+
+func TestRegistryReusesHistograms(t *testing.T) {
+	r := NewRegistry()
+
+	if r.Histogram("a") != r.Histogram("a") {
+		t.Error("expected the same histogram for the same name")
+	}
+	if len(r.Snapshot()) != 1 {
+		t.Errorf("expected 1 histogram, got %d", len(r.Snapshot()))
+	}
+}
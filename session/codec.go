@@ -0,0 +1,88 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// codec is a wire format for one connection: it encodes server messages and
+// decodes client messages.
+type codec interface {
+	// name identifies the format, e.g. for caching encoded broadcasts.
+	name() string
+	encode(msg ServerMessage) (frame, error)
+	decode(data []byte) (ClientMessage, error)
+}
+
+// codecs lists every wire format a client may ask for.
+var codecs = []codec{jsonCodec{}, msgpackCodec{}}
+
+// codecFor returns the codec a client asked for with ?format=, defaulting to
+// JSON.
+func codecFor(format string) (codec, error) {
+	switch format {
+	case "", "json":
+		return jsonCodec{}, nil
+	case "msgpack":
+		return msgpackCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// jsonCodec is the default format: JSON in text frames.
+type jsonCodec struct{}
+
+func (jsonCodec) name() string { return "json" }
+
+func (jsonCodec) encode(msg ServerMessage) (frame, error) {
+	data, err := json.Marshal(msg)
+	return frame{websocket.TextMessage, data}, err
+}
+
+func (jsonCodec) decode(data []byte) (ClientMessage, error) {
+	var msg ClientMessage
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// msgpackCodec sends MessagePack in binary frames, using the same field
+// names as the JSON format.
+type msgpackCodec struct{}
+
+func (msgpackCodec) name() string { return "msgpack" }
+
+func (msgpackCodec) encode(msg ServerMessage) (frame, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(msg); err != nil {
+		return frame{}, err
+	}
+	return frame{websocket.BinaryMessage, buf.Bytes()}, nil
+}
+
+// decode converts the payload to JSON, since command handlers parse their
+// payloads as JSON whatever the connection's format.
+func (msgpackCodec) decode(data []byte) (ClientMessage, error) {
+	var raw struct {
+		Type    string      `msgpack:"type"`
+		Payload interface{} `msgpack:"payload"`
+		ReqID   string      `msgpack:"reqId"`
+	}
+	if err := msgpack.Unmarshal(data, &raw); err != nil {
+		return ClientMessage{}, err
+	}
+	msg := ClientMessage{Type: raw.Type, ReqID: raw.ReqID}
+	if raw.Payload != nil {
+		payload, err := json.Marshal(raw.Payload)
+		if err != nil {
+			return ClientMessage{}, err
+		}
+		msg.Payload = payload
+	}
+	return msg, nil
+}
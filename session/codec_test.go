@@ -0,0 +1,59 @@
+package session
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"quick-tabletop-engine/game"
+)
+
+func TestCodecFor(t *testing.T) {
+	for format, want := range map[string]string{"": "json", "json": "json", "msgpack": "msgpack"} {
+		cd, err := codecFor(format)
+		if err != nil || cd.name() != want {
+			t.Errorf("%q: expected %s, got %v (%v)", format, want, cd, err)
+		}
+	}
+	if _, err := codecFor("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestMsgpackCodecEncodesJSONFieldNames(t *testing.T) {
+	f, err := msgpackCodec{}.encode(ServerMessage{Type: "welcome", Payload: Welcome{ClientID: "c1", Role: RoleGM}})
+	if err != nil || f.messageType != websocket.BinaryMessage {
+		t.Fatalf("expected a binary frame, got %d (%v)", f.messageType, err)
+	}
+
+	var got map[string]interface{}
+	if err := msgpack.Unmarshal(f.data, &got); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := got["payload"].(map[string]interface{})
+	if got["type"] != "welcome" || payload["clientId"] != "c1" || payload["role"] != RoleGM {
+		t.Errorf("unexpected message %v", got)
+	}
+}
+
+func TestMsgpackCodecDecodesPayloadAsJSON(t *testing.T) {
+	data, _ := msgpack.Marshal(map[string]interface{}{
+		"type":    "move_token",
+		"reqId":   "r1",
+		"payload": map[string]interface{}{"id": "t1", "x": 96, "y": 192.5},
+	})
+
+	msg, err := msgpackCodec{}.decode(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var p game.MoveTokenPayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil {
+		t.Fatalf("expected a JSON payload, got %s (%v)", msg.Payload, err)
+	}
+	if msg.Type != "move_token" || msg.ReqID != "r1" || p.ID != "t1" || p.X != 96 || p.Y != 192.5 {
+		t.Errorf("unexpected message %+v with payload %+v", msg, p)
+	}
+}
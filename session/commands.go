@@ -0,0 +1,1216 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/contrib/websocket"
+
+	"quick-tabletop-engine/config"
+	"quick-tabletop-engine/game"
+	"quick-tabletop-engine/metrics"
+)
+
+// commandContext carries everything a command handler may need besides its payload.
+type commandContext struct {
+	// role is the caller's role, checked against gmOnlyCommands.
+	role string
+	// paused is set while the GM has paused the session.
+	paused  bool
+	state   *game.State
+	cfg     config.Config
+	history *history
+	metrics *metrics.Registry
+
+	// playersCanAddTokens mirrors Session.PlayersCanAddTokens.
+	playersCanAddTokens bool
+
+	// delta is set by handlers whose change is confined to a single entity,
+	// letting delta-aware clients skip the full state. Nil means full state.
+	delta *Delta
+	// replies are sent back to the sender alone after the command.
+	replies []ServerMessage
+}
+
+func (ctx *commandContext) tokenChanged(id string) {
+	if token, ok := ctx.state.DisplayedTokens[id]; ok {
+		ctx.delta = &Delta{Kind: DeltaToken, ID: id, Token: &token}
+	}
+}
+
+func (ctx *commandContext) tokenDeleted(id string) {
+	ctx.delta = &Delta{Kind: DeltaTokenDeleted, ID: id}
+}
+
+// checkTokenLimit refuses a token that would push the board past the
+// configured cap. Replacing an existing token is always allowed.
+func (ctx *commandContext) checkTokenLimit(id string) error {
+	limit := ctx.cfg.MaxTokensPerSession
+	if limit <= 0 || len(ctx.state.DisplayedTokens) < limit {
+		return nil
+	}
+	if _, exists := ctx.state.DisplayedTokens[id]; exists {
+		return nil
+	}
+	return fmt.Errorf("session already has the maximum of %d tokens", limit)
+}
+
+// moveRejected tells the sender that token id stayed put, so its optimistic
+// UI can snap back.
+func (ctx *commandContext) moveRejected(id string) {
+	if token, ok := ctx.state.DisplayedTokens[id]; ok {
+		ctx.replies = append(ctx.replies, ServerMessage{
+			Type:    "move_rejected",
+			Payload: MoveRejected{ID: id, X: token.X, Y: token.Y},
+		})
+	}
+}
+
+// tokenTargetCommands act on existing tokens named by id, ids, tokenId or
+// moves[].id in their payload.
+var tokenTargetCommands = map[string]bool{
+	"move_token":             true,
+	"move_tokens":            true,
+	"duplicate_token":        true,
+	"delete_token":           true,
+	"delete_tokens":          true,
+	"set_token_hp":           true,
+	"set_token_z":            true,
+	"set_token_elevation":    true,
+	"set_token_aura":         true,
+	"bring_to_front":         true,
+	"send_to_back":           true,
+	"add_token_condition":    true,
+	"remove_token_condition": true,
+	"clear_token_conditions": true,
+	"start_concentration":    true,
+	"end_concentration":      true,
+}
+
+// tokenTargets collects the token ID fields used by tokenTargetCommands.
+type tokenTargets struct {
+	ID      string   `json:"id"`
+	IDs     []string `json:"ids"`
+	TokenID string   `json:"tokenId"`
+	Moves   []struct {
+		ID string `json:"id"`
+	} `json:"moves"`
+}
+
+// checkTokenTargets refuses a non-GM command naming a token the caller can't
+// see. A hidden token gets the same error as a missing one, so players can't
+// probe for hidden IDs.
+func (ctx *commandContext) checkTokenTargets(msg ClientMessage) error {
+	if ctx.role == RoleGM || !tokenTargetCommands[msg.Type] {
+		return nil
+	}
+	var t tokenTargets
+	if err := json.Unmarshal(msg.Payload, &t); err != nil {
+		return err
+	}
+	ids := t.IDs
+	if t.ID != "" {
+		ids = append(ids, t.ID)
+	}
+	if t.TokenID != "" {
+		ids = append(ids, t.TokenID)
+	}
+	for _, move := range t.Moves {
+		ids = append(ids, move.ID)
+	}
+	for _, id := range ids {
+		if token, ok := ctx.state.DisplayedTokens[id]; !ok || token.Hidden {
+			return fmt.Errorf("token %q not found", id)
+		}
+	}
+	return nil
+}
+
+// commandHandler applies a client command's payload to the session state.
+// A returned error means the payload was rejected and the state was left untouched.
+type commandHandler func(ctx *commandContext, payload json.RawMessage) error
+
+// commandHandlers is the central registry of state-mutating client commands.
+var commandHandlers = make(map[string]commandHandler)
+
+func registerCommand(msgType string, handler commandHandler) {
+	commandHandlers[msgType] = handler
+}
+
+// replyHandler turns a client command into a single server message without
+// mutating the game state.
+type replyHandler func(m *Manager, session *Session, sender *ClientInfo, payload json.RawMessage) (ServerMessage, error)
+
+// queryHandlers is the registry of read-only client commands whose reply is
+// sent only to the requester.
+var queryHandlers = make(map[string]replyHandler)
+
+func registerQuery(msgType string, handler replyHandler) {
+	queryHandlers[msgType] = handler
+}
+
+// controlHandler acts on the session's connections rather than its game
+// state, e.g. kicking a client.
+type controlHandler func(m *Manager, session *Session, sender *ClientInfo, payload json.RawMessage) error
+
+// controlHandlers is the registry of connection-level client commands.
+var controlHandlers = make(map[string]controlHandler)
+
+func registerControl(msgType string, handler controlHandler) {
+	controlHandlers[msgType] = handler
+}
+
+// eventHandlers is the registry of transient client commands (dice rolls and
+// the like) whose result is broadcast to the whole session but never stored.
+var eventHandlers = make(map[string]replyHandler)
+
+func registerEvent(msgType string, handler replyHandler) {
+	eventHandlers[msgType] = handler
+}
+
+func init() {
+	registerCommand("add_token", handleAddToken)
+	registerCommand("move_token", handleMoveToken)
+	registerCommand("move_tokens", handleMoveTokens)
+	registerCommand("duplicate_token", handleDuplicateToken)
+	registerCommand("delete_token", handleDeleteToken)
+	registerCommand("delete_tokens", handleDeleteTokens)
+	registerCommand("clear_tokens", handleClearTokens)
+	registerCommand("move_group", handleMoveGroup)
+	registerCommand("delete_group", handleDeleteGroup)
+	registerCommand("set_group_hidden", handleSetGroupHidden)
+	registerCommand("set_token_hp", handleSetTokenHP)
+	registerCommand("set_token_hidden", handleSetTokenHidden)
+	registerCommand("set_token_z", handleSetTokenZ)
+	registerCommand("set_token_elevation", handleSetTokenElevation)
+	registerCommand("set_token_name_visibility", handleSetTokenNameVisibility)
+	registerCommand("set_token_aura", handleSetTokenAura)
+	registerCommand("bring_to_front", handleBringToFront)
+	registerCommand("send_to_back", handleSendToBack)
+	registerCommand("add_token_condition", handleAddTokenCondition)
+	registerCommand("remove_token_condition", handleRemoveTokenCondition)
+	registerCommand("clear_token_conditions", handleClearTokenConditions)
+	registerCommand("start_concentration", handleStartConcentration)
+	registerCommand("end_concentration", handleEndConcentration)
+	registerCommand("set_initiative", handleSetInitiative)
+	registerCommand("set_token_initiative", handleSetTokenInitiative)
+	registerCommand("next_turn", handleNextTurn)
+	registerCommand("set_round", handleSetRound)
+	registerCommand("clear_initiative", handleClearInitiative)
+	registerCommand("add_fog", handleAddFog)
+	registerCommand("remove_fog", handleRemoveFog)
+	registerCommand("clear_fog", handleClearFog)
+	registerCommand("add_drawing", handleAddDrawing)
+	registerCommand("delete_drawing", handleDeleteDrawing)
+	registerCommand("clear_drawings", handleClearDrawings)
+	registerCommand("add_note", handleAddNote)
+	registerCommand("update_note", handleUpdateNote)
+	registerCommand("delete_note", handleDeleteNote)
+	registerCommand("add_text", handleAddText)
+	registerCommand("update_text", handleUpdateText)
+	registerCommand("move_text", handleMoveText)
+	registerCommand("delete_text", handleDeleteText)
+	registerCommand("create_scene", handleCreateScene)
+	registerCommand("switch_scene", handleSwitchScene)
+	registerCommand("delete_scene", handleDeleteScene)
+	registerCommand("change_background", handleChangeBackground)
+	registerCommand("set_background_transform", handleSetBackgroundTransform)
+	registerCommand("toggle_grid", handleToggleGrid)
+	registerCommand("set_snap", handleSetSnap)
+	registerCommand("set_snap_anchor", handleSetSnapAnchor)
+	registerCommand("set_grid_type", handleSetGridType)
+	registerCommand("set_prevent_overlap", handleSetPreventOverlap)
+	registerCommand("set_grid_offset", handleSetGridOffset)
+
+	registerCommand("undo", handleUndo)
+	registerCommand("redo", handleRedo)
+
+	registerQuery("capabilities", handleCapabilities)
+	registerQuery("token_distance", handleTokenDistance)
+
+	registerControl("kick", handleKick)
+	registerControl("rename_session", handleRenameSession)
+	registerControl("revoke_sharelink", handleRevokeShareLink)
+	registerControl("pause", handlePause)
+	registerControl("resume", handleResume)
+	registerControl("allow_player_tokens", handleAllowPlayerTokens)
+	registerControl("resync", handleResync)
+	registerControl("whisper", handleWhisper)
+
+	registerEvent("roll_dice", handleRollDice)
+	registerEvent("measure", handleMeasure)
+	registerEvent("chat", handleChat)
+	registerEvent("ping", handlePing)
+	registerEvent("set_name", handleSetName)
+}
+
+// commandTypes returns every command type a client may send, sorted.
+func commandTypes() []string {
+	types := make([]string, 0, len(commandHandlers)+len(queryHandlers)+len(controlHandlers)+len(eventHandlers))
+	for msgType := range commandHandlers {
+		types = append(types, msgType)
+	}
+	for msgType := range queryHandlers {
+		types = append(types, msgType)
+	}
+	for msgType := range controlHandlers {
+		types = append(types, msgType)
+	}
+	for msgType := range eventHandlers {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// commandMetric names the latency histogram recorded for a command type.
+func commandMetric(msgType string) string {
+	return "command_duration_seconds/" + msgType
+}
+
+// historyCommands move through the undo history rather than being recorded in it.
+var historyCommands = map[string]bool{"undo": true, "redo": true}
+
+// gmOnlyCommands may only be issued by the session's GM: anything that sets
+// up the table (grid, snapping, background, scenes, fog), decides what
+// players see, runs the initiative or manages connections. Undo and redo are
+// among them because the history also holds the GM's own changes, such as
+// hiding a token, which players must not be able to revert.
+var gmOnlyCommands = map[string]bool{
+	"undo":                      true,
+	"redo":                      true,
+	"clear_tokens":              true,
+	"change_background":         true,
+	"set_background_transform":  true,
+	"toggle_grid":               true,
+	"set_snap":                  true,
+	"set_snap_anchor":           true,
+	"set_grid_type":             true,
+	"set_grid_offset":           true,
+	"set_prevent_overlap":       true,
+	"add_fog":                   true,
+	"remove_fog":                true,
+	"clear_fog":                 true,
+	"set_token_hidden":          true,
+	"set_group_hidden":          true,
+	"set_token_name_visibility": true,
+	"set_initiative":            true,
+	"set_token_initiative":      true,
+	"next_turn":                 true,
+	"set_round":                 true,
+	"clear_initiative":          true,
+	"kick":                      true,
+	"rename_session":            true,
+	"pause":                     true,
+	"resume":                    true,
+	"allow_player_tokens":       true,
+	"revoke_sharelink":          true,
+	"create_scene":              true,
+	"switch_scene":              true,
+	"delete_scene":              true,
+	"add_note":                  true,
+	"update_note":               true,
+	"delete_note":               true,
+	"add_text":                  true,
+	"update_text":               true,
+	"move_text":                 true,
+	"delete_text":               true,
+}
+
+// spectatorCommands are the commands a spectator may still issue, since
+// they only affect the spectator themselves: what they receive, or the name
+// they appear under. Every other command and event, chat and dice included,
+// is refused.
+var spectatorCommands = map[string]bool{"resync": true, "set_name": true}
+
+// errForbidden is returned for commands the caller's role may not issue.
+var errForbidden = errors.New("only the GM may do that")
+
+// errPaused is returned for non-GM commands while the session is paused.
+var errPaused = errors.New("session paused")
+
+// errNoPlayerTokens is returned when a player adds a token while the GM has
+// turned that off.
+var errNoPlayerTokens = errors.New("the GM has turned off adding tokens")
+
+// errReadOnly is returned for any command from a spectator.
+var errReadOnly = errors.New("spectators are read-only")
+
+// authorize checks that role may issue msgType.
+func authorize(msgType, role string) error {
+	if role == RoleSpectator && !spectatorCommands[msgType] {
+		return fmt.Errorf("%s: %w", msgType, errReadOnly)
+	}
+	if gmOnlyCommands[msgType] && role != RoleGM {
+		return fmt.Errorf("%s: %w", msgType, errForbidden)
+	}
+	return nil
+}
+
+// processCommand applies msg to the state and reports whether the state
+// changed. On error the state is unchanged and nothing should be broadcast.
+func processCommand(msg ClientMessage, ctx *commandContext) (bool, error) {
+	handler, ok := commandHandlers[msg.Type]
+	if !ok {
+		return false, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	if err := authorize(msg.Type, ctx.role); err != nil {
+		return false, err
+	}
+	if ctx.paused && ctx.role != RoleGM {
+		return false, fmt.Errorf("%s: %w", msg.Type, errPaused)
+	}
+	if err := ctx.checkTokenTargets(msg); err != nil {
+		return false, fmt.Errorf("invalid %s payload: %w", msg.Type, err)
+	}
+
+	before := ctx.state.Clone()
+	start := time.Now()
+	err := handler(ctx, msg.Payload)
+	if ctx.metrics != nil {
+		ctx.metrics.Histogram(commandMetric(msg.Type)).Observe(time.Since(start))
+	}
+	if err != nil {
+		return false, fmt.Errorf("invalid %s payload: %w", msg.Type, err)
+	}
+	// A token delta doesn't carry the initiative, so a command that also
+	// changed it, or how players see it, has to send the full state.
+	if ctx.delta != nil && initiativeChanged(before, *ctx.state) {
+		ctx.delta = nil
+	}
+	changed := !reflect.DeepEqual(before, *ctx.state)
+	// A no-op isn't worth an undo step, and recording it would clear redo.
+	if changed && ctx.history != nil && !historyCommands[msg.Type] {
+		ctx.history.record(before)
+	}
+	return changed, nil
+}
+
+// initiativeChanged reports whether the initiative differs between before
+// and after, as either the GM or the players see it.
+func initiativeChanged(before, after game.State) bool {
+	if !slices.Equal(before.InitiativeOrder, after.InitiativeOrder) || before.CurrentTurn != after.CurrentTurn || before.Round != after.Round {
+		return true
+	}
+	beforeOrder, beforeTurn := before.PlayerInitiative()
+	afterOrder, afterTurn := after.PlayerInitiative()
+	return !slices.Equal(beforeOrder, afterOrder) || beforeTurn != afterTurn
+}
+
+// truncate shortens s to at most max characters. A non-positive max disables the limit.
+func truncate(s string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+func handleAddToken(ctx *commandContext, payload json.RawMessage) error {
+	var p game.AddTokenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if ctx.role == RolePlayer && !ctx.playersCanAddTokens {
+		return errNoPlayerTokens
+	}
+	if p.ID == "" {
+		return errors.New("token id is required")
+	}
+	if err := p.Token.Validate(); err != nil {
+		return err
+	}
+	// Players may not overwrite an existing token, visible or not, so the
+	// refusal says nothing about hidden IDs.
+	if _, exists := ctx.state.DisplayedTokens[p.ID]; exists && ctx.role != RoleGM {
+		return fmt.Errorf("token %q already exists", p.ID)
+	}
+	if err := ctx.checkTokenLimit(p.ID); err != nil {
+		return err
+	}
+	p.Token.Name = truncate(p.Token.Name, ctx.cfg.MaxNameLength)
+	ctx.state.AddToken(p.ID, p.Token)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleMoveToken(ctx *commandContext, payload json.RawMessage) error {
+	var p game.MoveTokenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if !ctx.state.MoveToken(p.ID, p.X, p.Y) {
+		ctx.moveRejected(p.ID)
+		return nil
+	}
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+// handleMoveTokens moves a group selection. It reports no delta, so the
+// whole group goes out in a single state broadcast.
+func handleMoveTokens(ctx *commandContext, payload json.RawMessage) error {
+	var p game.MoveTokensPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	for _, id := range ctx.state.MoveTokens(p.Moves) {
+		ctx.moveRejected(id)
+	}
+	return nil
+}
+
+func handleDuplicateToken(ctx *commandContext, payload json.RawMessage) error {
+	var p game.DuplicateTokenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if ctx.role == RolePlayer && !ctx.playersCanAddTokens {
+		return errNoPlayerTokens
+	}
+	if err := ctx.checkTokenLimit(""); err != nil {
+		return err
+	}
+	newID, ok := ctx.state.DuplicateToken(p.ID, p.OffsetX, p.OffsetY)
+	if _, exists := ctx.state.DisplayedTokens[p.ID]; !ok && exists {
+		return errors.New("the copy would overlap another token")
+	}
+	if !ok {
+		return fmt.Errorf("token %q not found", p.ID)
+	}
+	ctx.tokenChanged(newID)
+	return nil
+}
+
+func handleDeleteToken(ctx *commandContext, payload json.RawMessage) error {
+	var p game.DeleteTokenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.DeleteToken(p.ID)
+	ctx.tokenDeleted(p.ID)
+	return nil
+}
+
+// handleDeleteTokens removes a multi-selection with a single state broadcast.
+func handleDeleteTokens(ctx *commandContext, payload json.RawMessage) error {
+	var p game.DeleteTokensPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.DeleteTokens(p.IDs)
+	return nil
+}
+
+func handleMoveGroup(ctx *commandContext, payload json.RawMessage) error {
+	var p game.MoveGroupPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	for _, id := range ctx.state.MoveGroup(p.GroupID, p.OffsetX, p.OffsetY, ctx.role == RoleGM) {
+		ctx.moveRejected(id)
+	}
+	return nil
+}
+
+func handleDeleteGroup(ctx *commandContext, payload json.RawMessage) error {
+	var p game.DeleteGroupPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.DeleteGroup(p.GroupID, ctx.role == RoleGM)
+	return nil
+}
+
+func handleSetGroupHidden(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetGroupHiddenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetGroupHidden(p.GroupID, p.Hidden)
+	return nil
+}
+
+func handleClearTokens(ctx *commandContext, _ json.RawMessage) error {
+	ctx.state.ClearTokens()
+	return nil
+}
+
+func handleSetTokenHP(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetTokenHPPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetTokenHP(p.ID, p.HP)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleSetTokenHidden(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetTokenHiddenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetTokenHidden(p.ID, p.Hidden)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleSetTokenZ(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetTokenZPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetTokenZ(p.ID, p.Z)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleSetTokenNameVisibility(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetTokenNameVisibilityPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetTokenNameVisibility(p.ID, p.Visible)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleSetTokenElevation(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetTokenElevationPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetTokenElevation(p.ID, p.Elevation)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleSetTokenAura(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetTokenAuraPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if p.Radius < 0 {
+		return fmt.Errorf("aura radius must not be negative, got %v", p.Radius)
+	}
+	if p.Color != "" && !game.ValidColor(p.Color) {
+		return fmt.Errorf("invalid aura color %q", p.Color)
+	}
+	ctx.state.SetTokenAura(p.ID, p.Radius, p.Color)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleBringToFront(ctx *commandContext, payload json.RawMessage) error {
+	var p game.TokenOrderPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.BringToFront(p.ID)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleSendToBack(ctx *commandContext, payload json.RawMessage) error {
+	var p game.TokenOrderPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SendToBack(p.ID)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleAddTokenCondition(ctx *commandContext, payload json.RawMessage) error {
+	var p game.TokenConditionPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.AddTokenCondition(p.ID, truncate(p.Condition, ctx.cfg.MaxNameLength))
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleRemoveTokenCondition(ctx *commandContext, payload json.RawMessage) error {
+	var p game.TokenConditionPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.RemoveTokenCondition(p.ID, p.Condition)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleClearTokenConditions(ctx *commandContext, payload json.RawMessage) error {
+	var p game.TokenConditionPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.ClearTokenConditions(p.ID)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleStartConcentration(ctx *commandContext, payload json.RawMessage) error {
+	var p game.ConcentrationPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.StartConcentration(p.ID, truncate(p.Spell, ctx.cfg.MaxNameLength))
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleEndConcentration(ctx *commandContext, payload json.RawMessage) error {
+	var p game.ConcentrationPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.EndConcentration(p.ID)
+	ctx.tokenChanged(p.ID)
+	return nil
+}
+
+func handleSetInitiative(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetInitiativePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if err := ctx.state.ValidateInitiative(p.Entries); err != nil {
+		return err
+	}
+	for i := range p.Entries {
+		p.Entries[i].Name = truncate(p.Entries[i].Name, ctx.cfg.MaxNameLength)
+	}
+	ctx.state.SetInitiative(p.Entries)
+	return nil
+}
+
+func handleSetTokenInitiative(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetTokenInitiativePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetTokenInitiative(p.TokenID, p.Value)
+	return nil
+}
+
+func handleNextTurn(ctx *commandContext, _ json.RawMessage) error {
+	ctx.state.NextTurn()
+	return nil
+}
+
+func handleSetRound(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetRoundPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if p.Round < 0 {
+		return fmt.Errorf("round must not be negative, got %d", p.Round)
+	}
+	ctx.state.SetRound(p.Round)
+	return nil
+}
+
+func handleClearInitiative(ctx *commandContext, _ json.RawMessage) error {
+	ctx.state.ClearInitiative()
+	return nil
+}
+
+func handleAddFog(ctx *commandContext, payload json.RawMessage) error {
+	var p game.AddFogPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if err := p.Region.Validate(); err != nil {
+		return err
+	}
+	ctx.state.AddFog(p.Region)
+	return nil
+}
+
+func handleRemoveFog(ctx *commandContext, payload json.RawMessage) error {
+	var p game.RemoveFogPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.RemoveFog(p.ID)
+	return nil
+}
+
+func handleClearFog(ctx *commandContext, _ json.RawMessage) error {
+	ctx.state.ClearFog()
+	return nil
+}
+
+func handleAddDrawing(ctx *commandContext, payload json.RawMessage) error {
+	var p game.AddDrawingPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if err := p.Drawing.Validate(); err != nil {
+		return err
+	}
+	ctx.state.AddDrawing(p.Drawing)
+	return nil
+}
+
+func handleDeleteDrawing(ctx *commandContext, payload json.RawMessage) error {
+	var p game.DeleteDrawingPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.DeleteDrawing(p.ID)
+	return nil
+}
+
+func handleClearDrawings(ctx *commandContext, _ json.RawMessage) error {
+	ctx.state.ClearDrawings()
+	return nil
+}
+
+func handleAddNote(ctx *commandContext, payload json.RawMessage) error {
+	var p game.NotePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	p.Note.Text = truncate(p.Note.Text, ctx.cfg.MaxTextLength)
+	ctx.state.AddNote(p.ID, p.Note)
+	return nil
+}
+
+func handleUpdateNote(ctx *commandContext, payload json.RawMessage) error {
+	var p game.NotePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	p.Note.Text = truncate(p.Note.Text, ctx.cfg.MaxTextLength)
+	ctx.state.UpdateNote(p.ID, p.Note)
+	return nil
+}
+
+func handleDeleteNote(ctx *commandContext, payload json.RawMessage) error {
+	var p game.DeleteNotePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.DeleteNote(p.ID)
+	return nil
+}
+
+func handleAddText(ctx *commandContext, payload json.RawMessage) error {
+	var p game.TextPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if err := p.Text.Validate(); err != nil {
+		return err
+	}
+	p.Text.Text = truncate(p.Text.Text, ctx.cfg.MaxTextLength)
+	ctx.state.AddText(p.ID, p.Text)
+	return nil
+}
+
+func handleUpdateText(ctx *commandContext, payload json.RawMessage) error {
+	var p game.TextPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if err := p.Text.Validate(); err != nil {
+		return err
+	}
+	p.Text.Text = truncate(p.Text.Text, ctx.cfg.MaxTextLength)
+	ctx.state.UpdateText(p.ID, p.Text)
+	return nil
+}
+
+func handleMoveText(ctx *commandContext, payload json.RawMessage) error {
+	var p game.MoveTextPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.MoveText(p.ID, p.X, p.Y)
+	return nil
+}
+
+func handleDeleteText(ctx *commandContext, payload json.RawMessage) error {
+	var p game.DeleteTextPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.DeleteText(p.ID)
+	return nil
+}
+
+func handleCreateScene(ctx *commandContext, payload json.RawMessage) error {
+	var p game.CreateScenePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if !ctx.state.CreateScene(p.ID, truncate(p.Name, ctx.cfg.MaxNameLength), p.BackgroundImgPath) {
+		return fmt.Errorf("cannot create scene %q", p.ID)
+	}
+	return nil
+}
+
+func handleSwitchScene(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SceneIDPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SwitchScene(p.ID)
+	return nil
+}
+
+func handleDeleteScene(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SceneIDPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if !ctx.state.DeleteScene(p.ID) {
+		return fmt.Errorf("cannot delete scene %q", p.ID)
+	}
+	return nil
+}
+
+func handleSetBackgroundTransform(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetBackgroundTransformPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if p.Scale <= 0 {
+		return fmt.Errorf("background scale must be positive, got %v", p.Scale)
+	}
+	ctx.state.SetBackgroundTransform(p.Scale, p.OffsetX, p.OffsetY)
+	return nil
+}
+
+func handleChangeBackground(ctx *commandContext, payload json.RawMessage) error {
+	var p game.ChangeBackgroundPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if !game.ValidateImgPath(p.ImgPath) {
+		return fmt.Errorf("invalid background image path %q", p.ImgPath)
+	}
+	ctx.state.ChangeBackgroundImg(p.ImgPath)
+	ctx.state.FitGridToImage(p.ImageWidth, p.FitColumns)
+	return nil
+}
+
+func handleToggleGrid(ctx *commandContext, _ json.RawMessage) error {
+	ctx.state.ToggleGrid()
+	return nil
+}
+
+func handleSetSnap(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetSnapPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetSnapToGrid(p.Enabled)
+	return nil
+}
+
+func handleSetSnapAnchor(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetSnapAnchorPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if !game.ValidSnapAnchor(p.Anchor) {
+		return fmt.Errorf("invalid snap anchor %q", p.Anchor)
+	}
+	ctx.state.SetSnapAnchor(p.Anchor)
+	return nil
+}
+
+func handleSetGridType(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetGridTypePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if !game.ValidGridType(p.GridType) {
+		return fmt.Errorf("invalid grid type %q", p.GridType)
+	}
+	ctx.state.SetGridType(p.GridType)
+	return nil
+}
+
+func handleSetPreventOverlap(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetPreventOverlapPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetPreventOverlap(p.Enabled)
+	return nil
+}
+
+func handleSetGridOffset(ctx *commandContext, payload json.RawMessage) error {
+	var p game.SetGridOffsetPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	ctx.state.SetGridOffset(p.X, p.Y)
+	return nil
+}
+
+func handleUndo(ctx *commandContext, _ json.RawMessage) error {
+	if ctx.history == nil {
+		return errors.New("undo history unavailable")
+	}
+	if prev, ok := ctx.history.stepBack(*ctx.state); ok {
+		*ctx.state = prev
+	}
+	return nil
+}
+
+func handleRedo(ctx *commandContext, _ json.RawMessage) error {
+	if ctx.history == nil {
+		return errors.New("undo history unavailable")
+	}
+	if next, ok := ctx.history.stepForward(*ctx.state); ok {
+		*ctx.state = next
+	}
+	return nil
+}
+
+func handleCapabilities(m *Manager, _ *Session, _ *ClientInfo, _ json.RawMessage) (ServerMessage, error) {
+	return ServerMessage{Type: "capabilities", Payload: m.capabilities()}, nil
+}
+
+func handleTokenDistance(_ *Manager, session *Session, sender *ClientInfo, payload json.RawMessage) (ServerMessage, error) {
+	var p game.TokenDistancePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ServerMessage{}, err
+	}
+	// Measure within the sender's view so players can't probe hidden tokens.
+	view := viewFor(session.State, sender.Role)
+	distance, ok := view.TokenDistance(p.IDA, p.IDB)
+	if !ok {
+		return ServerMessage{}, errors.New("token not found")
+	}
+	return ServerMessage{
+		Type:    "token_distance",
+		Payload: game.TokenDistanceResult{IDA: p.IDA, IDB: p.IDB, Distance: distance},
+	}, nil
+}
+
+func handleRollDice(m *Manager, _ *Session, _ *ClientInfo, payload json.RawMessage) (ServerMessage, error) {
+	var p game.RollDicePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ServerMessage{}, err
+	}
+	total, rolls, err := game.Roll(p.Notation)
+	if err != nil {
+		return ServerMessage{}, err
+	}
+
+	sum := 0
+	for _, r := range rolls {
+		sum += r
+	}
+	return ServerMessage{
+		Type: "dice_result",
+		Payload: game.DiceResult{
+			Notation: p.Notation,
+			Label:    truncate(p.Label, m.config().MaxNameLength),
+			Rolls:    rolls,
+			Modifier: total - sum,
+			Total:    total,
+		},
+	}, nil
+}
+
+func handleChat(m *Manager, _ *Session, sender *ClientInfo, payload json.RawMessage) (ServerMessage, error) {
+	var p ChatPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ServerMessage{}, err
+	}
+	if err := checkChatText(p.Text, m.config().MaxTextLength); err != nil {
+		return ServerMessage{}, err
+	}
+	return ServerMessage{
+		Type: "chat_message",
+		Payload: ChatMessage{
+			ClientID:  sender.ID,
+			Text:      p.Text,
+			Timestamp: time.Now().UTC(),
+		},
+	}, nil
+}
+
+func handlePing(m *Manager, _ *Session, sender *ClientInfo, payload json.RawMessage) (ServerMessage, error) {
+	var p PingPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ServerMessage{}, err
+	}
+	return ServerMessage{
+		Type: "ping",
+		Payload: PingMessage{
+			ClientID: sender.ID,
+			X:        p.X,
+			Y:        p.Y,
+			Color:    truncate(p.Color, m.config().MaxNameLength),
+		},
+	}, nil
+}
+
+func handleMeasure(_ *Manager, session *Session, sender *ClientInfo, payload json.RawMessage) (ServerMessage, error) {
+	var p MeasurePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ServerMessage{}, err
+	}
+	switch p.Diagonal {
+	case "":
+		p.Diagonal = game.DiagonalChebyshev
+	case game.DiagonalChebyshev, game.DiagonalEuclidean:
+	default:
+		return ServerMessage{}, fmt.Errorf("unknown diagonal rule %q", p.Diagonal)
+	}
+	return ServerMessage{
+		Type: "measurement",
+		Payload: Measurement{
+			ClientID: sender.ID,
+			X1:       p.X1,
+			Y1:       p.Y1,
+			X2:       p.X2,
+			Y2:       p.Y2,
+			Diagonal: p.Diagonal,
+			Pixels:   math.Hypot(p.X2-p.X1, p.Y2-p.Y1),
+			Cells:    game.GridDistance(p.X1, p.Y1, p.X2, p.Y2, session.State.GridUnit, p.Diagonal),
+		},
+	}, nil
+}
+
+func handleSetName(_ *Manager, session *Session, sender *ClientInfo, payload json.RawMessage) (ServerMessage, error) {
+	var p SetNamePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ServerMessage{}, err
+	}
+	sender.Name = clientName(p.Name, sender.ID)
+	return ServerMessage{Type: "presence_update", Payload: session.presence()}, nil
+}
+
+// checkChatText rejects blank chat lines and ones longer than max
+// characters. A non-positive max disables the limit, as it does for truncate.
+func checkChatText(text string, max int) error {
+	if strings.TrimSpace(text) == "" {
+		return errors.New("empty chat message")
+	}
+	if n := utf8.RuneCountInString(text); max > 0 && n > max {
+		return fmt.Errorf("chat message of %d chars exceeds limit of %d", n, max)
+	}
+	return nil
+}
+
+// handleWhisper delivers a private chat line to one client and echoes it to
+// the sender; nobody else sees it.
+func handleWhisper(m *Manager, session *Session, sender *ClientInfo, payload json.RawMessage) error {
+	var p WhisperPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if err := checkChatText(p.Text, m.config().MaxTextLength); err != nil {
+		return err
+	}
+	targetConn, target := session.findClient(p.ToClientID)
+	if target == nil {
+		return fmt.Errorf("unknown client %q", p.ToClientID)
+	}
+
+	msg := ServerMessage{
+		Type: "chat_message",
+		Payload: ChatMessage{
+			ClientID:   sender.ID,
+			Text:       p.Text,
+			Timestamp:  time.Now().UTC(),
+			Private:    true,
+			ToClientID: target.ID,
+		},
+	}
+	sendMessage(targetConn, target.codec, msg)
+	if target != sender {
+		senderConn, _ := session.findClient(sender.ID)
+		sendMessage(senderConn, sender.codec, msg)
+	}
+	return nil
+}
+
+// handleResync sends the sender a fresh full state_update, for a client
+// whose state hash no longer matches or that missed a delta. Nobody else is
+// sent anything and the state is left alone.
+func handleResync(_ *Manager, session *Session, sender *ClientInfo, _ json.RawMessage) error {
+	conn, _ := session.findClient(sender.ID)
+	if conn == nil {
+		return errors.New("client not connected")
+	}
+	sendState(conn, session, sender)
+	return nil
+}
+
+// handleKick disconnects the target client. Kicking yourself or an unknown
+// client is a no-op; the target's own HandleWS cleanup removes it.
+func handleKick(_ *Manager, session *Session, sender *ClientInfo, payload json.RawMessage) error {
+	var p KickPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	conn, target := session.findClient(p.ClientID)
+	if target == nil || target == sender {
+		return nil
+	}
+	log.Printf("client %s kicked from session %s by %s\n", target.ID, session.ID, sender.ID)
+	target.removed = true
+	sendMessage(conn, target.codec, ServerMessage{Type: "kicked", Payload: nil})
+	disconnect(conn, websocket.ClosePolicyViolation, "kicked")
+	return nil
+}
+
+// handleRenameSession updates the session's name and system tag and tells
+// everyone in it.
+func handleRenameSession(m *Manager, session *Session, _ *ClientInfo, payload json.RawMessage) error {
+	var p SessionMeta
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	session.setMeta(p, m.config().MaxSessionNameLength)
+	broadcastMessage(session, ServerMessage{Type: "session_meta", Payload: session.Meta})
+	return nil
+}
+
+func handlePause(_ *Manager, session *Session, _ *ClientInfo, _ json.RawMessage) error {
+	return setPaused(session, true)
+}
+
+func handleResume(_ *Manager, session *Session, _ *ClientInfo, _ json.RawMessage) error {
+	return setPaused(session, false)
+}
+
+// handleAllowPlayerTokens lets the GM allow or refuse add_token and
+// duplicate_token from players, and tells everyone.
+func handleAllowPlayerTokens(_ *Manager, session *Session, _ *ClientInfo, payload json.RawMessage) error {
+	var p PlayersCanAddTokensPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	session.PlayersCanAddTokens = p.Allowed
+	broadcastMessage(session, ServerMessage{Type: "players_can_add_tokens", Payload: p})
+	return nil
+}
+
+// setPaused freezes or unfreezes the board for non-GM clients and tells
+// everyone, so clients can disable their controls.
+func setPaused(session *Session, paused bool) error {
+	session.Paused = paused
+	broadcastMessage(session, ServerMessage{Type: "session_paused", Payload: PausedMessage{Paused: paused}})
+	return nil
+}
@@ -0,0 +1,422 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"quick-tabletop-engine/config"
+	"quick-tabletop-engine/game"
+	"quick-tabletop-engine/metrics"
+)
+
+func TestRegistryHasExistingCommands(t *testing.T) {
+	for _, msgType := range []string{"add_token", "move_token", "delete_token", "clear_tokens", "change_background", "toggle_grid"} {
+		if _, ok := commandHandlers[msgType]; !ok {
+			t.Errorf("expected %q to be registered", msgType)
+		}
+	}
+}
+
+func TestRegistryDispatchesToHandler(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin", X: 96, Y: 96})
+
+	payload, _ := json.Marshal(game.MoveTokenPayload{ID: "t1", X: 10, Y: 20})
+	if err := commandHandlers["move_token"](testContext(&state), payload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	token := state.DisplayedTokens["t1"]
+	if token.X != 10 || token.Y != 20 {
+		t.Errorf("expected (10,20), got (%f,%f)", token.X, token.Y)
+	}
+}
+
+func TestRegistryHandlerRejectsMalformedPayload(t *testing.T) {
+	state := game.NewState()
+
+	err := commandHandlers["add_token"](testContext(&state), json.RawMessage(`{"id": 42}`))
+
+	if err == nil {
+		t.Error("expected an error for a malformed payload")
+	}
+	if len(state.DisplayedTokens) != 0 {
+		t.Error("malformed payload should not mutate state")
+	}
+}
+
+func TestAddTokenRejectsInvalidTokens(t *testing.T) {
+	state := game.NewState()
+
+	for _, p := range []game.AddTokenPayload{
+		{Token: game.TokenData{Name: "Goblin"}},
+		{ID: "t1", Token: game.TokenData{Name: "Goblin", MaxHP: -1}},
+	} {
+		payload, _ := json.Marshal(p)
+		if err := commandHandlers["add_token"](testContext(&state), payload); err == nil {
+			t.Errorf("expected %+v to be rejected", p)
+		}
+	}
+	if len(state.DisplayedTokens) != 0 {
+		t.Errorf("rejected tokens should not be added, got %v", state.DisplayedTokens)
+	}
+}
+
+func TestAddTokenDefaultsMissingAndNegativeSizes(t *testing.T) {
+	state := game.NewState()
+
+	for id, size := range map[string]float64{"omitted": 0, "negative": -96, "large": 192} {
+		cmd := makeCommand(t, "add_token", game.AddTokenPayload{ID: id, Token: game.TokenData{Name: "Goblin", TokenSize: size}})
+		if _, err := processCommand(cmd, testContext(&state)); err != nil {
+			t.Errorf("%s: expected the token to be added, got %v", id, err)
+		}
+	}
+
+	for id, want := range map[string]float64{"omitted": 96, "negative": 96, "large": 192} {
+		if got := state.DisplayedTokens[id].TokenSize; got != want {
+			t.Errorf("%s: expected size %v, got %v", id, want, got)
+		}
+	}
+}
+
+func TestCommandTypesIncludesRegistry(t *testing.T) {
+	types := commandTypes()
+
+	want := len(commandHandlers) + len(queryHandlers) + len(controlHandlers) + len(eventHandlers)
+	if len(types) != want {
+		t.Fatalf("expected %d command types, got %d", want, len(types))
+	}
+	for i := 1; i < len(types); i++ {
+		if types[i-1] > types[i] {
+			t.Fatalf("expected sorted command types, got %v", types)
+		}
+	}
+}
+
+func TestTokenDistanceQuery(t *testing.T) {
+	session := &Session{State: game.NewState()}
+	session.State.AddToken("a", game.TokenData{Name: "Fighter", X: 0, Y: 0})
+	session.State.AddToken("b", game.TokenData{Name: "Goblin", X: 96 * 3, Y: 96})
+
+	payload, _ := json.Marshal(game.TokenDistancePayload{IDA: "a", IDB: "b"})
+	reply, err := queryHandlers["token_distance"](NewManager(config.Default()), session, &ClientInfo{}, payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, ok := reply.Payload.(game.TokenDistanceResult)
+	if reply.Type != "token_distance" || !ok {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if result.Distance != 3 {
+		t.Errorf("expected distance 3, got %f", result.Distance)
+	}
+}
+
+func TestTokenDistanceQueryMissingToken(t *testing.T) {
+	session := &Session{State: game.NewState()}
+	session.State.AddToken("a", game.TokenData{Name: "Fighter"})
+
+	payload, _ := json.Marshal(game.TokenDistancePayload{IDA: "a", IDB: "missing"})
+	if _, err := queryHandlers["token_distance"](NewManager(config.Default()), session, &ClientInfo{}, payload); err == nil {
+		t.Error("expected an error when a token is missing")
+	}
+}
+
+func TestTokenDistanceQueryHidesHiddenTokens(t *testing.T) {
+	session := &Session{State: game.NewState()}
+	session.State.AddToken("a", game.TokenData{Name: "Fighter"})
+	session.State.AddToken("ambush", game.TokenData{Name: "Ogre", Hidden: true})
+
+	payload, _ := json.Marshal(game.TokenDistancePayload{IDA: "a", IDB: "ambush"})
+	m := NewManager(config.Default())
+	if _, err := queryHandlers["token_distance"](m, session, &ClientInfo{Role: RolePlayer}, payload); err == nil {
+		t.Error("expected players not to measure to a hidden token")
+	}
+	if _, err := queryHandlers["token_distance"](m, session, &ClientInfo{Role: RoleGM}, payload); err != nil {
+		t.Errorf("expected the GM to measure to a hidden token, got %v", err)
+	}
+}
+
+func TestHandlersReportTokenDeltas(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+
+	processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin"}}), ctx)
+	if ctx.delta == nil || ctx.delta.Kind != DeltaToken || ctx.delta.ID != "t1" {
+		t.Fatalf("expected token delta for t1, got %+v", ctx.delta)
+	}
+
+	ctx = testContext(&state)
+	processCommand(makeCommand(t, "move_token", game.MoveTokenPayload{ID: "t1", X: 10, Y: 20}), ctx)
+	if ctx.delta == nil || ctx.delta.Token.X != 10 || ctx.delta.Token.Y != 20 {
+		t.Fatalf("expected moved token in delta, got %+v", ctx.delta)
+	}
+
+	ctx = testContext(&state)
+	processCommand(makeCommand(t, "delete_token", game.DeleteTokenPayload{ID: "t1"}), ctx)
+	if ctx.delta == nil || ctx.delta.Kind != DeltaTokenDeleted {
+		t.Fatalf("expected token_deleted delta, got %+v", ctx.delta)
+	}
+
+	ctx = testContext(&state)
+	processCommand(makeCommand(t, "toggle_grid", nil), ctx)
+	if ctx.delta != nil {
+		t.Errorf("expected no delta for a board-wide change, got %+v", ctx.delta)
+	}
+}
+
+// applyDelta updates a client's copy of the state the way a delta-aware
+// client does. A nil delta means the client receives the full view.
+func applyDelta(view *game.State, delta *Delta, state game.State, role string) {
+	if delta == nil {
+		*view = viewFor(state, role).Clone()
+		return
+	}
+	delta = deltaFor(delta, role)
+	switch delta.Kind {
+	case DeltaToken:
+		view.DisplayedTokens[delta.ID] = *delta.Token
+	case DeltaTokenDeleted:
+		delete(view.DisplayedTokens, delta.ID)
+	}
+}
+
+func TestDeltasKeepInitiativeInSync(t *testing.T) {
+	for _, cmd := range []ClientMessage{
+		makeCommand(t, "move_token", game.MoveTokenPayload{ID: "orc", X: 96}),
+		makeCommand(t, "set_token_hidden", game.SetTokenHiddenPayload{ID: "orc", Hidden: true}),
+		makeCommand(t, "set_token_name_visibility", game.SetTokenNameVisibilityPayload{ID: "orc", Visible: false}),
+		makeCommand(t, "set_token_hp", game.SetTokenHPPayload{ID: "orc", HP: 3}),
+		makeCommand(t, "delete_token", game.DeleteTokenPayload{ID: "orc"}),
+	} {
+		for _, role := range []string{RoleGM, RolePlayer} {
+			state := game.NewState()
+			state.AddToken("orc", game.TokenData{Name: "Orc"})
+			state.AddToken("elf", game.TokenData{Name: "Elf"})
+			state.SetInitiative([]game.InitiativeEntry{{TokenID: "orc", Score: 15, Name: "Orc"}, {TokenID: "elf", Score: 10, Name: "Elf"}})
+			state.NextTurn()
+			view := viewFor(state, role).Clone()
+
+			ctx := testContext(&state)
+			if _, err := processCommand(cmd, ctx); err != nil {
+				t.Fatalf("%s: %v", cmd.Type, err)
+			}
+			applyDelta(&view, ctx.delta, state, role)
+
+			if got, want := view.Hash(), viewFor(state, role).Hash(); got != want {
+				t.Errorf("%s as %s: client state hash %s doesn't match server %s", cmd.Type, role, got, want)
+			}
+		}
+	}
+}
+
+func TestGroupMovesAndCopiesRespectPreventOverlap(t *testing.T) {
+	state := game.NewState()
+	state.PreventOverlap = true
+	state.AddToken("g1", game.TokenData{Name: "Goblin", X: 0, Y: 0, GroupID: "warband"})
+	state.AddToken("wall", game.TokenData{Name: "Wall", X: 96, Y: 0})
+
+	ctx := testContext(&state)
+	processCommand(makeCommand(t, "move_group", game.MoveGroupPayload{GroupID: "warband", OffsetX: 96}), ctx)
+	if len(ctx.replies) != 1 || ctx.replies[0].Type != "move_rejected" {
+		t.Errorf("expected a move_rejected reply, got %+v", ctx.replies)
+	}
+
+	_, err := processCommand(makeCommand(t, "duplicate_token", game.DuplicateTokenPayload{ID: "g1", OffsetX: 96}), testContext(&state))
+	if err == nil || len(state.DisplayedTokens) != 2 {
+		t.Errorf("expected a copy onto the wall's cell to be refused, got %v", err)
+	}
+}
+
+func TestDeltaForHidesHiddenTokensFromPlayers(t *testing.T) {
+	token := game.TokenData{Name: "Ogre", Hidden: true}
+	delta := &Delta{Kind: DeltaToken, ID: "ambush", Token: &token}
+
+	if got := deltaFor(delta, RoleGM); got != delta {
+		t.Errorf("GM should get the delta unchanged, got %+v", got)
+	}
+	if got := deltaFor(delta, RolePlayer); got.Kind != DeltaTokenDeleted || got.Token != nil {
+		t.Errorf("player should see the hidden token as deleted, got %+v", got)
+	}
+}
+
+func TestRollDiceEvent(t *testing.T) {
+	payload, _ := json.Marshal(game.RollDicePayload{Notation: "3d1+2", Label: "attack"})
+
+	msg, err := eventHandlers["roll_dice"](NewManager(config.Default()), &Session{State: game.NewState()}, &ClientInfo{}, payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, ok := msg.Payload.(game.DiceResult)
+	if msg.Type != "dice_result" || !ok {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if result.Total != 5 || result.Modifier != 2 || len(result.Rolls) != 3 || result.Label != "attack" {
+		t.Errorf("unexpected dice result %+v", result)
+	}
+}
+
+func TestRollDiceEventSubtractedDice(t *testing.T) {
+	payload, _ := json.Marshal(game.RollDicePayload{Notation: "2d1-1d1+3"})
+
+	msg, err := eventHandlers["roll_dice"](NewManager(config.Default()), &Session{State: game.NewState()}, &ClientInfo{}, payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result := msg.Payload.(game.DiceResult); result.Total != 4 || result.Modifier != 3 {
+		t.Errorf("expected total 4 with modifier 3, got %+v", result)
+	}
+}
+
+func TestRollDiceEventInvalidNotation(t *testing.T) {
+	payload, _ := json.Marshal(game.RollDicePayload{Notation: "lots of dice"})
+
+	if _, err := eventHandlers["roll_dice"](NewManager(config.Default()), &Session{State: game.NewState()}, &ClientInfo{}, payload); err == nil {
+		t.Error("expected an error for invalid notation")
+	}
+}
+
+func TestProcessCommandRecordsLatency(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.metrics = metrics.NewRegistry()
+
+	processCommand(makeCommand(t, "toggle_grid", nil), ctx)
+	processCommand(makeCommand(t, "toggle_grid", nil), ctx)
+
+	snap, ok := ctx.metrics.Snapshot()[commandMetric("toggle_grid")]
+	if !ok {
+		t.Fatal("expected a histogram for toggle_grid")
+	}
+	if snap.Count != 2 {
+		t.Errorf("expected 2 samples, got %d", snap.Count)
+	}
+}
+
+func TestChatEvent(t *testing.T) {
+	payload, _ := json.Marshal(ChatPayload{Text: "hello table"})
+	sender := &ClientInfo{ID: "client-1", Role: RolePlayer}
+
+	msg, err := eventHandlers["chat"](NewManager(config.Default()), &Session{}, sender, payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	chat, ok := msg.Payload.(ChatMessage)
+	if msg.Type != "chat_message" || !ok {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if chat.ClientID != "client-1" || chat.Text != "hello table" || chat.Timestamp.IsZero() {
+		t.Errorf("unexpected chat message %+v", chat)
+	}
+}
+
+func TestChatEventDropsOversizedMessages(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxTextLength = 10
+	payload, _ := json.Marshal(ChatPayload{Text: "this is far too long"})
+
+	if _, err := eventHandlers["chat"](NewManager(cfg), &Session{}, &ClientInfo{}, payload); err == nil {
+		t.Error("expected oversized chat message to be rejected")
+	}
+}
+
+func TestChatEventWithoutLengthLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxTextLength = 0
+	payload, _ := json.Marshal(ChatPayload{Text: "any length goes"})
+
+	if _, err := eventHandlers["chat"](NewManager(cfg), &Session{}, &ClientInfo{}, payload); err != nil {
+		t.Errorf("expected a zero MaxTextLength to disable the limit, got %v", err)
+	}
+	if err := checkChatText(" ", 0); err == nil {
+		t.Error("expected a blank message to be rejected even without a limit")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	if err := authorize("kick", RolePlayer); !errors.Is(err, errForbidden) {
+		t.Errorf("expected kick to be forbidden for players, got %v", err)
+	}
+	if err := authorize("kick", RoleGM); err != nil {
+		t.Errorf("expected GM to kick, got %v", err)
+	}
+	if err := authorize("move_token", RolePlayer); err != nil {
+		t.Errorf("expected players to move tokens, got %v", err)
+	}
+}
+
+func TestPlayersCannotChangeTableSetup(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+	player := testContext(&state)
+	player.role = RolePlayer
+
+	for _, cmd := range []ClientMessage{
+		makeCommand(t, "add_fog", game.AddFogPayload{Region: game.FogRect{ID: "f1", W: 96, H: 96}}),
+		makeCommand(t, "remove_fog", game.RemoveFogPayload{ID: "f1"}),
+		makeCommand(t, "clear_fog", nil),
+		makeCommand(t, "toggle_grid", nil),
+		makeCommand(t, "set_snap", game.SetSnapPayload{Enabled: false}),
+		makeCommand(t, "set_snap_anchor", game.SetSnapAnchorPayload{Anchor: game.SnapAnchorCenter}),
+		makeCommand(t, "set_grid_type", game.SetGridTypePayload{GridType: game.GridIso}),
+		makeCommand(t, "set_grid_offset", game.SetGridOffsetPayload{X: 10, Y: 10}),
+		makeCommand(t, "set_prevent_overlap", game.SetPreventOverlapPayload{Enabled: true}),
+		makeCommand(t, "set_initiative", game.SetInitiativePayload{Entries: []game.InitiativeEntry{{TokenID: "t1"}}}),
+		makeCommand(t, "set_token_initiative", game.SetTokenInitiativePayload{TokenID: "t1", Value: 12}),
+		makeCommand(t, "next_turn", nil),
+		makeCommand(t, "set_round", game.SetRoundPayload{Round: 4}),
+		makeCommand(t, "clear_initiative", nil),
+	} {
+		before := state.Clone()
+		if _, err := processCommand(cmd, player); !errors.Is(err, errForbidden) {
+			t.Errorf("expected %s to be GM-only, got %v", cmd.Type, err)
+		}
+		if !reflect.DeepEqual(before, state) {
+			t.Errorf("expected a refused %s to leave the state alone", cmd.Type)
+		}
+	}
+}
+
+func TestMeasureEvent(t *testing.T) {
+	state := game.NewState()
+	state.GridUnit = 50
+	sender := &ClientInfo{ID: "client-1"}
+
+	for _, tc := range []struct {
+		diagonal string
+		cells    float64
+	}{
+		{"", 3},
+		{game.DiagonalChebyshev, 3},
+		{game.DiagonalEuclidean, math.Hypot(3, 2)},
+	} {
+		payload, _ := json.Marshal(MeasurePayload{X1: 0, Y1: 0, X2: 150, Y2: 100, Diagonal: tc.diagonal})
+
+		msg, err := eventHandlers["measure"](NewManager(config.Default()), &Session{State: state}, sender, payload)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tc.diagonal, err)
+		}
+
+		m, ok := msg.Payload.(Measurement)
+		if msg.Type != "measurement" || !ok {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+		if m.ClientID != "client-1" || m.Pixels != math.Hypot(150, 100) || m.Cells != tc.cells {
+			t.Errorf("%q: unexpected measurement %+v", tc.diagonal, m)
+		}
+	}
+}
+
+func TestMeasureEventRejectsUnknownDiagonalRule(t *testing.T) {
+	payload, _ := json.Marshal(MeasurePayload{X2: 100, Diagonal: "manhattan"})
+
+	if _, err := eventHandlers["measure"](NewManager(config.Default()), &Session{State: game.NewState()}, &ClientInfo{}, payload); err == nil {
+		t.Error("expected an error for an unknown diagonal rule")
+	}
+}
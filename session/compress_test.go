@@ -0,0 +1,67 @@
+package session
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/gofiber/contrib/websocket"
+
+	"quick-tabletop-engine/game"
+)
+
+func largeState() game.State {
+	state := game.NewState()
+	for i := 0; i < 200; i++ {
+		state.AddToken(fmt.Sprintf("token-%03d", i), game.TokenData{
+			Name:    fmt.Sprintf("Goblin %d", i),
+			ImgPath: "/assets/default/tokens/goblin.png",
+			X:       float64(i%20) * 96,
+			Y:       float64(i/20) * 96,
+			HP:      7,
+			MaxHP:   7,
+		})
+	}
+	return state
+}
+
+func TestEncodeStateGzip(t *testing.T) {
+	state := largeState()
+
+	plain, err := encodeState(state, jsonCodec{}, false)
+	if err != nil || plain.messageType != websocket.TextMessage {
+		t.Fatalf("expected a text frame, got %d (%v)", plain.messageType, err)
+	}
+	compressed, err := encodeState(state, jsonCodec{}, true)
+	if err != nil || compressed.messageType != websocket.BinaryMessage {
+		t.Fatalf("expected a binary frame, got %d (%v)", compressed.messageType, err)
+	}
+	if compressed.data[0] != frameGzipJSON {
+		t.Fatalf("expected the gzip prefix, got %d", compressed.data[0])
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed.data[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain.data) {
+		t.Error("expected the gzipped frame to hold the plain JSON")
+	}
+
+	t.Logf("200 tokens: %d bytes plain, %d bytes gzipped", len(plain.data), len(compressed.data))
+	if len(compressed.data)*4 > len(plain.data) {
+		t.Errorf("expected at least 4x compression, got %d of %d bytes", len(compressed.data), len(plain.data))
+	}
+
+	var msg ServerMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "state_update" {
+		t.Errorf("expected a state_update, got %q (%v)", msg.Type, err)
+	}
+}
@@ -0,0 +1,38 @@
+package session
+
+import (
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+)
+
+// startHeartbeat pings c every interval until stop is closed. Each pong
+// pushes the read deadline out again, so a peer that stops answering fails
+// its next read and goes through the normal HandleWS cleanup. The returned
+// channel is closed once the pinging goroutine has exited; HandleWS must
+// wait for it, since Fiber reuses the conn as soon as the handler returns.
+func startHeartbeat(c *websocket.Conn, interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	c.SetReadDeadline(time.Now().Add(2 * interval))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(2 * interval))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// WriteControl may run concurrently with the other writers.
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return done
+}
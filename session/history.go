@@ -0,0 +1,50 @@
+package session
+
+import "quick-tabletop-engine/game"
+
+// history is a bounded undo/redo stack of previous game states. Once depth
+// states are stored, recording another drops the oldest.
+type history struct {
+	depth int
+	undo  []game.State
+	redo  []game.State
+}
+
+func newHistory(depth int) *history {
+	return &history{depth: depth}
+}
+
+// record saves state as the latest undo point. Any redo states are discarded
+// since they no longer follow from the current state.
+func (h *history) record(state game.State) {
+	if h.depth <= 0 {
+		return
+	}
+	if len(h.undo) == h.depth {
+		h.undo = h.undo[1:]
+	}
+	h.undo = append(h.undo, state.Clone())
+	h.redo = nil
+}
+
+// stepBack returns the previous state and remembers current for redo.
+func (h *history) stepBack(current game.State) (game.State, bool) {
+	if len(h.undo) == 0 {
+		return current, false
+	}
+	prev := h.undo[len(h.undo)-1]
+	h.undo = h.undo[:len(h.undo)-1]
+	h.redo = append(h.redo, current.Clone())
+	return prev, true
+}
+
+// stepForward re-applies the most recently undone state.
+func (h *history) stepForward(current game.State) (game.State, bool) {
+	if len(h.redo) == 0 {
+		return current, false
+	}
+	next := h.redo[len(h.redo)-1]
+	h.redo = h.redo[:len(h.redo)-1]
+	h.undo = append(h.undo, current.Clone())
+	return next, true
+}
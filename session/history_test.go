@@ -0,0 +1,108 @@
+package session
+
+import (
+	"testing"
+
+	"quick-tabletop-engine/game"
+)
+
+func TestHistoryUndoRedo(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.history = newHistory(20)
+
+	processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin"}}), ctx)
+	processCommand(makeCommand(t, "delete_token", game.DeleteTokenPayload{ID: "t1"}), ctx)
+
+	processCommand(makeCommand(t, "undo", nil), ctx)
+	if _, ok := state.DisplayedTokens["t1"]; !ok {
+		t.Fatal("undo should restore the deleted token")
+	}
+
+	processCommand(makeCommand(t, "redo", nil), ctx)
+	if _, ok := state.DisplayedTokens["t1"]; ok {
+		t.Fatal("redo should delete the token again")
+	}
+}
+
+func TestHistoryPlayersCannotUndo(t *testing.T) {
+	state := game.NewState()
+	gm := testContext(&state)
+	gm.history = newHistory(20)
+	player := testContext(&state)
+	player.role = RolePlayer
+	player.history = gm.history
+
+	processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: "ogre", Token: game.TokenData{Name: "Ogre"}}), gm)
+	processCommand(makeCommand(t, "set_token_hidden", game.SetTokenHiddenPayload{ID: "ogre", Hidden: true}), gm)
+
+	for _, msgType := range []string{"undo", "redo"} {
+		if _, err := processCommand(makeCommand(t, msgType, nil), player); err == nil {
+			t.Errorf("expected %s to be refused for players", msgType)
+		}
+	}
+	if !state.DisplayedTokens["ogre"].Hidden {
+		t.Error("a player's undo must not reveal the hidden token")
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	h := newHistory(2)
+	for i := 0; i < 5; i++ {
+		h.record(game.NewState())
+	}
+
+	if len(h.undo) != 2 {
+		t.Errorf("expected 2 undo states, got %d", len(h.undo))
+	}
+}
+
+func TestHistoryNewCommandClearsRedo(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.history = newHistory(20)
+
+	processCommand(makeCommand(t, "toggle_grid", nil), ctx)
+	processCommand(makeCommand(t, "undo", nil), ctx)
+	processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin"}}), ctx)
+	processCommand(makeCommand(t, "redo", nil), ctx)
+
+	if !state.ShowGrid {
+		t.Error("redo after a new command should do nothing")
+	}
+	if _, ok := state.DisplayedTokens["t1"]; !ok {
+		t.Error("redo after a new command should keep the new token")
+	}
+}
+
+func TestHistoryUndoWithNothingRecorded(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.history = newHistory(20)
+
+	processCommand(makeCommand(t, "undo", nil), ctx)
+
+	if !state.ShowGrid || len(state.DisplayedTokens) != 0 {
+		t.Error("undo with empty history should leave the state unchanged")
+	}
+}
+
+func TestHistoryIgnoresNoOps(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.history = newHistory(20)
+
+	processCommand(makeCommand(t, "toggle_grid", nil), ctx)
+	processCommand(makeCommand(t, "undo", nil), ctx)
+	if changed, err := processCommand(makeCommand(t, "clear_fog", nil), ctx); err != nil || changed {
+		t.Fatalf("expected clear_fog on an empty board to be a no-op, got changed=%v err=%v", changed, err)
+	}
+	processCommand(makeCommand(t, "redo", nil), ctx)
+
+	if state.ShowGrid {
+		t.Error("a no-op should neither clear redo nor take an undo step")
+	}
+	if len(ctx.history.undo) != 1 {
+		t.Errorf("expected 1 undo state, got %d", len(ctx.history.undo))
+	}
+}
@@ -0,0 +1,37 @@
+package session
+
+import "time"
+
+// rateLimiter is a token bucket allowing up to perSecond events per second,
+// with bursts of the same size. It is not safe for concurrent use: each
+// connection goroutine owns its limiters, so they go away with the client.
+type rateLimiter struct {
+	perSecond float64
+	tokens    float64
+	last      time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{
+		perSecond: float64(perSecond),
+		tokens:    float64(perSecond),
+	}
+}
+
+// allow reports whether an event at now fits in the budget, consuming a
+// token if so.
+func (l *rateLimiter) allow(now time.Time) bool {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.perSecond
+		if l.tokens > l.perSecond {
+			l.tokens = l.perSecond
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
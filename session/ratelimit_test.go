@@ -0,0 +1,35 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurstThenThrottles(t *testing.T) {
+	l := newRateLimiter(5)
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if !l.allow(now) {
+			t.Fatalf("event %d should be allowed", i)
+		}
+	}
+	if l.allow(now) {
+		t.Error("6th event in the same instant should be throttled")
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(5)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		l.allow(now)
+	}
+
+	if !l.allow(now.Add(200 * time.Millisecond)) {
+		t.Error("one token should refill after 200ms at 5/s")
+	}
+	if l.allow(now.Add(200 * time.Millisecond)) {
+		t.Error("only one token should have refilled")
+	}
+}
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// departedClient remembers a disconnected client so it can reclaim its
+// identity with a reconnection token until the window closes.
+type departedClient struct {
+	info  ClientInfo
+	until time.Time
+}
+
+// reconnectToken signs the client's identity within the session. It holds no
+// expiry of its own: the window starts when the client disconnects.
+func reconnectToken(secret []byte, sessionID, clientID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(clientID)) + "." + signature(secret, sessionID, clientID)
+}
+
+// verifyReconnectToken returns the client ID token was issued to in
+// sessionID, or false if it is malformed or forged.
+func verifyReconnectToken(secret []byte, sessionID, token string) (string, bool) {
+	encodedID, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	clientID, err := base64.RawURLEncoding.DecodeString(encodedID)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, sessionID, string(clientID)))) {
+		return "", false
+	}
+	return string(clientID), true
+}
+
+func signature(secret []byte, sessionID, clientID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionID + "\x00" + clientID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// depart records a disconnected client for later reconnection.
+func (s *Session) depart(info ClientInfo, until time.Time) {
+	if s.departed == nil {
+		s.departed = make(map[string]departedClient)
+	}
+	s.departed[info.ID] = departedClient{info: info, until: until}
+}
+
+// reclaim hands back a departed client's identity if its window is still
+// open and nobody is connected under that ID.
+func (s *Session) reclaim(clientID string, now time.Time) (ClientInfo, bool) {
+	s.pruneDeparted(now)
+	departed, ok := s.departed[clientID]
+	if !ok {
+		return ClientInfo{}, false
+	}
+	if _, connected := s.findClient(clientID); connected != nil {
+		return ClientInfo{}, false
+	}
+	delete(s.departed, clientID)
+	// A spectator whose share link has since been revoked stays out.
+	if link := departed.info.shareLink; link != "" && !s.shareLinks[link] {
+		return ClientInfo{}, false
+	}
+	return departed.info, true
+}
+
+func (s *Session) pruneDeparted(now time.Time) {
+	for id, departed := range s.departed {
+		if now.After(departed.until) {
+			delete(s.departed, id)
+		}
+	}
+}
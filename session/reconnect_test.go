@@ -0,0 +1,64 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectTokenRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	token := reconnectToken(secret, "s1", "client-1")
+
+	if id, ok := verifyReconnectToken(secret, "s1", token); !ok || id != "client-1" {
+		t.Errorf("expected client-1, got %q (ok=%v)", id, ok)
+	}
+	if _, ok := verifyReconnectToken(secret, "s2", token); ok {
+		t.Error("token should not be valid in another session")
+	}
+	if _, ok := verifyReconnectToken([]byte("other"), "s1", token); ok {
+		t.Error("token should not verify with another secret")
+	}
+	forged := reconnectToken([]byte("guess"), "s1", "client-1")
+	if _, ok := verifyReconnectToken(secret, "s1", forged); ok {
+		t.Error("forged token should not verify")
+	}
+	if _, ok := verifyReconnectToken(secret, "s1", "garbage"); ok {
+		t.Error("malformed token should not verify")
+	}
+}
+
+func TestReclaimHonorsWindow(t *testing.T) {
+	now := time.Now()
+	s := &Session{ID: "s1"}
+	s.depart(ClientInfo{ID: "gm", Name: "Dungeon Master", Role: RoleGM}, now.Add(time.Minute))
+	s.depart(ClientInfo{ID: "late", Role: RolePlayer}, now.Add(-time.Second))
+
+	if !s.hasGM(now) {
+		t.Error("a departed GM within their window should keep the GM seat")
+	}
+	if _, ok := s.reclaim("late", now); ok {
+		t.Error("expected an expired departure to be gone")
+	}
+
+	info, ok := s.reclaim("gm", now)
+	if !ok || info.Name != "Dungeon Master" || info.Role != RoleGM {
+		t.Fatalf("expected the GM's identity back, got %+v (ok=%v)", info, ok)
+	}
+	if _, ok := s.reclaim("gm", now); ok {
+		t.Error("an identity should only be reclaimed once")
+	}
+}
+
+func TestReclaimRefusesRevokedShareLink(t *testing.T) {
+	now := time.Now()
+	s := &Session{ID: "s1", shareLinks: map[string]bool{"kept": true}}
+	s.depart(ClientInfo{ID: "viewer", Role: RoleSpectator, shareLink: "revoked"}, now.Add(time.Minute))
+	s.depart(ClientInfo{ID: "other", Role: RoleSpectator, shareLink: "kept"}, now.Add(time.Minute))
+
+	if _, ok := s.reclaim("viewer", now); ok {
+		t.Error("a spectator whose share link was revoked should not rejoin")
+	}
+	if _, ok := s.reclaim("other", now); !ok {
+		t.Error("a spectator with a live share link should rejoin")
+	}
+}
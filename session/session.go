@@ -1,11 +1,19 @@
 package session
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"quick-tabletop-engine/config"
 	"quick-tabletop-engine/game"
+	"quick-tabletop-engine/metrics"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
@@ -15,41 +23,370 @@ import (
 type ClientMessage struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+	// ReqID, when set, asks for an ack once the message has been processed,
+	// whether it is a command, a query or an event.
+	ReqID string `json:"reqId,omitempty"`
 }
 
+// Ack tells the sender whether its command with ReqID took effect. A valid
+// command that changed nothing, such as moving an unknown token, fails.
+type Ack struct {
+	ReqID string `json:"reqId"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ServerMessage is every message sent to clients. state_update and
+// state_delta carry the Hash of the recipient's view after the change, so a
+// client that computes a different hash knows it has drifted and should ask
+// for a full resync.
 type ServerMessage struct {
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload"`
+	Hash    string      `json:"hash,omitempty"`
+}
+
+// Delta kinds carried by state_delta messages.
+const (
+	DeltaToken        = "token"
+	DeltaTokenDeleted = "token_deleted"
+)
+
+// Delta describes a single changed entity. Clients that connect with
+// ?deltas=1 receive these as state_delta messages instead of a full
+// state_update after each command.
+type Delta struct {
+	Kind  string          `json:"kind"`
+	ID    string          `json:"id"`
+	Token *game.TokenData `json:"token,omitempty"`
+}
+
+type ChatPayload struct {
+	Text string `json:"text"`
+}
+
+// ChatMessage is broadcast for every chat line. Chat is ephemeral and never
+// stored in the game state. A whisper is Private and goes only to
+// ToClientID and back to its sender.
+type ChatMessage struct {
+	ClientID   string    `json:"clientId"`
+	Text       string    `json:"text"`
+	Timestamp  time.Time `json:"timestamp"`
+	Private    bool      `json:"private,omitempty"`
+	ToClientID string    `json:"toClientId,omitempty"`
+}
+
+// WhisperPayload is a private chat line for a single client.
+type WhisperPayload struct {
+	ToClientID string `json:"toClientId"`
+	Text       string `json:"text"`
+}
+
+type PingPayload struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Color string  `json:"color"`
+}
+
+// PingMessage highlights a map location for everyone; like chat it is never
+// stored in the game state.
+type PingMessage struct {
+	ClientID string  `json:"clientId"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Color    string  `json:"color"`
+}
+
+type MeasurePayload struct {
+	X1 float64 `json:"x1"`
+	Y1 float64 `json:"y1"`
+	X2 float64 `json:"x2"`
+	Y2 float64 `json:"y2"`
+	// Diagonal is game.DiagonalChebyshev (the default) or game.DiagonalEuclidean.
+	Diagonal string `json:"diagonal"`
+}
+
+// Measurement is a live ruler shown to everyone and, like pings, never
+// stored in the game state.
+type Measurement struct {
+	ClientID string  `json:"clientId"`
+	X1       float64 `json:"x1"`
+	Y1       float64 `json:"y1"`
+	X2       float64 `json:"x2"`
+	Y2       float64 `json:"y2"`
+	Diagonal string  `json:"diagonal"`
+	Pixels   float64 `json:"pixels"`
+	Cells    float64 `json:"cells"`
+}
+
+type SetNamePayload struct {
+	Name string `json:"name"`
+}
+
+// PresenceEntry describes one connected client. Spectator repeats what Role
+// says, for clients that only care whether someone can change the board.
+type PresenceEntry struct {
+	ClientID  string `json:"clientId"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Spectator bool   `json:"spectator"`
+}
+
+// PresenceUpdate lists everyone connected to the session, doubling as the
+// GM's roster. It is broadcast whenever a client joins, leaves or renames
+// itself.
+type PresenceUpdate struct {
+	Clients []PresenceEntry `json:"clients"`
+}
+
+// ErrorMessage tells a single client why its command was refused.
+type ErrorMessage struct {
+	Command string `json:"command"`
+	Message string `json:"message"`
+}
+
+// SessionMeta is a session's human-readable label: the body of POST
+// /session, the payload of rename_session and of the session_meta broadcast.
+type SessionMeta struct {
+	Name   string `json:"name"`
+	System string `json:"system"`
+}
+
+// PausedMessage is the payload of session_paused, broadcast when the GM
+// pauses or resumes the session and sent to clients joining while paused.
+type PausedMessage struct {
+	Paused bool `json:"paused"`
 }
 
+// PlayersCanAddTokensPayload is the payload of allow_player_tokens and
+// of the players_can_add_tokens message broadcast when it changes.
+type PlayersCanAddTokensPayload struct {
+	Allowed bool `json:"allowed"`
+}
+
+// MoveRejected is sent to a client whose move was refused because the cell
+// was taken; X and Y are where the token still is.
+type MoveRejected struct {
+	ID string  `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+}
+
+type KickPayload struct {
+	ClientID string `json:"clientId"`
+}
+
+// maxClientNameLength caps display names set with set_name.
+const maxClientNameLength = 40
+
+// maxPingsPerSecond limits how often a single connection may ping.
+const maxPingsPerSecond = 5
+
+// ProtocolVersion is reported to clients through the capabilities command
+// so they can feature-detect against the server they are connected to.
+const ProtocolVersion = "1"
+
+type Capabilities struct {
+	Commands []string               `json:"commands"`
+	Features map[string]interface{} `json:"features"`
+	Version  string                 `json:"version"`
+}
+
+// Client roles. The GM sees the full state, players get a filtered view.
+const (
+	RoleGM     = "gm"
+	RolePlayer = "player"
+	// RoleSpectator watches the session but can't change it.
+	RoleSpectator = "spectator"
+)
+
+// ClientInfo describes a connection within a session.
+type ClientInfo struct {
+	// ID is a stable identifier assigned when the client joins.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// Deltas is true when the client asked for state_delta messages.
+	Deltas bool `json:"deltas"`
+	// Compress is true when the client asked for gzipped state updates.
+	Compress bool `json:"compress"`
+	// codec is the wire format the client asked for with ?format=.
+	codec codec
+	// shareLink is the share token the client joined with, if any.
+	shareLink string
+	// removed is set when the client is disconnected on purpose, so its
+	// identity isn't held for a reconnection.
+	removed bool
+}
+
+// presenceEntry describes info in presence updates and join/leave messages.
+func (info *ClientInfo) presenceEntry() PresenceEntry {
+	return PresenceEntry{
+		ClientID:  info.ID,
+		Name:      info.Name,
+		Role:      info.Role,
+		Spectator: info.Role == RoleSpectator,
+	}
+}
+
+// Welcome is sent to a client right after it joins, before the initial state.
+type Welcome struct {
+	ClientID string `json:"clientId"`
+	Role     string `json:"role"`
+	// ReconnectToken lets the client rejoin as itself with ?reconnect= for
+	// a while after disconnecting.
+	ReconnectToken string `json:"reconnectToken"`
+}
+
+// Session is one table. Its mu guards every field but ID, so commands in
+// different sessions don't wait for each other.
 type Session struct {
+	mu sync.Mutex
+
 	ID      string
-	Clients map[*websocket.Conn]bool
+	Clients map[*websocket.Conn]*ClientInfo
 	State   game.State
+	history *history
+	// Meta names the session in lobbies; both fields may be empty.
+	Meta SessionMeta
+	// Paused freezes the board for everyone but the GM.
+	Paused bool
+	// PlayersCanAddTokens lets players place tokens of their own; the GM
+	// may turn it off. It starts on.
+	PlayersCanAddTokens bool
+	// shareLinks holds the live read-only share tokens.
+	shareLinks map[string]bool
+	// CreatedAt is when the session was created, for SessionTTLSec.
+	CreatedAt time.Time
+	// LastActivity is when a client last sent a real command; heartbeats
+	// and pings don't count.
+	LastActivity time.Time
+	// departed holds recently disconnected clients, by ID.
+	departed map[string]departedClient
+	// pendingBroadcast fires the coalesced state_update while
+	// BroadcastCoalesceMs is set; nil when nothing is waiting.
+	pendingBroadcast *time.Timer
+	// closed is set once the sweeper reaps the session, so a client that
+	// looked it up just before can't join it.
+	closed bool
+	// encodedState caches state_update frames by stateKey until the state
+	// next changes; see stateFrame.
+	encodedState map[string]frame
+}
+
+// setMeta stores meta trimmed and limited to max characters per field.
+func (s *Session) setMeta(meta SessionMeta, max int) {
+	s.Meta = SessionMeta{
+		Name:   truncate(strings.TrimSpace(meta.Name), max),
+		System: truncate(strings.TrimSpace(meta.System), max),
+	}
+}
+
+// presence builds the current roster, sorted by client ID.
+func (s *Session) presence() PresenceUpdate {
+	clients := make([]PresenceEntry, 0, len(s.Clients))
+	for _, info := range s.Clients {
+		clients = append(clients, info.presenceEntry())
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+	return PresenceUpdate{Clients: clients}
+}
+
+// clientName trims and caps name, falling back to a generated
+// "Player-<shortid>" when it is empty.
+func clientName(name, clientID string) string {
+	name = truncate(strings.TrimSpace(name), maxClientNameLength)
+	if name == "" {
+		return "Player-" + clientID[:min(8, len(clientID))]
+	}
+	return name
 }
 
+// findClient returns the connection and info for clientID, or nils if no
+// such client is connected.
+func (s *Session) findClient(clientID string) (*websocket.Conn, *ClientInfo) {
+	for conn, info := range s.Clients {
+		if info.ID == clientID {
+			return conn, info
+		}
+	}
+	return nil, nil
+}
+
+func (s *Session) spectators() int {
+	n := 0
+	for _, info := range s.Clients {
+		if info.Role == RoleSpectator {
+			n++
+		}
+	}
+	return n
+}
+
+// hasGM reports whether the session has a GM, counting a disconnected GM
+// whose reconnection window is still open so nobody takes their seat.
+func (s *Session) hasGM(now time.Time) bool {
+	for _, info := range s.Clients {
+		if info.Role == RoleGM {
+			return true
+		}
+	}
+	s.pruneDeparted(now)
+	for _, departed := range s.departed {
+		if departed.info.Role == RoleGM {
+			return true
+		}
+	}
+	return false
+}
+
+// Manager owns every live session. mu guards only the sessions map and the
+// config; each session's contents are guarded by its own lock. A session's
+// lock may be held while taking mu, never the other way round.
 type Manager struct {
-	sessions  map[string]*Session
-	mu       sync.Mutex
-	maxSessions int
+	sessions map[string]*Session
+	mu       sync.RWMutex
+	cfg      config.Config
+	metrics  *metrics.Registry
+	// secret signs reconnection tokens. It is regenerated on restart, which
+	// also discards every session.
+	secret []byte
 }
 
-func NewManager(maxSessions int) *Manager{
+func NewManager(cfg config.Config) *Manager {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
 	return &Manager{
 		sessions: make(map[string]*Session),
-		maxSessions: maxSessions,
+		cfg:      cfg,
+		metrics:  metrics.NewRegistry(),
+		secret:   secret,
 	}
 }
 
-func (m *Manager) Reset(){
-	m.sessions = make(map[string]*Session)}
-
-
-func (m *Manager) CreateSession(c *fiber.Ctx) error {
+func (m *Manager) Reset() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.sessions = make(map[string]*Session)
+}
 
-	if len(m.sessions) >= m.maxSessions {
+func (m *Manager) CreateSession(c *fiber.Ctx) error {
+	var meta SessionMeta
+	if len(c.Body()) > 0 {
+		if err := json.Unmarshal(c.Body(), &meta); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid session metadata: " + err.Error(),
+			})
+		}
+	}
+
+	m.mu.Lock()
+	if len(m.sessions) >= m.cfg.MaxSessions {
+		m.mu.Unlock()
 		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
 			"error": "maximum number of sessions reached",
 		})
@@ -57,24 +394,41 @@ func (m *Manager) CreateSession(c *fiber.Ctx) error {
 
 	id := uuid.NewString()
 
-	m.sessions[id] = &Session{
+	session := &Session{
 		ID:      id,
-		Clients: make(map[*websocket.Conn]bool),
-		State:   game.NewState(),
+		Clients: make(map[*websocket.Conn]*ClientInfo),
+		State:   game.NewStateWithDefaults(m.cfg.DefaultBackground, m.cfg.DefaultGridUnit),
+		history: newHistory(m.cfg.UndoDepth),
+
+		CreatedAt:    time.Now(),
+		LastActivity: time.Now(),
+
+		PlayersCanAddTokens: true,
 	}
+	// Set up before publishing, so nothing else can see it half-built.
+	session.setMeta(meta, m.cfg.MaxSessionNameLength)
+	meta = session.Meta
+	m.sessions[id] = session
+	m.mu.Unlock()
 
 	log.Println("session created:", id)
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"sessionId": id,
+		"name":      meta.Name,
+		"system":    meta.System,
 	})
 }
 
 func (m *Manager) GetSession(c *fiber.Ctx) error {
 	id := c.Params("id")
-	m.mu.Lock()
-	_, ok := m.sessions[id]
-	m.mu.Unlock()
+	session, ok := m.lookup(id)
+	var meta SessionMeta
+	if ok {
+		session.mu.Lock()
+		meta = session.Meta
+		session.mu.Unlock()
+	}
 
 	if !ok {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -84,113 +438,782 @@ func (m *Manager) GetSession(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{
 		"sessionId": id,
+		"name":      meta.Name,
+		"system":    meta.System,
 	})
 }
 
+// GetSessionAssets lists the images on the session's board so clients can
+// preload them. It is open to anyone who knows the session ID, like joining,
+// so it lists only what players can see: images of hidden tokens are left
+// out.
+func (m *Manager) GetSessionAssets(c *fiber.Ctx) error {
+	id := c.Params("id")
+	session, ok := m.lookup(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "session not found",
+		})
+	}
 
-//WS handler
-func (m *Manager) HandleWS(c *websocket.Conn){
-		sessionId := c.Params("sessionId")
-		m.mu.Lock()
-		session, ok := m.sessions[sessionId]
-		if !ok {
+	session.mu.Lock()
+	paths := session.State.PlayerView().ImagePaths()
+	session.mu.Unlock()
+
+	return c.JSON(fiber.Map{
+		"sessionId": id,
+		"images":    paths,
+	})
+}
+
+// StartSweeper closes and deletes sessions that have been idle for longer
+// than the configured timeout or have outlived the session TTL, checking
+// periodically until stop is closed. The limits are re-read on every check,
+// so UpdateConfig takes effect.
+func (m *Manager) StartSweeper(stop <-chan struct{}) {
+	go func() {
+		timer := time.NewTimer(m.sweepInterval())
+		defer timer.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-timer.C:
+				m.sweep(now)
+				timer.Reset(m.sweepInterval())
+			}
+		}
+	}()
+}
+
+// sweepInterval checks ten times per idle timeout or TTL, whichever is
+// shorter, and once a minute while both are disabled in case one gets
+// enabled.
+func (m *Manager) sweepInterval() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	interval := time.Minute
+	for _, sec := range []int{m.cfg.IdleTimeoutSec, m.cfg.SessionTTLSec} {
+		if sec > 0 {
+			interval = min(interval, time.Duration(sec)*time.Second/10)
+		}
+	}
+	return max(interval, time.Second)
+}
+
+// sweep deletes sessions created more than the TTL before now, telling
+// their clients first, and sessions whose last activity is more than the
+// idle timeout before now.
+func (m *Manager) sweep(now time.Time) {
+	cfg := m.config()
+	ttl := time.Duration(cfg.SessionTTLSec) * time.Second
+	timeout := time.Duration(cfg.IdleTimeoutSec) * time.Second
+	for _, session := range m.allSessions() {
+		if session.reap(now, ttl, timeout) {
+			m.mu.Lock()
+			delete(m.sessions, session.ID)
 			m.mu.Unlock()
+		}
+	}
+}
+
+// reap closes the session if it has outlived ttl or been idle for longer
+// than timeout, disconnecting its clients, and reports whether it did. A
+// zero limit is never reached. The check and the close happen under the
+// session's lock, so a session is only ever reaped once.
+func (s *Session) reap(now time.Time, ttl, timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.closed:
+		return false
+	case ttl > 0 && now.Sub(s.CreatedAt) > ttl:
+		broadcastMessage(s, ServerMessage{Type: "session_expired"})
+		for conn := range s.Clients {
+			disconnect(conn, websocket.CloseGoingAway, "session expired")
+		}
+		log.Printf("session %s expired, created at %s\n", s.ID, s.CreatedAt.Format(time.RFC3339))
+	case timeout > 0 && now.Sub(s.LastActivity) > timeout:
+		for conn := range s.Clients {
+			disconnect(conn, websocket.CloseGoingAway, "session idle")
+		}
+		log.Printf("session %s closed after being idle since %s\n", s.ID, s.LastActivity.Format(time.RFC3339))
+	default:
+		return false
+	}
+	if s.pendingBroadcast != nil {
+		s.pendingBroadcast.Stop()
+	}
+	s.closed = true
+	return true
+}
+
+// lookup returns the session with the given ID.
+func (m *Manager) lookup(id string) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	session, ok := m.sessions[id]
+	return session, ok
+}
+
+// allSessions lists the live sessions, for callers that go on to lock each
+// one without holding m.mu.
+func (m *Manager) allSessions() []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// UpdateConfig applies a reloaded config to the running manager. Limits
+// checked per command apply immediately; per-connection settings such as
+// the heartbeat and command rate apply to clients that join afterwards, and
+// UndoDepth to sessions created afterwards.
+func (m *Manager) UpdateConfig(cfg config.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+}
+
+// config returns the current settings.
+func (m *Manager) config() config.Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg
+}
+
+// OriginAllowed reports whether the current settings accept a WebSocket
+// upgrade from origin, so reloaded AllowedOrigins apply straight away.
+func (m *Manager) OriginAllowed(origin string) bool {
+	return m.config().OriginAllowed(origin)
+}
+
+// Shutdown disconnects every client so their HandleWS goroutines finish
+// before the server stops.
+func (m *Manager) Shutdown() {
+	for _, session := range m.allSessions() {
+		session.mu.Lock()
+		for conn := range session.Clients {
+			disconnect(conn, websocket.CloseGoingAway, "server shutting down")
+		}
+		session.mu.Unlock()
+	}
+}
+
+// isAdmin reports whether the request carries the configured admin token.
+func (m *Manager) isAdmin(c *fiber.Ctx) bool {
+	adminToken := m.config().AdminToken
+	if adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// isSessionGM reports whether the request's bearer token is the reconnection
+// token of the session's connected GM. The caller holds session.mu.
+func (m *Manager) isSessionGM(c *fiber.Ctx, session *Session) bool {
+	bearer, _ := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	clientID, ok := verifyReconnectToken(m.secret, session.ID, bearer)
+	if !ok {
+		return false
+	}
+	_, info := session.findClient(clientID)
+	return info != nil && info.Role == RoleGM
+}
+
+// ExportSession downloads a session's full live state as a JSON file. Like
+// the debug dump it includes GM-only content, so it requires the admin token
+// or the session's GM's reconnection token.
+func (m *Manager) ExportSession(c *fiber.Ctx) error {
+	id := c.Params("id")
+	session, ok := m.lookup(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "session not found",
+		})
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !m.isAdmin(c) && !m.isSessionGM(c, session) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "forbidden",
+		})
+	}
+
+	c.Attachment("session-" + id + ".json")
+	return c.JSON(session.State)
+}
+
+// ImportSession replaces a session's state with the game.State JSON in the
+// request body, e.g. a prepared encounter or an earlier export, and pushes it
+// to every client. The previous state can be restored with undo. Like export
+// it requires the admin token or the session's GM's reconnection token.
+func (m *Manager) ImportSession(c *fiber.Ctx) error {
+	id := c.Params("id")
+	session, ok := m.lookup(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "session not found",
+		})
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !m.isAdmin(c) && !m.isSessionGM(c, session) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "forbidden",
+		})
+	}
+
+	var state game.State
+	if err := json.Unmarshal(c.Body(), &state); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid state: " + err.Error(),
+		})
+	}
+	if err := state.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid state: " + err.Error(),
+		})
+	}
+
+	if session.history != nil {
+		session.history.record(session.State)
+	}
+	session.State = state
+	session.stateChanged()
+	session.LastActivity = time.Now()
+	broadcastState(session)
+	log.Println("state imported into session:", id)
+
+	return c.JSON(fiber.Map{
+		"sessionId": id,
+	})
+}
+
+// DebugSession dumps a session's full in-memory state, unfiltered by role,
+// for support. It requires DebugEnabled and the admin token.
+func (m *Manager) DebugSession(c *fiber.Ctx) error {
+	if !m.config().DebugEnabled {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "not found",
+		})
+	}
+	if !m.isAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "forbidden",
+		})
+	}
+
+	id := c.Params("id")
+	session, ok := m.lookup(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "session not found",
+		})
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	clients := make([]ClientInfo, 0, len(session.Clients))
+	for _, info := range session.Clients {
+		clients = append(clients, *info)
+	}
+	return c.JSON(fiber.Map{
+		"sessionId":   session.ID,
+		"name":        session.Meta.Name,
+		"system":      session.Meta.System,
+		"paused":      session.Paused,
+		"createdAt":   session.CreatedAt,
+		"clientCount": len(clients),
+		"clients":     clients,
+		"state":       session.State,
+	})
+}
+
+// GetMetrics reports per-command processing latency histograms.
+func (m *Manager) GetMetrics(c *fiber.Ctx) error {
+	return c.JSON(m.metrics.Snapshot())
+}
+
+// capabilities describes the protocol options and limits clients can rely
+// on, as currently configured. Limits of 0 mean no limit.
+func (m *Manager) capabilities() Capabilities {
+	cfg := m.config()
+	formats := make([]string, len(codecs))
+	for i, cd := range codecs {
+		formats[i] = cd.name()
+	}
+	return Capabilities{
+		Commands: commandTypes(),
+		Features: map[string]interface{}{
+			"formats":             formats,
+			"deltas":              true,
+			"gzip":                true,
+			"undo":                cfg.UndoDepth > 0,
+			"undoDepth":           cfg.UndoDepth,
+			"reconnect":           cfg.ReconnectWindowSec > 0,
+			"reconnectWindowSec":  cfg.ReconnectWindowSec,
+			"heartbeatSec":        cfg.HeartbeatSec,
+			"maxSessions":         cfg.MaxSessions,
+			"maxSpectators":       cfg.MaxSpectators,
+			"maxTokensPerSession": cfg.MaxTokensPerSession,
+			"maxNameLength":       cfg.MaxNameLength,
+			"maxTextLength":       cfg.MaxTextLength,
+			"maxCommandsPerSec":   cfg.MaxCommandsPerSec,
+			"maxUploadBytes":      cfg.MaxUploadBytes,
+			"maxDice":             game.MaxDice,
+			"maxDrawingPoints":    game.MaxDrawingPoints,
+		},
+		Version: ProtocolVersion,
+	}
+}
+
+// WS handler
+func (m *Manager) HandleWS(c *websocket.Conn) {
+	sessionId := c.Params("sessionId")
+	cd, err := codecFor(c.Query("format"))
+	if err != nil {
+		log.Println("refusing connection:", err)
+		c.Close()
+		return
+	}
+
+	cfg := m.config()
+	session, ok := m.lookup(sessionId)
+	if !ok {
+		c.Close()
+		return
+	}
+	session.mu.Lock()
+	if session.closed {
+		session.mu.Unlock()
+		c.Close()
+		return
+	}
+
+	// A client with a valid reconnection token gets its identity back.
+	// Otherwise the first client to join a session without a GM becomes its GM.
+	now := time.Now()
+	info := &ClientInfo{
+		ID:       uuid.NewString(),
+		Role:     RolePlayer,
+		Deltas:   c.Query("deltas") == "1",
+		Compress: c.Query("compress") == "gzip",
+		codec:    cd,
+	}
+	info.Name = clientName("", info.ID)
+
+	// A share link always joins as a spectator, whatever else is asked for.
+	share := c.Query("share")
+	if share != "" && !session.shareLinks[share] {
+		session.mu.Unlock()
+		log.Printf("refusing unknown share link for session %s\n", sessionId)
+		c.Close()
+		return
+	}
+
+	reclaimed := false
+	if clientID, ok := verifyReconnectToken(m.secret, sessionId, c.Query("reconnect")); ok && share == "" {
+		var prior ClientInfo
+		if prior, reclaimed = session.reclaim(clientID, now); reclaimed {
+			prior.Deltas = info.Deltas
+			prior.Compress = info.Compress
+			prior.codec = info.codec
+			info = &prior
+		}
+	}
+	switch {
+	case reclaimed:
+	case share != "" || c.Query("mode") == "spectator":
+		if cfg.MaxSpectators > 0 && session.spectators() >= cfg.MaxSpectators {
+			session.mu.Unlock()
+			log.Printf("session %s is full of spectators, refusing %s\n", sessionId, info.ID)
 			c.Close()
 			return
 		}
+		info.Role = RoleSpectator
+		info.shareLink = share
+	case !session.hasGM(now):
+		info.Role = RoleGM
+	}
+	session.Clients[c] = info
+	log.Printf("client %s joined session %s as %s (%d connected)\n", info.ID, sessionId, info.Role, len(session.Clients))
 
-		session.Clients[c] = true
-		log.Printf("client joined session %s (%d connected)\n", sessionId, len(session.Clients))
+	sendMessage(c, cd, ServerMessage{Type: "welcome", Payload: Welcome{
+		ClientID:       info.ID,
+		Role:           info.Role,
+		ReconnectToken: reconnectToken(m.secret, sessionId, info.ID),
+	}})
+	// Send current state to the new client (late-joiner sync)
+	sendState(c, session, info)
+	if session.Paused {
+		sendMessage(c, cd, ServerMessage{Type: "session_paused", Payload: PausedMessage{Paused: true}})
+	}
+	if !session.PlayersCanAddTokens {
+		sendMessage(c, cd, ServerMessage{Type: "players_can_add_tokens", Payload: PlayersCanAddTokensPayload{Allowed: false}})
+	}
+	broadcastMessageExcept(session, c, ServerMessage{Type: "client_joined", Payload: info.presenceEntry()})
+	broadcastMessage(session, ServerMessage{Type: "presence_update", Payload: session.presence()})
+	session.mu.Unlock()
 
-		// Send current state to the new client (late-joiner sync)
-		sendState(c, session.State)
-		m.mu.Unlock()
+	// Runs exactly once per connection, however it ends.
+	defer func() {
+		c.Close()
+		session.mu.Lock()
+		delete(session.Clients, c)
+		if window := time.Duration(m.config().ReconnectWindowSec) * time.Second; window > 0 && !info.removed {
+			session.depart(*info, time.Now().Add(window))
+		}
+		broadcastMessage(session, ServerMessage{Type: "client_left", Payload: info.presenceEntry()})
+		broadcastMessage(session, ServerMessage{Type: "presence_update", Payload: session.presence()})
+		session.mu.Unlock()
+	}()
 
+	if cfg.HeartbeatSec > 0 {
+		stop := make(chan struct{})
+		done := startHeartbeat(c, time.Duration(cfg.HeartbeatSec)*time.Second, stop)
 		defer func() {
-			c.Close()
-			m.mu.Lock()
-			delete(session.Clients, c)
-			m.mu.Unlock()
+			close(stop)
+			<-done
 		}()
+	}
 
-		for {
-			_, msg, err := c.ReadMessage()
+	pingLimiter := newRateLimiter(maxPingsPerSecond)
+	var commandLimiter *rateLimiter
+	if cfg.MaxCommandsPerSec > 0 {
+		commandLimiter = newRateLimiter(cfg.MaxCommandsPerSec)
+	}
+	var lastThrottleWarning time.Time
+
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			log.Println("read:", err)
+			break
+		}
+
+		clientMsg, err := cd.decode(msg)
+		if err != nil {
+			log.Println("invalid message:", err)
+			continue
+		}
+
+		// The limit covers every kind of message, queries included.
+		if now := time.Now(); commandLimiter != nil && !commandLimiter.allow(now) {
+			if now.Sub(lastThrottleWarning) >= time.Second {
+				log.Printf("warning: client %s is sending too many commands, dropping\n", info.ID)
+				lastThrottleWarning = now
+			}
+			continue
+		}
+
+		// Every write to a connection happens under the session's lock, since
+		// broadcasts from other clients' goroutines write to it too.
+		if query, ok := queryHandlers[clientMsg.Type]; ok {
+			session.mu.Lock()
+			reply, err := query(m, session, info, clientMsg.Payload)
 			if err != nil {
-				log.Println("read:", err)
-				break
+				log.Printf("invalid %s query: %v\n", clientMsg.Type, err)
+				sendError(c, cd, clientMsg.Type, err)
+			} else {
+				sendMessage(c, cd, reply)
 			}
+			sendAck(c, cd, clientMsg.ReqID, err)
+			session.mu.Unlock()
+			continue
+		}
 
-			var clientMsg ClientMessage
-			if err := json.Unmarshal(msg, &clientMsg); err != nil {
-				log.Println("invalid message:", err)
-				continue
+		if control, ok := controlHandlers[clientMsg.Type]; ok {
+			session.mu.Lock()
+			session.LastActivity = time.Now()
+			err := authorize(clientMsg.Type, info.Role)
+			if err == nil {
+				err = control(m, session, info, clientMsg.Payload)
+			}
+			if err != nil {
+				log.Printf("invalid %s command: %v\n", clientMsg.Type, err)
+				sendError(c, cd, clientMsg.Type, err)
 			}
+			sendAck(c, cd, clientMsg.ReqID, err)
+			session.mu.Unlock()
+			continue
+		}
 
-			m.mu.Lock()
-			processCommand(clientMsg, &session.State)
-			broadcastState(session)
-			m.mu.Unlock()
+		if clientMsg.Type == "ping" && !pingLimiter.allow(time.Now()) {
+			continue
 		}
+
+		if event, ok := eventHandlers[clientMsg.Type]; ok {
+			session.mu.Lock()
+			if clientMsg.Type != "ping" {
+				session.LastActivity = time.Now()
+			}
+			var msg ServerMessage
+			err := authorize(clientMsg.Type, info.Role)
+			if err == nil {
+				msg, err = event(m, session, info, clientMsg.Payload)
+			}
+			if err != nil {
+				log.Printf("warning: dropping %s: %v\n", clientMsg.Type, err)
+				sendError(c, cd, clientMsg.Type, err)
+			} else {
+				broadcastMessage(session, msg)
+			}
+			sendAck(c, cd, clientMsg.ReqID, err)
+			session.mu.Unlock()
+			continue
+		}
+
+		m.runCommand(session, c, info, clientMsg)
 	}
+}
+
+// runCommand applies a state-changing command from the client on c, then
+// broadcasts the change and answers the sender.
+func (m *Manager) runCommand(session *Session, c *websocket.Conn, info *ClientInfo, clientMsg ClientMessage) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.LastActivity = time.Now()
+	ctx := &commandContext{
+		role:    info.Role,
+		paused:  session.Paused,
+		state:   &session.State,
+		cfg:     m.config(),
+		history: session.history,
+		metrics: m.metrics,
 
-func processCommand(msg ClientMessage, state *game.State) {
-	switch msg.Type {
-	case "add_token":
-		var p game.AddTokenPayload
-		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			state.AddToken(p.ID, p.Token)
+		playersCanAddTokens: session.PlayersCanAddTokens,
+	}
+	changed, err := processCommand(clientMsg, ctx)
+	if changed {
+		session.stateChanged()
+	}
+	switch {
+	case err != nil:
+		log.Println(err)
+		sendError(c, info.codec, clientMsg.Type, err)
+	default:
+		m.queueBroadcast(session, ctx.delta)
+		if !changed {
+			err = errors.New("command had no effect")
 		}
-	case "move_token":
-		var p game.MoveTokenPayload
-		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			state.MoveToken(p.ID, p.X, p.Y)
+	}
+	for _, reply := range ctx.replies {
+		sendMessage(c, info.codec, reply)
+	}
+	sendAck(c, info.codec, clientMsg.ReqID, err)
+}
+
+// queueBroadcast sends the outcome of a command. With BroadcastCoalesceMs
+// set it instead schedules one full state_update for the end of the window,
+// so a burst of commands such as a token drag costs a single broadcast of
+// whatever the state is by then. Delta clients get that state_update too.
+// The session's lock must be held.
+func (m *Manager) queueBroadcast(session *Session, delta *Delta) {
+	window := time.Duration(m.config().BroadcastCoalesceMs) * time.Millisecond
+	if window <= 0 {
+		broadcastChange(session, delta)
+		return
+	}
+	if session.pendingBroadcast != nil {
+		return
+	}
+	session.pendingBroadcast = time.AfterFunc(window, func() {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		session.pendingBroadcast = nil
+		broadcastState(session)
+	})
+}
+
+// viewFor returns the part of state a client with the given role may see.
+func viewFor(state game.State, role string) game.State {
+	if role == RoleGM {
+		return state
+	}
+	return state.PlayerView()
+}
+
+// broadcastState sends every client the state filtered for its role,
+// encoding each distinct view only once.
+func broadcastState(session *Session) {
+	for client, info := range session.Clients {
+		f, err := session.stateFrame(info)
+		if err != nil {
+			log.Println("failed to marshal state:", err)
+			return
 		}
-	case "delete_token":
-		var p game.DeleteTokenPayload
-		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			state.DeleteToken(p.ID)
+		client.WriteMessage(f.messageType, f.data)
+	}
+}
+
+// stateFrame returns the state_update for a client like info. Encodings are
+// cached until stateChanged, so a burst of late joiners or a broadcast
+// followed by joins encodes each view once.
+func (s *Session) stateFrame(info *ClientInfo) (frame, error) {
+	key := stateKey(info)
+	if f, ok := s.encodedState[key]; ok {
+		return f, nil
+	}
+	f, err := encodeState(viewFor(s.State, info.Role), info.codec, info.Compress)
+	if err != nil {
+		return f, err
+	}
+	if s.encodedState == nil {
+		s.encodedState = make(map[string]frame)
+	}
+	s.encodedState[key] = f
+	return f, nil
+}
+
+// stateChanged drops the cached encodings. Everything that changes State
+// must call it.
+func (s *Session) stateChanged() {
+	s.encodedState = nil
+}
+
+// stateKey identifies the state_update encoding a client receives.
+func stateKey(info *ClientInfo) string {
+	key := "state_update/" + info.codec.name() + "/" + info.Role
+	if info.Compress {
+		key += "/gzip"
+	}
+	return key
+}
+
+// broadcastChange sends delta to clients that opted into deltas and the
+// full state to everyone else. A nil delta falls back to broadcastState.
+func broadcastChange(session *Session, delta *Delta) {
+	if delta == nil {
+		broadcastState(session)
+		return
+	}
+
+	// Each distinct message is encoded once, keyed by kind and role, and each
+	// role's view is hashed once.
+	encoded := make(map[string]frame)
+	hashes := make(map[string]string)
+	for client, info := range session.Clients {
+		key := stateKey(info)
+		if info.Deltas {
+			key = "state_delta/" + info.codec.name() + "/" + info.Role
 		}
-	case "clear_tokens":
-		state.ClearTokens()
-	case "change_background":
-		var p game.ChangeBackgroundPayload
-		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			state.ChangeBackgroundImg(p.ImgPath)
+
+		f, ok := encoded[key]
+		if !ok {
+			var err error
+			if info.Deltas {
+				hash, ok := hashes[info.Role]
+				if !ok {
+					hash = viewFor(session.State, info.Role).Hash()
+					hashes[info.Role] = hash
+				}
+				f, err = info.codec.encode(ServerMessage{Type: "state_delta", Payload: deltaFor(delta, info.Role), Hash: hash})
+			} else {
+				f, err = session.stateFrame(info)
+			}
+			if err != nil {
+				log.Printf("failed to marshal %s: %v\n", key, err)
+				return
+			}
+			encoded[key] = f
 		}
-	case "toggle_grid":
-		state.ToggleGrid()
-	default:
-		log.Println("unknown message type:", msg.Type)
+		client.WriteMessage(f.messageType, f.data)
 	}
 }
 
+// deltaFor filters delta for role. A token hidden from players is reported
+// to them as deleted, since it may have been visible until now.
+func deltaFor(delta *Delta, role string) *Delta {
+	if role == RoleGM || delta.Kind != DeltaToken {
+		return delta
+	}
+	if delta.Token.Hidden {
+		return &Delta{Kind: DeltaTokenDeleted, ID: delta.ID}
+	}
+	token := delta.Token.ForPlayers()
+	return &Delta{Kind: delta.Kind, ID: delta.ID, Token: &token}
+}
 
+// broadcastMessage sends msg unchanged to every client in the session.
+func broadcastMessage(session *Session, msg ServerMessage) {
+	broadcastMessageExcept(session, nil, msg)
+}
 
-
-func broadcastState(session *Session) {
-	msg := ServerMessage{
-		Type:    "state_update",
-		Payload: session.State,
+// broadcastMessageExcept sends msg to every client but except, encoding it
+// once per wire format.
+func broadcastMessageExcept(session *Session, except *websocket.Conn, msg ServerMessage) {
+	encoded := make(map[string]frame)
+	for client, info := range session.Clients {
+		if client == except {
+			continue
+		}
+		f, ok := encoded[info.codec.name()]
+		if !ok {
+			var err error
+			if f, err = info.codec.encode(msg); err != nil {
+				log.Printf("failed to marshal %s: %v\n", msg.Type, err)
+				return
+			}
+			encoded[info.codec.name()] = f
+		}
+		client.WriteMessage(f.messageType, f.data)
 	}
-	data, err := json.Marshal(msg)
+}
+
+// sendState sends the client on c, described by info, its view of the
+// session's state.
+func sendState(c *websocket.Conn, session *Session, info *ClientInfo) {
+	f, err := session.stateFrame(info)
 	if err != nil {
 		log.Println("failed to marshal state:", err)
 		return
 	}
-	for client := range session.Clients {
-		client.WriteMessage(websocket.TextMessage, data)
-	}
+	c.WriteMessage(f.messageType, f.data)
+}
+
+// disconnect ends another goroutine's connection. Closing a hijacked Fiber
+// conn is a no-op until its handler returns, so instead send a close frame
+// and expire the read deadline: the pending read fails and HandleWS cleans up.
+func disconnect(c *websocket.Conn, code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.SetReadDeadline(time.Now())
 }
 
-func sendState(c *websocket.Conn, state game.State) {
-	msg := ServerMessage{
-		Type:    "state_update",
-		Payload: state,
+// sendAck answers a command that carried a reqId; err is its outcome.
+func sendAck(c *websocket.Conn, cd codec, reqID string, err error) {
+	if reqID == "" {
+		return
 	}
-	data, err := json.Marshal(msg)
+	ack := Ack{ReqID: reqID, OK: err == nil}
 	if err != nil {
-		log.Println("failed to marshal state:", err)
+		ack.Error = err.Error()
+	}
+	sendMessage(c, cd, ServerMessage{Type: "ack", Payload: ack})
+}
+
+func sendError(c *websocket.Conn, cd codec, command string, err error) {
+	sendMessage(c, cd, ServerMessage{
+		Type:    "error",
+		Payload: ErrorMessage{Command: command, Message: err.Error()},
+	})
+}
+
+func sendMessage(c *websocket.Conn, cd codec, msg ServerMessage) {
+	f, err := cd.encode(msg)
+	if err != nil {
+		log.Printf("failed to marshal %s: %v\n", msg.Type, err)
 		return
 	}
-	c.WriteMessage(websocket.TextMessage, data)
+	c.WriteMessage(f.messageType, f.data)
 }
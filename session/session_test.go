@@ -1,17 +1,33 @@
 package session
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+
+	"quick-tabletop-engine/config"
 	"quick-tabletop-engine/game"
 )
 
 func TestNewManager(t *testing.T) {
-	m := NewManager(10)
+	cfg := config.Default()
+	cfg.MaxSessions = 10
+	m := NewManager(cfg)
 
-	if m.maxSessions != 10 {
-		t.Errorf("expected maxSessions 10, got %d", m.maxSessions)
+	if m.cfg.MaxSessions != 10 {
+		t.Errorf("expected maxSessions 10, got %d", m.cfg.MaxSessions)
 	}
 	if len(m.sessions) != 0 {
 		t.Errorf("expected 0 sessions, got %d", len(m.sessions))
@@ -19,7 +35,7 @@ func TestNewManager(t *testing.T) {
 }
 
 func TestManagerReset(t *testing.T) {
-	m := NewManager(10)
+	m := NewManager(config.Default())
 	m.sessions["fake"] = &Session{ID: "fake", State: game.NewState()}
 
 	m.Reset()
@@ -29,6 +45,10 @@ func TestManagerReset(t *testing.T) {
 	}
 }
 
+func testContext(state *game.State) *commandContext {
+	return &commandContext{role: RoleGM, state: state, cfg: config.Default()}
+}
+
 func makeCommand(t *testing.T, msgType string, payload interface{}) ClientMessage {
 	t.Helper()
 	var raw json.RawMessage
@@ -46,10 +66,10 @@ func TestProcessCommandAddToken(t *testing.T) {
 	state := game.NewState()
 	cmd := makeCommand(t, "add_token", game.AddTokenPayload{
 		ID:    "t1",
-		Token: game.TokenData{Name: "Goblin", ImgPath: "/goblin.jpg", X: 96, Y: 96, TokenSize: 96},
+		Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg", X: 96, Y: 96, TokenSize: 96},
 	})
 
-	processCommand(cmd, &state)
+	processCommand(cmd, testContext(&state))
 
 	if len(state.DisplayedTokens) != 1 {
 		t.Fatalf("expected 1 token, got %d", len(state.DisplayedTokens))
@@ -64,7 +84,7 @@ func TestProcessCommandMoveToken(t *testing.T) {
 	state.AddToken("t1", game.TokenData{Name: "Goblin", X: 96, Y: 96, TokenSize: 96})
 
 	cmd := makeCommand(t, "move_token", game.MoveTokenPayload{ID: "t1", X: 200, Y: 300})
-	processCommand(cmd, &state)
+	processCommand(cmd, testContext(&state))
 
 	token := state.DisplayedTokens["t1"]
 	if token.X != 200 || token.Y != 300 {
@@ -77,20 +97,84 @@ func TestProcessCommandDeleteToken(t *testing.T) {
 	state.AddToken("t1", game.TokenData{Name: "Goblin"})
 
 	cmd := makeCommand(t, "delete_token", game.DeleteTokenPayload{ID: "t1"})
-	processCommand(cmd, &state)
+	processCommand(cmd, testContext(&state))
 
 	if len(state.DisplayedTokens) != 0 {
 		t.Errorf("expected 0 tokens, got %d", len(state.DisplayedTokens))
 	}
 }
 
+func TestProcessCommandDuplicateToken(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin", X: 96, Y: 96})
+
+	ctx := testContext(&state)
+	if _, err := processCommand(makeCommand(t, "duplicate_token", game.DuplicateTokenPayload{ID: "t1", OffsetX: 96}), ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(state.DisplayedTokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(state.DisplayedTokens))
+	}
+	if ctx.delta == nil || ctx.delta.ID == "t1" || ctx.delta.Token.X != 192 {
+		t.Errorf("expected a delta for the copy, got %+v", ctx.delta)
+	}
+
+	if _, err := processCommand(makeCommand(t, "duplicate_token", game.DuplicateTokenPayload{ID: "missing"}), testContext(&state)); err == nil {
+		t.Error("expected an error for an unknown token")
+	}
+}
+
+func TestProcessCommandTokenLimit(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.cfg.MaxTokensPerSession = 2
+
+	for _, id := range []string{"t1", "t2"} {
+		if _, err := processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: id, Token: game.TokenData{Name: "Goblin"}}), ctx); err != nil {
+			t.Fatalf("unexpected error adding %s: %v", id, err)
+		}
+	}
+
+	if _, err := processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: "t3", Token: game.TokenData{Name: "Goblin"}}), ctx); err == nil {
+		t.Error("expected the third token to be refused")
+	}
+	if _, err := processCommand(makeCommand(t, "duplicate_token", game.DuplicateTokenPayload{ID: "t1"}), ctx); err == nil {
+		t.Error("expected a duplicate past the limit to be refused")
+	}
+	if len(state.DisplayedTokens) != 2 {
+		t.Errorf("expected 2 tokens, got %d", len(state.DisplayedTokens))
+	}
+
+	if _, err := processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Orc"}}), ctx); err != nil {
+		t.Errorf("expected replacing an existing token to be allowed, got %v", err)
+	}
+}
+
+func TestProcessCommandDeleteTokens(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+	state.AddToken("t2", game.TokenData{Name: "Orc"})
+	state.AddToken("t3", game.TokenData{Name: "Troll"})
+
+	ctx := testContext(&state)
+	processCommand(makeCommand(t, "delete_tokens", game.DeleteTokensPayload{IDs: []string{"t1", "t3", "missing"}}), ctx)
+
+	if len(state.DisplayedTokens) != 1 {
+		t.Errorf("expected 1 token, got %d", len(state.DisplayedTokens))
+	}
+	if ctx.delta != nil {
+		t.Errorf("expected a full state broadcast, got delta %+v", ctx.delta)
+	}
+}
+
 func TestProcessCommandClearTokens(t *testing.T) {
 	state := game.NewState()
 	state.AddToken("t1", game.TokenData{Name: "Goblin"})
 	state.AddToken("t2", game.TokenData{Name: "Orc"})
 
 	cmd := makeCommand(t, "clear_tokens", nil)
-	processCommand(cmd, &state)
+	processCommand(cmd, testContext(&state))
 
 	if len(state.DisplayedTokens) != 0 {
 		t.Errorf("expected 0 tokens, got %d", len(state.DisplayedTokens))
@@ -100,33 +184,1028 @@ func TestProcessCommandClearTokens(t *testing.T) {
 func TestProcessCommandChangeBackground(t *testing.T) {
 	state := game.NewState()
 
-	cmd := makeCommand(t, "change_background", game.ChangeBackgroundPayload{ImgPath: "/forest.jpg"})
-	processCommand(cmd, &state)
+	cmd := makeCommand(t, "change_background", game.ChangeBackgroundPayload{ImgPath: "/assets/forest.jpg"})
+	processCommand(cmd, testContext(&state))
 
-	if state.BackgroundImgPath != "/forest.jpg" {
+	if state.BackgroundImgPath != "/assets/forest.jpg" {
 		t.Errorf("expected /forest.jpg, got %q", state.BackgroundImgPath)
 	}
 }
 
+func TestProcessCommandSetBackgroundTransform(t *testing.T) {
+	state := game.NewState()
+
+	if _, err := processCommand(makeCommand(t, "set_background_transform", game.SetBackgroundTransformPayload{Scale: 0}), testContext(&state)); err == nil {
+		t.Error("expected a zero scale to be rejected")
+	}
+	processCommand(makeCommand(t, "set_background_transform", game.SetBackgroundTransformPayload{Scale: 2, OffsetX: 48}), testContext(&state))
+	if state.BackgroundScale != 2 || state.BackgroundOffsetX != 48 {
+		t.Errorf("expected scale 2 offset 48, got %v %v", state.BackgroundScale, state.BackgroundOffsetX)
+	}
+}
+
+func TestProcessCommandRejectsInvalidImgPaths(t *testing.T) {
+	state := game.NewState()
+
+	for _, cmd := range []ClientMessage{
+		makeCommand(t, "change_background", game.ChangeBackgroundPayload{ImgPath: "http://evil/x.png"}),
+		makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/../../etc/passwd"}}),
+	} {
+		if _, err := processCommand(cmd, testContext(&state)); err == nil {
+			t.Errorf("%s: expected an error for an invalid image path", cmd.Type)
+		}
+	}
+	if state.BackgroundImgPath != game.NewState().BackgroundImgPath || len(state.DisplayedTokens) != 0 {
+		t.Errorf("invalid image paths should not change state, got %+v", state)
+	}
+}
+
 func TestProcessCommandToggleGrid(t *testing.T) {
 	state := game.NewState()
 
 	cmd := makeCommand(t, "toggle_grid", nil)
-	processCommand(cmd, &state)
+	processCommand(cmd, testContext(&state))
 
 	if state.ShowGrid {
 		t.Error("expected showGrid false after toggle")
 	}
 }
 
+func TestProcessCommandReportsChanges(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+
+	changed, err := processCommand(makeCommand(t, "move_token", game.MoveTokenPayload{ID: "t1", X: 96, Y: 96}), testContext(&state))
+	if err != nil || !changed {
+		t.Errorf("expected moving a token to change state, got changed=%v err=%v", changed, err)
+	}
+
+	changed, err = processCommand(makeCommand(t, "move_token", game.MoveTokenPayload{ID: "missing", X: 96, Y: 96}), testContext(&state))
+	if err != nil || changed {
+		t.Errorf("expected moving an unknown token to change nothing, got changed=%v err=%v", changed, err)
+	}
+}
+
+func TestProcessCommandWhilePaused(t *testing.T) {
+	state := game.NewState()
+
+	player := testContext(&state)
+	player.role = RolePlayer
+	player.paused = true
+	drawing := game.AddDrawingPayload{Drawing: game.Drawing{ID: "d1"}}
+	if _, err := processCommand(makeCommand(t, "add_drawing", drawing), player); !errors.Is(err, errPaused) {
+		t.Errorf("expected players to be refused while paused, got %v", err)
+	}
+	if len(state.Drawings) != 0 {
+		t.Error("a refused command should not change state")
+	}
+
+	gm := testContext(&state)
+	gm.paused = true
+	if _, err := processCommand(makeCommand(t, "toggle_grid", nil), gm); err != nil {
+		t.Errorf("expected the GM to act while paused, got %v", err)
+	}
+}
+
 func TestProcessCommandUnknownType(t *testing.T) {
 	state := game.NewState()
 
 	cmd := makeCommand(t, "unknown_command", nil)
-	processCommand(cmd, &state)
+	processCommand(cmd, testContext(&state))
 
 	// Should not panic, state should be unchanged
 	if len(state.DisplayedTokens) != 0 {
 		t.Error("state should be unchanged for unknown command")
 	}
 }
+
+func TestCapabilitiesListsKnownCommands(t *testing.T) {
+	m := NewManager(config.Default())
+
+	caps := m.capabilities()
+
+	for _, want := range []string{"capabilities", "add_token", "move_token", "delete_token", "clear_tokens", "change_background", "toggle_grid"} {
+		found := false
+		for _, cmd := range caps.Commands {
+			if cmd == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected %q in capabilities commands %v", want, caps.Commands)
+		}
+	}
+	if caps.Version != ProtocolVersion {
+		t.Errorf("expected version %q, got %q", ProtocolVersion, caps.Version)
+	}
+	if caps.Features["maxSessions"] != 5 {
+		t.Errorf("expected maxSessions feature 5, got %v", caps.Features["maxSessions"])
+	}
+	if caps.Features["maxTokensPerSession"] != 500 || caps.Features["undo"] != true || caps.Features["deltas"] != true {
+		t.Errorf("expected the configured limits and features, got %v", caps.Features)
+	}
+	if formats, _ := caps.Features["formats"].([]string); len(formats) != 2 || formats[1] != "msgpack" {
+		t.Errorf("expected json and msgpack formats, got %v", caps.Features["formats"])
+	}
+
+	cfg := config.Default()
+	cfg.UndoDepth = 0
+	if caps := NewManager(cfg).capabilities(); caps.Features["undo"] != false {
+		t.Error("expected undo to be reported as unavailable with no undo depth")
+	}
+}
+
+func TestProcessCommandStartConcentration(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Cleric"})
+
+	processCommand(makeCommand(t, "start_concentration", game.ConcentrationPayload{ID: "t1", Spell: "Bless"}), testContext(&state))
+	processCommand(makeCommand(t, "start_concentration", game.ConcentrationPayload{ID: "t1", Spell: "Spirit Guardians"}), testContext(&state))
+
+	if got := state.DisplayedTokens["t1"].ConcentratingOn; got != "Spirit Guardians" {
+		t.Errorf("expected Spirit Guardians, got %q", got)
+	}
+
+	processCommand(makeCommand(t, "end_concentration", game.ConcentrationPayload{ID: "t1"}), testContext(&state))
+
+	if got := state.DisplayedTokens["t1"].ConcentratingOn; got != "" {
+		t.Errorf("expected concentration cleared, got %q", got)
+	}
+}
+
+func TestProcessCommandSetTokenHP(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin", HP: 7, MaxHP: 7})
+
+	processCommand(makeCommand(t, "set_token_hp", game.SetTokenHPPayload{ID: "t1", HP: 2}), testContext(&state))
+
+	if got := state.DisplayedTokens["t1"].HP; got != 2 {
+		t.Errorf("expected HP 2, got %d", got)
+	}
+}
+
+func TestProcessCommandTokenConditions(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+
+	processCommand(makeCommand(t, "add_token_condition", game.TokenConditionPayload{ID: "t1", Condition: "prone"}), testContext(&state))
+	processCommand(makeCommand(t, "add_token_condition", game.TokenConditionPayload{ID: "t1", Condition: "poisoned"}), testContext(&state))
+	processCommand(makeCommand(t, "remove_token_condition", game.TokenConditionPayload{ID: "t1", Condition: "prone"}), testContext(&state))
+
+	got := state.DisplayedTokens["t1"].Conditions
+	if len(got) != 1 || got[0] != "poisoned" {
+		t.Fatalf("expected [poisoned], got %v", got)
+	}
+
+	processCommand(makeCommand(t, "clear_token_conditions", game.TokenConditionPayload{ID: "t1"}), testContext(&state))
+
+	if got := state.DisplayedTokens["t1"].Conditions; len(got) != 0 {
+		t.Errorf("expected no conditions, got %v", got)
+	}
+}
+
+func TestProcessCommandTruncatesLongNames(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.cfg.MaxNameLength = 8
+
+	processCommand(makeCommand(t, "add_token", game.AddTokenPayload{
+		ID:    "t1",
+		Token: game.TokenData{Name: "Ancient Red Dragon", ImgPath: "/assets/dragon.jpg"},
+	}), ctx)
+	processCommand(makeCommand(t, "add_token_condition", game.TokenConditionPayload{ID: "t1", Condition: "frightened-by-everything"}), ctx)
+
+	token := state.DisplayedTokens["t1"]
+	if token.Name != "Ancient " {
+		t.Errorf("expected name truncated to 8 chars, got %q", token.Name)
+	}
+	if len(token.Conditions) != 1 || token.Conditions[0] != "frighten" {
+		t.Errorf("expected condition truncated to 8 chars, got %v", token.Conditions)
+	}
+}
+
+func TestTruncateIsRuneAware(t *testing.T) {
+	if got := truncate("héllo wörld", 5); got != "héllo" {
+		t.Errorf("expected héllo, got %q", got)
+	}
+	if got := truncate("short", 0); got != "short" {
+		t.Errorf("expected limit 0 to disable truncation, got %q", got)
+	}
+}
+
+func TestProcessCommandTokenLayering(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+	state.AddToken("t2", game.TokenData{Name: "Orc"})
+
+	processCommand(makeCommand(t, "set_token_z", game.SetTokenZPayload{ID: "t2", Z: 7}), testContext(&state))
+	processCommand(makeCommand(t, "bring_to_front", game.TokenOrderPayload{ID: "t1"}), testContext(&state))
+
+	if got := state.DisplayedTokens["t1"].Z; got != 8 {
+		t.Errorf("expected t1 z 8, got %d", got)
+	}
+
+	processCommand(makeCommand(t, "send_to_back", game.TokenOrderPayload{ID: "t2"}), testContext(&state))
+
+	if got := state.DisplayedTokens["t2"].Z; got != 7 {
+		t.Errorf("expected t2 z 7 (t1 is the only other token at 8), got %d", got)
+	}
+}
+
+func TestProcessCommandSetTokenElevation(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Wyvern"})
+
+	ctx := testContext(&state)
+	processCommand(makeCommand(t, "set_token_elevation", game.SetTokenElevationPayload{ID: "t1", Elevation: 30}), ctx)
+
+	if got := state.DisplayedTokens["t1"].Elevation; got != 30 {
+		t.Errorf("expected elevation 30, got %v", got)
+	}
+	if ctx.delta == nil || ctx.delta.Token.Elevation != 30 {
+		t.Errorf("expected a token delta with the new elevation, got %+v", ctx.delta)
+	}
+}
+
+func TestProcessCommandGroups(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("g1", game.TokenData{Name: "Goblin", X: 96, GroupID: "warband"})
+	state.AddToken("g2", game.TokenData{Name: "Goblin", X: 192, GroupID: "warband"})
+
+	ctx := testContext(&state)
+	processCommand(makeCommand(t, "move_group", game.MoveGroupPayload{GroupID: "warband", OffsetX: 96}), ctx)
+	if state.DisplayedTokens["g1"].X != 192 || state.DisplayedTokens["g2"].X != 288 {
+		t.Errorf("expected the group moved, got %+v", state.DisplayedTokens)
+	}
+	if ctx.delta != nil {
+		t.Errorf("expected one full state broadcast for the group, got delta %+v", ctx.delta)
+	}
+
+	player := testContext(&state)
+	player.role = RolePlayer
+	if _, err := processCommand(makeCommand(t, "set_group_hidden", game.SetGroupHiddenPayload{GroupID: "warband", Hidden: true}), player); !errors.Is(err, errForbidden) {
+		t.Errorf("expected players to be refused hiding a group, got %v", err)
+	}
+
+	processCommand(makeCommand(t, "delete_group", game.DeleteGroupPayload{GroupID: "warband"}), testContext(&state))
+	if len(state.DisplayedTokens) != 0 {
+		t.Errorf("expected the group deleted, got %+v", state.DisplayedTokens)
+	}
+}
+
+func TestProcessCommandSetTokenAura(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Cleric"})
+
+	if _, err := processCommand(makeCommand(t, "set_token_aura", game.SetTokenAuraPayload{ID: "t1", Radius: 4, Color: "#ffcc00"}), testContext(&state)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, bad := range []game.SetTokenAuraPayload{{ID: "t1", Radius: -2}, {ID: "t1", Radius: 2, Color: "red"}} {
+		if _, err := processCommand(makeCommand(t, "set_token_aura", bad), testContext(&state)); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+	if got := state.DisplayedTokens["t1"]; got.AuraRadius != 4 || got.AuraColor != "#ffcc00" {
+		t.Errorf("expected the valid aura to stick, got %v %q", got.AuraRadius, got.AuraColor)
+	}
+}
+
+func TestProcessCommandScenes(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+
+	if _, err := processCommand(makeCommand(t, "create_scene", game.CreateScenePayload{ID: "cellar", Name: "Cellar"}), ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	player := testContext(&state)
+	player.role = RolePlayer
+	if _, err := processCommand(makeCommand(t, "switch_scene", game.SceneIDPayload{ID: "cellar"}), player); !errors.Is(err, errForbidden) {
+		t.Errorf("expected players to be refused switching scenes, got %v", err)
+	}
+
+	ctx = testContext(&state)
+	processCommand(makeCommand(t, "switch_scene", game.SceneIDPayload{ID: "cellar"}), ctx)
+	if state.ActiveScene != "cellar" || ctx.delta != nil {
+		t.Errorf("expected a full state broadcast of the cellar, got %q with delta %+v", state.ActiveScene, ctx.delta)
+	}
+	if _, err := processCommand(makeCommand(t, "delete_scene", game.SceneIDPayload{ID: "cellar"}), testContext(&state)); err == nil {
+		t.Error("expected deleting the active scene to fail")
+	}
+}
+
+func TestViewForFiltersByRole(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("ambush", game.TokenData{Name: "Ogre", Hidden: true})
+
+	if _, ok := viewFor(state, RoleGM).DisplayedTokens["ambush"]; !ok {
+		t.Error("GM should see hidden tokens")
+	}
+	if _, ok := viewFor(state, RolePlayer).DisplayedTokens["ambush"]; ok {
+		t.Error("player should not see hidden tokens")
+	}
+}
+
+func TestProcessCommandInitiative(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("a", game.TokenData{Name: "Goblin"})
+	state.AddToken("b", game.TokenData{Name: "Rogue"})
+
+	processCommand(makeCommand(t, "set_initiative", game.SetInitiativePayload{Entries: []game.InitiativeEntry{
+		{TokenID: "a", Score: 5, Name: "Goblin"},
+		{TokenID: "b", Score: 19, Name: "Rogue"},
+	}}), testContext(&state))
+	processCommand(makeCommand(t, "next_turn", nil), testContext(&state))
+
+	if state.InitiativeOrder[0].TokenID != "b" {
+		t.Errorf("expected b first, got %+v", state.InitiativeOrder)
+	}
+	if state.CurrentTurn != 1 {
+		t.Errorf("expected turn 1, got %d", state.CurrentTurn)
+	}
+
+	processCommand(makeCommand(t, "set_round", game.SetRoundPayload{Round: 3}), testContext(&state))
+	if _, err := processCommand(makeCommand(t, "set_round", game.SetRoundPayload{Round: -1}), testContext(&state)); err == nil {
+		t.Error("expected a negative round to be refused")
+	}
+	if state.Round != 3 {
+		t.Errorf("expected round 3, got %d", state.Round)
+	}
+
+	processCommand(makeCommand(t, "clear_initiative", nil), testContext(&state))
+
+	if len(state.InitiativeOrder) != 0 {
+		t.Errorf("expected initiative cleared, got %+v", state.InitiativeOrder)
+	}
+}
+
+func TestProcessCommandChangeBackgroundFitsGrid(t *testing.T) {
+	state := game.NewState()
+
+	cmd := makeCommand(t, "change_background", game.ChangeBackgroundPayload{ImgPath: "/assets/cave.jpg", ImageWidth: 1500, FitColumns: 30})
+	processCommand(cmd, testContext(&state))
+
+	if state.GridUnit != 50 {
+		t.Errorf("expected gridUnit 50, got %f", state.GridUnit)
+	}
+}
+
+func debugRequest(t *testing.T, m *Manager, id, token string) *http.Response {
+	t.Helper()
+	app := fiber.New()
+	app.Get("/debug/session/:id", m.DebugSession)
+
+	req := httptest.NewRequest("GET", "/debug/session/"+id, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return resp
+}
+
+func TestDebugSessionReturnsFullState(t *testing.T) {
+	cfg := config.Default()
+	cfg.DebugEnabled = true
+	cfg.AdminToken = "secret"
+	m := NewManager(cfg)
+	state := game.NewState()
+	state.AddToken("ambush", game.TokenData{Name: "Ogre", Hidden: true})
+	created := time.Date(2026, 3, 1, 18, 0, 0, 0, time.UTC)
+	m.sessions["s1"] = &Session{
+		ID:        "s1",
+		Clients:   make(map[*websocket.Conn]*ClientInfo),
+		State:     state,
+		Meta:      SessionMeta{Name: "Curse of the Crypt", System: "dnd5e"},
+		Paused:    true,
+		CreatedAt: created,
+	}
+
+	resp := debugRequest(t, m, "s1", "secret")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body struct {
+		SessionID string     `json:"sessionId"`
+		Name      string     `json:"name"`
+		System    string     `json:"system"`
+		Paused    bool       `json:"paused"`
+		CreatedAt time.Time  `json:"createdAt"`
+		State     game.State `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if _, ok := body.State.DisplayedTokens["ambush"]; !ok {
+		t.Error("debug dump should include hidden tokens")
+	}
+	if body.Name != "Curse of the Crypt" || body.System != "dnd5e" || !body.Paused || !body.CreatedAt.Equal(created) {
+		t.Errorf("expected the session metadata in the dump, got %q %q paused=%v created %v", body.Name, body.System, body.Paused, body.CreatedAt)
+	}
+}
+
+func TestExportSession(t *testing.T) {
+	cfg := config.Default()
+	cfg.AdminToken = "secret"
+	m := NewManager(cfg)
+	state := game.NewState()
+	state.AddToken("ambush", game.TokenData{Name: "Ogre", Hidden: true})
+	m.sessions["s1"] = &Session{ID: "s1", Clients: make(map[*websocket.Conn]*ClientInfo), State: state}
+
+	app := fiber.New()
+	app.Get("/session/:id/export", m.ExportSession)
+	request := func(id, token string) *http.Response {
+		req := httptest.NewRequest("GET", "/session/"+id+"/export", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	resp := request("s1", "secret")
+	defer resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Disposition"); !strings.Contains(got, "attachment") || !strings.Contains(got, "session-s1.json") {
+		t.Errorf("expected an attachment, got Content-Disposition %q", got)
+	}
+	var exported game.State
+	if err := json.NewDecoder(resp.Body).Decode(&exported); err != nil {
+		t.Fatalf("failed to decode export: %v", err)
+	}
+	if _, ok := exported.DisplayedTokens["ambush"]; !ok {
+		t.Error("export should include hidden tokens")
+	}
+
+	if resp := request("s1", ""); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 without the admin token, got %d", resp.StatusCode)
+	}
+	if resp := request("missing", "secret"); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("expected 404 for an unknown session, got %d", resp.StatusCode)
+	}
+}
+
+func TestDebugSessionDisabled(t *testing.T) {
+	cfg := config.Default()
+	cfg.AdminToken = "secret"
+	m := NewManager(cfg)
+	m.sessions["s1"] = &Session{ID: "s1", State: game.NewState()}
+
+	resp := debugRequest(t, m, "s1", "secret")
+	resp.Body.Close()
+
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("expected 404 when debug is disabled, got %d", resp.StatusCode)
+	}
+}
+
+func TestDebugSessionRequiresAdminToken(t *testing.T) {
+	cfg := config.Default()
+	cfg.DebugEnabled = true
+	cfg.AdminToken = "secret"
+	m := NewManager(cfg)
+	m.sessions["s1"] = &Session{ID: "s1", State: game.NewState()}
+
+	for _, token := range []string{"", "wrong"} {
+		resp := debugRequest(t, m, "s1", token)
+		resp.Body.Close()
+		if resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("token %q: expected 403, got %d", token, resp.StatusCode)
+		}
+	}
+}
+
+func TestProcessCommandFog(t *testing.T) {
+	state := game.NewState()
+
+	processCommand(makeCommand(t, "add_fog", game.AddFogPayload{Region: game.FogRect{ID: "f1", W: 96, H: 96}}), testContext(&state))
+	processCommand(makeCommand(t, "add_fog", game.AddFogPayload{Region: game.FogRect{ID: "f2", W: 96, H: 96}}), testContext(&state))
+	processCommand(makeCommand(t, "remove_fog", game.RemoveFogPayload{ID: "f1"}), testContext(&state))
+
+	if len(state.FogRegions) != 1 || state.FogRegions[0].ID != "f2" {
+		t.Fatalf("expected only f2, got %+v", state.FogRegions)
+	}
+
+	processCommand(makeCommand(t, "clear_fog", nil), testContext(&state))
+
+	if len(state.FogRegions) != 0 {
+		t.Errorf("expected fog cleared, got %+v", state.FogRegions)
+	}
+}
+
+func TestProcessCommandDrawings(t *testing.T) {
+	state := game.NewState()
+	drawing := game.Drawing{ID: "d1", Points: []game.Point{{X: 0, Y: 0}, {X: 96, Y: 96}}, Color: "#ff0000", Width: 3}
+
+	processCommand(makeCommand(t, "add_drawing", game.AddDrawingPayload{Drawing: drawing}), testContext(&state))
+	processCommand(makeCommand(t, "add_drawing", game.AddDrawingPayload{Drawing: game.Drawing{ID: "d2"}}), testContext(&state))
+	processCommand(makeCommand(t, "delete_drawing", game.DeleteDrawingPayload{ID: "d2"}), testContext(&state))
+
+	if len(state.Drawings) != 1 || state.Drawings[0].Color != "#ff0000" || len(state.Drawings[0].Points) != 2 {
+		t.Fatalf("expected only d1, got %+v", state.Drawings)
+	}
+
+	processCommand(makeCommand(t, "clear_drawings", nil), testContext(&state))
+
+	if len(state.Drawings) != 0 {
+		t.Errorf("expected drawings cleared, got %+v", state.Drawings)
+	}
+}
+
+func TestProcessCommandNotes(t *testing.T) {
+	state := game.NewState()
+
+	processCommand(makeCommand(t, "add_note", game.NotePayload{ID: "n1", Note: game.Note{X: 96, Y: 96, Text: "Trapdoor", GMOnly: true}}), testContext(&state))
+	processCommand(makeCommand(t, "update_note", game.NotePayload{ID: "n1", Note: game.Note{X: 96, Y: 96, Text: "Open trapdoor"}}), testContext(&state))
+
+	if note := state.Notes["n1"]; note.Text != "Open trapdoor" || note.GMOnly {
+		t.Fatalf("unexpected note %+v", note)
+	}
+
+	processCommand(makeCommand(t, "delete_note", game.DeleteNotePayload{ID: "n1"}), testContext(&state))
+
+	if len(state.Notes) != 0 {
+		t.Errorf("expected note deleted, got %+v", state.Notes)
+	}
+}
+
+func TestProcessCommandTextObjects(t *testing.T) {
+	state := game.NewState()
+
+	processCommand(makeCommand(t, "add_text", game.TextPayload{ID: "t1", Text: game.TextObject{Text: "Throne Room", Size: 48}}), testContext(&state))
+	processCommand(makeCommand(t, "move_text", game.MoveTextPayload{ID: "t1", X: 96, Y: 96}), testContext(&state))
+
+	if text := state.TextObjects["t1"]; text.Text != "Throne Room" || text.X != 96 {
+		t.Fatalf("unexpected text object %+v", text)
+	}
+
+	if _, err := processCommand(makeCommand(t, "update_text", game.TextPayload{ID: "t1", Text: game.TextObject{Text: "Throne Room", Size: 48, Color: "gold"}}), testContext(&state)); err == nil {
+		t.Error("expected an invalid color to be rejected")
+	}
+	player := testContext(&state)
+	player.role = RolePlayer
+	if _, err := processCommand(makeCommand(t, "delete_text", game.DeleteTextPayload{ID: "t1"}), player); err == nil {
+		t.Error("expected players to be refused")
+	}
+
+	processCommand(makeCommand(t, "delete_text", game.DeleteTextPayload{ID: "t1"}), testContext(&state))
+
+	if len(state.TextObjects) != 0 {
+		t.Errorf("expected text deleted, got %+v", state.TextObjects)
+	}
+}
+
+func TestProcessCommandSetSnap(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+
+	processCommand(makeCommand(t, "set_snap", game.SetSnapPayload{Enabled: true}), testContext(&state))
+	processCommand(makeCommand(t, "move_token", game.MoveTokenPayload{ID: "t1", X: 100, Y: 100}), testContext(&state))
+
+	if got := state.DisplayedTokens["t1"]; got.X != 96 || got.Y != 96 {
+		t.Errorf("expected snapped (96,96), got (%f,%f)", got.X, got.Y)
+	}
+}
+
+func TestProcessCommandSetGridOffset(t *testing.T) {
+	state := game.NewState()
+
+	processCommand(makeCommand(t, "set_grid_offset", game.SetGridOffsetPayload{X: 12, Y: -8}), testContext(&state))
+
+	if state.GridOffsetX != 12 || state.GridOffsetY != -8 {
+		t.Errorf("expected offset (12,-8), got (%f,%f)", state.GridOffsetX, state.GridOffsetY)
+	}
+}
+
+func TestClientName(t *testing.T) {
+	if got := clientName("  Aragorn  ", "abcdef123456"); got != "Aragorn" {
+		t.Errorf("expected trimmed name, got %q", got)
+	}
+	if got := clientName("   ", "abcdef123456"); got != "Player-abcdef12" {
+		t.Errorf("expected generated fallback name, got %q", got)
+	}
+	long := strings.Repeat("x", 60)
+	if got := clientName(long, "abcdef123456"); len(got) != maxClientNameLength {
+		t.Errorf("expected name capped at %d chars, got %d", maxClientNameLength, len(got))
+	}
+}
+
+func TestSetNameUpdatesPresence(t *testing.T) {
+	alice := &ClientInfo{ID: "a", Name: "Player-a"}
+	bob := &ClientInfo{ID: "b", Name: "Player-b"}
+	session := &Session{Clients: map[*websocket.Conn]*ClientInfo{nil: alice, {}: bob}}
+
+	payload, _ := json.Marshal(SetNamePayload{Name: "Alice"})
+	msg, err := eventHandlers["set_name"](NewManager(config.Default()), session, alice, payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	presence, ok := msg.Payload.(PresenceUpdate)
+	if msg.Type != "presence_update" || !ok {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if len(presence.Clients) != 2 || presence.Clients[0].Name != "Alice" || presence.Clients[1].Name != "Player-b" {
+		t.Errorf("unexpected presence %+v", presence)
+	}
+}
+
+func TestProcessCommandRejectsProtectedCommandsFromPlayers(t *testing.T) {
+	for _, cmd := range []ClientMessage{
+		makeCommand(t, "clear_tokens", nil),
+		makeCommand(t, "change_background", game.ChangeBackgroundPayload{ImgPath: "/assets/forest.jpg"}),
+		makeCommand(t, "set_token_hidden", game.SetTokenHiddenPayload{ID: "t1", Hidden: true}),
+	} {
+		state := game.NewState()
+		state.AddToken("t1", game.TokenData{Name: "Goblin"})
+		ctx := testContext(&state)
+		ctx.role = RolePlayer
+
+		_, err := processCommand(cmd, ctx)
+
+		if !errors.Is(err, errForbidden) {
+			t.Errorf("%s: expected errForbidden, got %v", cmd.Type, err)
+		}
+		if len(state.DisplayedTokens) != 1 || state.DisplayedTokens["t1"].Hidden || state.BackgroundImgPath == "/assets/forest.jpg" {
+			t.Errorf("%s: player command should not mutate state", cmd.Type)
+		}
+	}
+}
+
+func TestProcessCommandIgnoresSpectators(t *testing.T) {
+	state := game.NewState()
+	ctx := testContext(&state)
+	ctx.role = RoleSpectator
+	cmd := makeCommand(t, "add_token", game.AddTokenPayload{
+		ID:    "t1",
+		Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/goblin.jpg"},
+	})
+
+	_, err := processCommand(cmd, ctx)
+
+	if !errors.Is(err, errReadOnly) {
+		t.Errorf("expected errReadOnly, got %v", err)
+	}
+	if len(state.DisplayedTokens) != 0 {
+		t.Errorf("spectator add_token should not change state, got %v", state.DisplayedTokens)
+	}
+}
+
+func TestProcessCommandAllowsProtectedCommandsFromGM(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+
+	if _, err := processCommand(makeCommand(t, "clear_tokens", nil), testContext(&state)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(state.DisplayedTokens) != 0 {
+		t.Error("GM should be able to clear tokens")
+	}
+}
+
+func TestSweepIdleDeletesOnlyIdleSessions(t *testing.T) {
+	cfg := config.Default()
+	cfg.IdleTimeoutSec = 3600
+	m := NewManager(cfg)
+	now := time.Now()
+	m.sessions["idle"] = &Session{ID: "idle", Clients: map[*websocket.Conn]*ClientInfo{}, LastActivity: now.Add(-2 * time.Hour)}
+	m.sessions["busy"] = &Session{ID: "busy", Clients: map[*websocket.Conn]*ClientInfo{}, LastActivity: now.Add(-time.Minute)}
+
+	m.sweep(now)
+
+	if _, ok := m.sessions["idle"]; ok {
+		t.Error("expected idle session to be deleted")
+	}
+	if _, ok := m.sessions["busy"]; !ok {
+		t.Error("expected active session to be kept")
+	}
+}
+
+func TestSetMetaTrimsAndLimits(t *testing.T) {
+	s := &Session{}
+
+	s.setMeta(SessionMeta{Name: "  " + strings.Repeat("a", 200) + "  ", System: " pf2e "}, config.Default().MaxSessionNameLength)
+
+	if len(s.Meta.Name) != 80 || s.Meta.System != "pf2e" {
+		t.Errorf("expected trimmed, capped metadata, got %+v", s.Meta)
+	}
+
+	s.setMeta(SessionMeta{Name: strings.Repeat("a", 200)}, 0)
+	if len(s.Meta.Name) != 200 {
+		t.Errorf("expected a zero limit to keep the whole name, got %d characters", len(s.Meta.Name))
+	}
+}
+
+func TestSweepDeletesExpiredSessions(t *testing.T) {
+	cfg := config.Default()
+	cfg.SessionTTLSec = 4 * 3600
+	m := NewManager(cfg)
+	now := time.Now()
+	m.sessions["old"] = &Session{ID: "old", Clients: map[*websocket.Conn]*ClientInfo{}, CreatedAt: now.Add(-5 * time.Hour), LastActivity: now}
+	m.sessions["new"] = &Session{ID: "new", Clients: map[*websocket.Conn]*ClientInfo{}, CreatedAt: now.Add(-time.Hour), LastActivity: now}
+
+	m.sweep(now)
+
+	if _, ok := m.sessions["old"]; ok {
+		t.Error("expected expired session to be deleted despite recent activity")
+	}
+	if _, ok := m.sessions["new"]; !ok {
+		t.Error("expected session within its TTL to be kept")
+	}
+
+	cfg.SessionTTLSec = 0
+	m.UpdateConfig(cfg)
+	m.sessions["old"] = &Session{ID: "old", Clients: map[*websocket.Conn]*ClientInfo{}, CreatedAt: now.Add(-5 * time.Hour), LastActivity: now}
+	m.sweep(now)
+	if _, ok := m.sessions["old"]; !ok {
+		t.Error("expected a TTL of 0 to keep sessions")
+	}
+}
+
+func TestUpdateConfigAppliesToNewSessions(t *testing.T) {
+	m := NewManager(config.Default())
+	app := fiber.New()
+	app.Post("/session", m.CreateSession)
+	create := func() int {
+		resp, err := app.Test(httptest.NewRequest("POST", "/session", nil))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	cfg := config.Default()
+	cfg.MaxSessions = 1
+	m.UpdateConfig(cfg)
+
+	if status := create(); status != fiber.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	if status := create(); status != fiber.StatusTooManyRequests {
+		t.Errorf("expected the reloaded limit to apply, got %d", status)
+	}
+}
+
+func TestCreateSessionUsesConfiguredBoard(t *testing.T) {
+	cfg := config.Default()
+	cfg.DefaultBackground = "/assets/maps/cave.png"
+	cfg.DefaultGridUnit = 70
+	m := NewManager(cfg)
+	app := fiber.New()
+	app.Post("/session", m.CreateSession)
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/session", nil))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	for _, s := range m.sessions {
+		if s.State.BackgroundImgPath != "/assets/maps/cave.png" || s.State.GridUnit != 70 {
+			t.Errorf("expected the configured board, got %q at %v", s.State.BackgroundImgPath, s.State.GridUnit)
+		}
+	}
+	if len(m.sessions) != 1 {
+		t.Errorf("expected 1 session, got %d", len(m.sessions))
+	}
+}
+
+// BenchmarkCommandsAcrossSessions runs move_token commands from parallel
+// clients spread over one session or many. Sessions lock independently, so
+// with many sessions the commands run side by side instead of queuing. The
+// lock=global runs take one shared mutex around every command, as before
+// sessions had their own locks, for comparison; run with -cpu 1,2,4 or more.
+func BenchmarkCommandsAcrossSessions(b *testing.B) {
+	for _, global := range []bool{false, true} {
+		for _, n := range []int{1, 16} {
+			name := fmt.Sprintf("lock=session/sessions=%d", n)
+			if global {
+				name = fmt.Sprintf("lock=global/sessions=%d", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				m := NewManager(config.Default())
+				sessions := make([]*Session, n)
+				for i := range sessions {
+					state := game.NewState()
+					state.AddToken("t1", game.TokenData{Name: "Goblin"})
+					sessions[i] = &Session{ID: fmt.Sprint(i), Clients: make(map[*websocket.Conn]*ClientInfo), State: state}
+				}
+
+				var globalMu sync.Mutex
+				var clients atomic.Int64
+				b.RunParallel(func(pb *testing.PB) {
+					session := sessions[int(clients.Add(1))%n]
+					info := &ClientInfo{ID: "c", Role: RoleGM, codec: jsonCodec{}}
+					for x := 0; pb.Next(); x++ {
+						payload, _ := json.Marshal(game.MoveTokenPayload{ID: "t1", X: float64(x)})
+						msg := ClientMessage{Type: "move_token", Payload: payload}
+						if global {
+							globalMu.Lock()
+							m.runCommand(session, nil, info, msg)
+							globalMu.Unlock()
+						} else {
+							m.runCommand(session, nil, info, msg)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestStateFrameCacheInvalidatedByCommands(t *testing.T) {
+	m := NewManager(config.Default())
+	state := game.NewState()
+	state.AddToken("t1", game.TokenData{Name: "Goblin"})
+	session := &Session{ID: "s1", Clients: make(map[*websocket.Conn]*ClientInfo), State: state}
+	gm := &ClientInfo{ID: "gm", Role: RoleGM, codec: jsonCodec{}}
+	player := &ClientInfo{ID: "p", Role: RolePlayer, codec: jsonCodec{}}
+
+	first, _ := session.stateFrame(gm)
+	session.State.DisplayedTokens["t1"] = game.TokenData{Name: "Changed behind the cache's back"}
+	if again, _ := session.stateFrame(gm); !bytes.Equal(first.data, again.data) {
+		t.Error("expected the cached frame to be reused")
+	}
+	if len(session.encodedState) != 1 {
+		t.Errorf("expected one cached view, got %d", len(session.encodedState))
+	}
+	session.stateFrame(player)
+	if len(session.encodedState) != 2 {
+		t.Errorf("expected the player view to be cached separately, got %d", len(session.encodedState))
+	}
+
+	payload, _ := json.Marshal(game.MoveTokenPayload{ID: "t1", X: 96})
+	m.runCommand(session, nil, gm, ClientMessage{Type: "move_token", Payload: payload})
+
+	after, _ := session.stateFrame(gm)
+	var msg struct {
+		Payload game.State `json:"payload"`
+	}
+	if err := json.Unmarshal(after.data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload.DisplayedTokens["t1"].X != 96 {
+		t.Errorf("expected a fresh encoding after the move, got %+v", msg.Payload.DisplayedTokens["t1"])
+	}
+}
+
+// BenchmarkLateJoins syncs 100 clients joining an unchanged session, as
+// when a whole table reconnects after a network blip. Only the first join
+// encodes the state.
+func BenchmarkLateJoins(b *testing.B) {
+	session := &Session{State: largeState()}
+	info := &ClientInfo{Role: RolePlayer, codec: jsonCodec{}}
+	for i := 0; i < b.N; i++ {
+		session.stateChanged()
+		for range 100 {
+			if _, err := session.stateFrame(info); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPlayersCanAddTokensOnlyWhenAllowed(t *testing.T) {
+	state := game.NewState()
+	player := testContext(&state)
+	player.role = RolePlayer
+
+	add := makeCommand(t, "add_token", game.AddTokenPayload{ID: "wolf", Token: game.TokenData{Name: "Wolf"}})
+	if _, err := processCommand(add, player); !errors.Is(err, errNoPlayerTokens) {
+		t.Errorf("expected a player's add to be refused, got %v", err)
+	}
+	if _, err := processCommand(add, testContext(&state)); err != nil {
+		t.Errorf("expected the GM to add tokens regardless, got %v", err)
+	}
+
+	player.playersCanAddTokens = true
+	add = makeCommand(t, "add_token", game.AddTokenPayload{ID: "owl", Token: game.TokenData{Name: "Owl"}})
+	if _, err := processCommand(add, player); err != nil {
+		t.Errorf("expected a player's add to be allowed, got %v", err)
+	}
+}
+
+func TestPlayersSeeHiddenTokensAsUnknown(t *testing.T) {
+	state := game.NewState()
+	state.AddToken("ogre", game.TokenData{Name: "Ogre", Hidden: true, GroupID: "ambush"})
+	player := testContext(&state)
+	player.role = RolePlayer
+	player.playersCanAddTokens = true
+
+	for _, tc := range []struct {
+		msgType string
+		hidden  interface{}
+		unknown interface{}
+	}{
+		{"move_token", game.MoveTokenPayload{ID: "ogre", X: 10}, game.MoveTokenPayload{ID: "nobody", X: 10}},
+		{"move_tokens", game.MoveTokensPayload{Moves: []game.MoveTokenPayload{{ID: "ogre"}}}, game.MoveTokensPayload{Moves: []game.MoveTokenPayload{{ID: "nobody"}}}},
+		{"delete_token", game.DeleteTokenPayload{ID: "ogre"}, game.DeleteTokenPayload{ID: "nobody"}},
+		{"delete_tokens", game.DeleteTokensPayload{IDs: []string{"ogre"}}, game.DeleteTokensPayload{IDs: []string{"nobody"}}},
+		{"set_token_hp", game.SetTokenHPPayload{ID: "ogre", HP: 1}, game.SetTokenHPPayload{ID: "nobody", HP: 1}},
+		{"duplicate_token", game.DuplicateTokenPayload{ID: "ogre"}, game.DuplicateTokenPayload{ID: "nobody"}},
+		{"add_token_condition", game.TokenConditionPayload{ID: "ogre", Condition: "prone"}, game.TokenConditionPayload{ID: "nobody", Condition: "prone"}},
+	} {
+		before := state.Clone()
+		_, hiddenErr := processCommand(makeCommand(t, tc.msgType, tc.hidden), player)
+		_, unknownErr := processCommand(makeCommand(t, tc.msgType, tc.unknown), player)
+		if hiddenErr == nil || unknownErr == nil {
+			t.Errorf("%s: expected both to be refused, got %v and %v", tc.msgType, hiddenErr, unknownErr)
+			continue
+		}
+		if got, want := hiddenErr.Error(), strings.ReplaceAll(unknownErr.Error(), "nobody", "ogre"); got != want {
+			t.Errorf("%s: hidden token error %q differs from unknown token error %q", tc.msgType, got, want)
+		}
+		if !reflect.DeepEqual(before, state) {
+			t.Errorf("%s: expected the hidden token untouched", tc.msgType)
+		}
+	}
+
+	processCommand(makeCommand(t, "delete_group", game.DeleteGroupPayload{GroupID: "ambush"}), player)
+	if _, ok := state.DisplayedTokens["ogre"]; !ok {
+		t.Error("expected a player's delete_group to skip hidden members")
+	}
+	if _, err := processCommand(makeCommand(t, "add_token", game.AddTokenPayload{ID: "ogre", Token: game.TokenData{Name: "Owl"}}), player); err == nil {
+		t.Error("expected a player's add_token not to overwrite a hidden token")
+	}
+	if _, err := processCommand(makeCommand(t, "move_token", game.MoveTokenPayload{ID: "ogre", X: 10}), testContext(&state)); err != nil {
+		t.Errorf("expected the GM to move hidden tokens, got %v", err)
+	}
+}
+
+func TestCommandBuiltStateSurvivesExportImport(t *testing.T) {
+	state := game.NewState()
+	for _, cmd := range []ClientMessage{
+		makeCommand(t, "add_token", game.AddTokenPayload{ID: "ogre", Token: game.TokenData{Name: "Ogre", ImgPath: "/assets/ogre.png", MaxHP: 30, AuraRadius: 10, AuraColor: "#ff0000"}}),
+		makeCommand(t, "add_token", game.AddTokenPayload{ID: "elf", Token: game.TokenData{Name: "Elf"}}),
+		makeCommand(t, "duplicate_token", game.DuplicateTokenPayload{ID: "ogre", OffsetX: 96}),
+		makeCommand(t, "set_token_hp", game.SetTokenHPPayload{ID: "ogre", HP: 12}),
+		makeCommand(t, "add_token_condition", game.TokenConditionPayload{ID: "elf", Condition: "prone"}),
+		makeCommand(t, "set_initiative", game.SetInitiativePayload{Entries: []game.InitiativeEntry{
+			{TokenID: "ogre", Score: 12}, {Name: "Lair action", Score: 20},
+		}}),
+		makeCommand(t, "set_token_initiative", game.SetTokenInitiativePayload{TokenID: "elf", Value: 15}),
+		makeCommand(t, "next_turn", nil),
+		makeCommand(t, "add_fog", game.AddFogPayload{Region: game.FogRect{ID: "f1", W: 96, H: 96}}),
+		makeCommand(t, "add_drawing", game.AddDrawingPayload{Drawing: game.Drawing{ID: "d1", Points: []game.Point{{X: 1, Y: 2}}, Color: "#00ff00"}}),
+		makeCommand(t, "add_note", game.NotePayload{ID: "n1", Note: game.Note{Text: "Trap <here> & there", GMOnly: true}}),
+		makeCommand(t, "add_text", game.TextPayload{ID: "x1", Text: game.TextObject{Text: "Keep out", Size: 24}}),
+		makeCommand(t, "set_snap_anchor", game.SetSnapAnchorPayload{Anchor: game.SnapAnchorCenter}),
+		makeCommand(t, "set_grid_type", game.SetGridTypePayload{GridType: game.GridIso}),
+		makeCommand(t, "create_scene", game.CreateScenePayload{ID: "cellar", Name: "Cellar"}),
+		makeCommand(t, "switch_scene", game.SceneIDPayload{ID: "cellar"}),
+		makeCommand(t, "add_token", game.AddTokenPayload{ID: "rat", Token: game.TokenData{Name: "Rat"}}),
+	} {
+		if _, err := processCommand(cmd, testContext(&state)); err != nil {
+			t.Fatalf("%s: %v", cmd.Type, err)
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imported game.State
+	if err := json.Unmarshal(data, &imported); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.Validate(); err != nil {
+		t.Fatalf("expected a state built by commands to import, got %v", err)
+	}
+}
+
+func TestHandlersRejectWhatImportRejects(t *testing.T) {
+	state := game.NewState()
+	for _, cmd := range []ClientMessage{
+		makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin", MaxHP: -1}}),
+		makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin", AuraColor: "red"}}),
+		makeCommand(t, "add_token", game.AddTokenPayload{ID: "t1", Token: game.TokenData{Name: "Goblin", ImgPath: "/assets/g.png", PlaceholderColor: "blue"}}),
+		makeCommand(t, "add_fog", game.AddFogPayload{Region: game.FogRect{ID: "f1", W: -5, H: 10}}),
+		makeCommand(t, "set_initiative", game.SetInitiativePayload{Entries: []game.InitiativeEntry{{TokenID: "ghost"}}}),
+		makeCommand(t, "add_drawing", game.AddDrawingPayload{Drawing: game.Drawing{ID: "d1", Color: "red"}}),
+	} {
+		if _, err := processCommand(cmd, testContext(&state)); err == nil {
+			t.Errorf("expected %s %s to be refused", cmd.Type, cmd.Payload)
+		}
+	}
+}
+
+func TestSetGridType(t *testing.T) {
+	state := game.NewState()
+
+	if _, err := processCommand(makeCommand(t, "set_grid_type", game.SetGridTypePayload{GridType: game.GridIso}), testContext(&state)); err != nil || state.GridType != game.GridIso {
+		t.Errorf("expected the iso grid to be accepted, got %q (err %v)", state.GridType, err)
+	}
+	if _, err := processCommand(makeCommand(t, "set_grid_type", game.SetGridTypePayload{GridType: "hex"}), testContext(&state)); err == nil {
+		t.Error("expected an unknown grid type to be refused")
+	}
+}
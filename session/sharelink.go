@@ -0,0 +1,76 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RevokeShareLinkPayload names the share token to invalidate.
+type RevokeShareLinkPayload struct {
+	Token string `json:"token"`
+}
+
+// newShareToken returns a short random token that is hard to guess.
+func newShareToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CreateShareLink issues a token for joining the session read-only with
+// ?share=, e.g. for a projector. Only the session's GM may ask, proving it
+// with its reconnection token as a bearer token. Tokens live in memory and
+// are lost on restart.
+func (m *Manager) CreateShareLink(c *fiber.Ctx) error {
+	id := c.Params("id")
+	session, ok := m.lookup(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "session not found",
+		})
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !m.isSessionGM(c, session) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "forbidden",
+		})
+	}
+
+	token := newShareToken()
+	if session.shareLinks == nil {
+		session.shareLinks = make(map[string]bool)
+	}
+	session.shareLinks[token] = true
+	log.Println("share link created for session:", id)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"token": token,
+	})
+}
+
+// handleRevokeShareLink invalidates a share token and disconnects everyone
+// who joined with it.
+func handleRevokeShareLink(_ *Manager, session *Session, _ *ClientInfo, payload json.RawMessage) error {
+	var p RevokeShareLinkPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	if !session.shareLinks[p.Token] {
+		return nil
+	}
+	delete(session.shareLinks, p.Token)
+	for conn, info := range session.Clients {
+		if info.shareLink == p.Token {
+			info.removed = true
+			disconnect(conn, websocket.ClosePolicyViolation, "share link revoked")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Package upload stores images clients add to the assets served under /assets.
+package upload
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// UploadsDir is the subdirectory of the assets dir that uploads go to.
+const UploadsDir = "uploads"
+
+// imageExtensions maps the accepted image types, as sniffed from the file
+// contents, to the extension they are stored with.
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+}
+
+// Handler accepts a multipart "file" upload of a PNG, JPEG or WebP
+// image of at most maxBytes, stores it under dir/uploads with a random name
+// and responds with the /assets path to use in commands.
+func Handler(dir string, maxBytes int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "missing file",
+			})
+		}
+		if header.Size > maxBytes {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": "file too large",
+			})
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// Trust the contents rather than the client's declared type.
+		head := make([]byte, 512)
+		n, err := io.ReadFull(file, head)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unreadable file",
+			})
+		}
+		ext, ok := imageExtensions[http.DetectContentType(head[:n])]
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "only png, jpeg and webp images are accepted",
+			})
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		name := uuid.NewString() + ext
+		if err := save(filepath.Join(dir, UploadsDir), name, file); err != nil {
+			log.Println("upload failed:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to store upload",
+			})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"path": "/assets/" + UploadsDir + "/" + name,
+		})
+	}
+}
+
+func save(dir, name string, r io.Reader) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	out, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,80 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// pngHeader is enough of a PNG for content sniffing.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func upload(t *testing.T, dir string, maxBytes int64, contents []byte) (int, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "art.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(contents)
+	form.Close()
+
+	app := fiber.New()
+	app.Post("/upload", Handler(dir, maxBytes))
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Path string `json:"path"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result.Path
+}
+
+func TestUploadStoresImage(t *testing.T) {
+	dir := t.TempDir()
+
+	status, path := upload(t, dir, 1<<20, pngHeader)
+
+	if status != fiber.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	name, ok := strings.CutPrefix(path, "/assets/uploads/")
+	if !ok || !strings.HasSuffix(name, ".png") {
+		t.Fatalf("unexpected path %q", path)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, UploadsDir, name))
+	if err != nil || !bytes.Equal(stored, pngHeader) {
+		t.Errorf("expected the upload to be stored, got %q (%v)", stored, err)
+	}
+}
+
+func TestUploadRejectsNonImages(t *testing.T) {
+	status, _ := upload(t, t.TempDir(), 1<<20, []byte("#!/bin/sh\nrm -rf /\n"))
+
+	if status != fiber.StatusBadRequest {
+		t.Errorf("expected 400, got %d", status)
+	}
+}
+
+func TestUploadRejectsLargeFiles(t *testing.T) {
+	status, _ := upload(t, t.TempDir(), 8, pngHeader)
+
+	if status != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", status)
+	}
+}